@@ -0,0 +1,279 @@
+// Command cluster starts every node of a topology file, either as gossipers
+// in this process or as hw1_new children, and stops them all on interrupt.
+//
+// Example of how to run it:
+//
+//	./cluster/cluster -topology=cluster/topologies/topo4.dot
+//	./cluster/cluster -topology=cluster/topologies/line.dot -exec=./hw1_new
+//
+// Nodes without address or UI port in the topology get consecutive ones,
+// starting at -gossipPort and -UIPort. In process the UI is not available,
+// the output of each node is prefixed by its name.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.dedis.ch/cs438/hw1/gossip"
+	"go.dedis.ch/cs438/hw1/topology"
+)
+
+// stopTimeout is how long the children have to stop after an interrupt before
+// being killed.
+const stopTimeout = 5 * time.Second
+
+func main() {
+
+	topoPath := flag.String("topology", "", "topology file describing the nodes and their peers")
+	bin := flag.String("exec", "", "path of the hw1_new binary to start a process per node, the nodes run in this process if empty")
+	host := flag.String("host", "127.0.0.1", "host of the nodes without address")
+	gossipPort := flag.Int("gossipPort", 5000, "first gossip port given to the nodes without address")
+	UIPort := flag.Int("UIPort", 8080, "first UI port given to the nodes without UI port")
+	broadcastMode := flag.Bool("broadcast", false, "run the children in broadcast mode")
+	network := flag.String("network", "", "ID of the network of the nodes")
+	networkKey := flag.String("networkKey", "", "pre-shared key of the network of the nodes, the network is open if empty")
+	flag.Parse()
+
+	if *topoPath == "" {
+		fmt.Fprintln(os.Stderr, "missing -topology")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	topo, err := topology.Load(*topoPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", *topoPath, err)
+		os.Exit(1)
+	}
+
+	topo.AssignAddresses(*host, *gossipPort, *UIPort)
+
+	err = topo.Validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", *topoPath, err)
+		os.Exit(1)
+	}
+
+	stdout := &lockedWriter{w: os.Stdout}
+
+	// the nodes only hear each other
+	var opts []gossip.Option
+	var args []string
+	if *networkKey != "" {
+		opts = append(opts, gossip.WithNetwork(*network, []byte(*networkKey)))
+		args = append(args, "-network="+*network, "-networkKey="+*networkKey)
+	}
+
+	for _, n := range topo.Nodes {
+		fmt.Fprintf(stdout, "node %v gossip %v UI %v peers %v\n",
+			n.Name, n.Addr, n.UIPort, strings.Join(topo.Peers(n.Name), ","))
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	if *bin == "" {
+		err = runInProcess(topo, opts, stdout, interrupt)
+	} else {
+		err = runChildren(topo, *bin, *broadcastMode, args, stdout, interrupt)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runInProcess runs a gossiper per node, with the given options, until an
+// interrupt.
+func runInProcess(topo *topology.Topology, opts []gossip.Option, stdout io.Writer,
+	interrupt chan os.Signal) error {
+
+	fac := gossip.GetFactory()
+	nodes := make([]gossip.BaseGossiper, 0, len(topo.Nodes))
+
+	// stop the nodes started so
+	// far if one cannot start
+	defer func() {
+		for _, g := range nodes {
+			g.Stop()
+		}
+	}()
+
+	for _, n := range topo.Nodes {
+
+		g, err := fac.New(n.Addr, n.Name, n.AntiEntropy, n.RouteTimer,
+			append(opts, gossip.WithOutput(&prefixWriter{prefix: n.Name, w: stdout}))...)
+		if err != nil {
+			return fmt.Errorf("failed to create %v: %v", n.Name, err)
+		}
+
+		peers := topo.Peers(n.Name)
+		if len(peers) > 0 {
+			err = g.AddAddresses(peers...)
+			if err != nil {
+				return fmt.Errorf("failed to add peers of %v: %v", n.Name, err)
+			}
+		}
+
+		ready := make(chan struct{})
+		go g.Run(ready)
+		<-ready
+
+		nodes = append(nodes, g)
+	}
+
+	<-interrupt
+	fmt.Fprintln(stdout, "stopping the nodes")
+
+	return nil
+}
+
+// runChildren starts a process per node, with the given extra arguments,
+// until an interrupt, or until a child exits.
+func runChildren(topo *topology.Topology, bin string, broadcastMode bool, extra []string,
+	stdout io.Writer, interrupt chan os.Signal) error {
+
+	cmds := make([]*exec.Cmd, 0, len(topo.Nodes))
+	exited := make(chan string, len(topo.Nodes))
+
+	var wg sync.WaitGroup
+
+	for _, n := range topo.Nodes {
+
+		args := []string{
+			"-UIPort=" + n.UIPort,
+			"-gossipAddr=" + n.Addr,
+			"-name=" + n.Name,
+			"-peers=" + strings.Join(topo.Peers(n.Name), ","),
+			"-antiEntropy=" + strconv.Itoa(n.AntiEntropy),
+			"-rtimer=" + strconv.Itoa(n.RouteTimer),
+			"-broadcast=" + strconv.FormatBool(broadcastMode),
+		}
+
+		cmd := exec.Command(bin, append(args, extra...)...)
+
+		out := &prefixWriter{prefix: n.Name, w: stdout}
+		cmd.Stdout = out
+		cmd.Stderr = out
+
+		err := cmd.Start()
+		if err != nil {
+			stopChildren(cmds, &wg)
+			return fmt.Errorf("failed to start %v: %v", n.Name, err)
+		}
+		cmds = append(cmds, cmd)
+
+		name := n.Name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := cmd.Wait()
+			out.Flush()
+			if err != nil {
+				exited <- fmt.Sprintf("%v exited: %v", name, err)
+			} else {
+				exited <- fmt.Sprintf("%v exited", name)
+			}
+		}()
+	}
+
+	select {
+	case <-interrupt:
+		fmt.Fprintln(stdout, "stopping the nodes")
+	case reason := <-exited:
+		fmt.Fprintf(stdout, "%v, stopping the nodes\n", reason)
+	}
+
+	stopChildren(cmds, &wg)
+	return nil
+}
+
+// stopChildren interrupts the children and waits for them, killing the ones
+// still running after stopTimeout.
+func stopChildren(cmds []*exec.Cmd, wg *sync.WaitGroup) {
+
+	for _, cmd := range cmds {
+		// the child may already be gone
+		cmd.Process.Signal(os.Interrupt)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		for _, cmd := range cmds {
+			cmd.Process.Kill()
+		}
+		<-done
+	}
+}
+
+// lockedWriter serializes the writes of the nodes.
+type lockedWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.w.Write(b)
+}
+
+// prefixWriter writes every complete line prefixed by the name of a node, so
+// that the lines of different nodes do not mix.
+type prefixWriter struct {
+	sync.Mutex
+	prefix string
+	w      io.Writer
+	buf    bytes.Buffer
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.buf.Write(b)
+
+	for {
+		i := bytes.IndexByte(p.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+
+		line := p.buf.Next(i + 1)
+		_, err := fmt.Fprintf(p.w, "[%v] %s", p.prefix, line)
+		if err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// Flush writes the last line, even if it is not complete.
+func (p *prefixWriter) Flush() {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.buf.Len() > 0 {
+		fmt.Fprintf(p.w, "[%v] %s\n", p.prefix, p.buf.Bytes())
+		p.buf.Reset()
+	}
+}
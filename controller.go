@@ -33,28 +33,42 @@ type Controller struct {
 	messages      []CtrlMessage
 	// simpleMode: true if the gossiper should broadcast messages from clients as SimpleMessages
 	simpleMode bool
+	// hopLimit is the number of hops private messages from clients can travel
+	hopLimit int
 }
 
 type CtrlMessage struct {
 	Origin string
 	ID     uint32
 	Text   string
+
+	// Private messages are shown with whether they were encrypted for us and
+	// signed by the key of their origin
+	Private       bool
+	Decrypted     bool
+	Authenticated bool
 }
 
 // NewController returns the controller that sets up the gossiping state machine
 // as well as the web routing. It uses the same gossiping address for the
 // identifier.
 func NewController(identifier, uiAddress, gossipAddress string, simpleMode bool,
-	g gossip.BaseGossiper, addresses ...string) *Controller {
+	hopLimit int, g gossip.BaseGossiper, addresses ...string) *Controller {
 
 	c := &Controller{
 		identifier:    identifier,
 		uiAddress:     uiAddress,
 		gossipAddress: gossipAddress,
 		simpleMode:    simpleMode,
+		hopLimit:      hopLimit,
 		gossiper:      g,
 	}
 
+	// the history restored by the gossiper
+	for _, m := range g.GetMessages() {
+		c.messages = append(c.messages, CtrlMessage{m.Origin, m.ID, m.Text, false, false, false})
+	}
+
 	g.RegisterCallback(c.NewMessage)
 
 	return c
@@ -70,6 +84,10 @@ func (c *Controller) Run() {
 	r.Methods("POST").Path("/node").HandlerFunc(c.PostNode)
 	r.Methods("GET").Path("/id").HandlerFunc(c.GetIdentifier)
 	r.Methods("POST").Path("/id").HandlerFunc(c.SetIdentifier)
+	r.Methods("GET").Path("/ban").HandlerFunc(c.GetBans)
+	r.Methods("POST").Path("/ban").HandlerFunc(c.PostBan)
+	r.Methods("DELETE").Path("/ban").HandlerFunc(c.DeleteBan)
+	r.Methods("GET").Path("/limits").HandlerFunc(c.GetLimits)
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
 	loggedRouter := handlers.LoggingHandler(os.Stdout, r)
 
@@ -118,15 +136,20 @@ func (c *Controller) PostMessage(w http.ResponseWriter, r *http.Request) {
 
 	if c.simpleMode {
 		c.gossiper.AddSimpleMessage(message.Contents)
-		c.messages = append(c.messages, CtrlMessage{c.identifier, 0, message.Contents})
+		c.messages = append(c.messages, CtrlMessage{c.identifier, 0, message.Contents, false, false, false})
 	} else {
 		if message.Destination != "" {
-			c.gossiper.AddPrivateMessage(message.Contents, message.Destination, c.gossiper.GetIdentifier(), 10)
-			c.messages = append(c.messages, CtrlMessage{c.identifier, 0, message.Contents})
+			err = c.gossiper.AddPrivateMessage(message.Contents, message.Destination, c.gossiper.GetIdentifier(), c.hopLimit)
+			if err != nil {
+				log.Error(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.messages = append(c.messages, CtrlMessage{c.identifier, 0, message.Contents, true, true, true})
 		} else {
 
 			id := c.gossiper.AddMessage(message.Contents)
-			c.messages = append(c.messages, CtrlMessage{c.identifier, id, message.Contents})
+			c.messages = append(c.messages, CtrlMessage{c.identifier, id, message.Contents, false, false, false})
 		}
 
 	}
@@ -190,7 +213,61 @@ func (c *Controller) SetIdentifier(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Lvl1("GUI set identifier")
 	fmt.Println("gui set identifier")
-	c.gossiper.SetIdentifier(id)
+	err := c.gossiper.SetIdentifier(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// GET /ban returns the banned addresses and IPs, with when their ban expires,
+// as a json encoded map
+func (c *Controller) GetBans(w http.ResponseWriter, r *http.Request) {
+	bans := c.gossiper.GetBans()
+	if err := json.NewEncoder(w).Encode(bans); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// POST /ban with the address or IP to ban in the body as a string. The ban
+// lasts the default duration
+func (c *Controller) PostBan(w http.ResponseWriter, r *http.Request) {
+	text, ok := readString(w, r)
+	if !ok {
+		return
+	}
+	log.Lvl1("GUI ban", text)
+	if err := c.gossiper.Ban(text, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// DELETE /ban with the address or IP to unban in the body as a string
+func (c *Controller) DeleteBan(w http.ResponseWriter, r *http.Request) {
+	text, ok := readString(w, r)
+	if !ok {
+		return
+	}
+	log.Lvl1("GUI unban", text)
+	c.gossiper.Unban(text)
+	w.WriteHeader(200)
+}
+
+// GET /limits returns the number of packets dropped by the rate limits and
+// the bans as json encoded counters
+func (c *Controller) GetLimits(w http.ResponseWriter, r *http.Request) {
+	stats := c.gossiper.GetLimitStats()
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(200)
 }
 
@@ -201,11 +278,16 @@ func (c *Controller) NewMessage(origin string, msg gossip.GossipPacket) {
 
 	if msg.Rumor != nil {
 
-		c.messages = append(c.messages, CtrlMessage{msg.Rumor.Origin, msg.Rumor.ID, msg.Rumor.Text})
+		c.messages = append(c.messages, CtrlMessage{msg.Rumor.Origin, msg.Rumor.ID, msg.Rumor.Text, false, false, false})
 	}
 	if msg.Simple != nil {
 
-		c.messages = append(c.messages, CtrlMessage{msg.Simple.OriginPeerName, 0, msg.Simple.Contents})
+		c.messages = append(c.messages, CtrlMessage{msg.Simple.OriginPeerName, 0, msg.Simple.Contents, false, false, false})
+	}
+	if msg.Private != nil {
+
+		c.messages = append(c.messages, CtrlMessage{msg.Private.Origin, 0, msg.Private.Text,
+			true, msg.Private.Decrypted, msg.Private.Authenticated})
 	}
 	log.Lvl1("messages", c.messages)
 }
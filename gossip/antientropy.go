@@ -0,0 +1,210 @@
+package gossip
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"go.dedis.ch/cs438/hw1/gossip/clock"
+)
+
+// catchUpInterval is the delay between two rumors sent to a peer that is
+// catching up after a status exchange.
+const catchUpInterval = 5 * time.Millisecond
+
+// catchUpGrace is how long a stream waits for the peer to acknowledge its last
+// rumors. After that, a status from the peer can start a new stream, which
+// resends the rumors that were lost.
+const catchUpGrace = 500 * time.Millisecond
+
+// catchUpStream sends, one after the other, the rumors a peer is missing.
+// There is at most one stream per peer, so that the status packets the peer
+// sends to acknowledge each rumor do not start new streams.
+type catchUpStream struct {
+	// rumors are the rumors left to send, in order
+	rumors []*RumorMessage
+	// last holds the highest ID sent so far for each origin
+	last map[string]uint32
+	// timer paces the sending, then expires the stream
+	// if the peer does not acknowledge the last rumors
+	timer clock.Timer
+}
+
+// missingRumors returns the rumors that a peer whose status is given by want
+// does not have yet, sorted by origin and ID. It must be called with g.mux
+// held.
+func (g *Gossiper) missingRumors(want map[string]uint32) []*RumorMessage {
+
+	origins := make([]string, 0, len(g.messages))
+	for origin := range g.messages {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	missing := make([]*RumorMessage, 0)
+	for _, origin := range origins {
+
+		var start uint32 = 1
+		if next, ok := want[origin]; ok {
+			start = next
+		}
+
+		rumors := g.messages[origin]
+		for id := start; id <= uint32(len(rumors)); id++ {
+			missing = append(missing, rumors[id-1])
+		}
+	}
+
+	return missing
+}
+
+// catchingUp tells whether a stream to addr is still running. A stream is
+// over once the peer acknowledged every rumor of the stream. It must be called
+// with g.mux held.
+func (g *Gossiper) catchingUp(addr string, want map[string]uint32) bool {
+
+	stream, ok := g.catchUps[addr]
+	if !ok {
+		return false
+	}
+
+	if len(stream.rumors) > 0 {
+		return true
+	}
+
+	for origin, last := range stream.last {
+		if want[origin] <= last {
+			return true
+		}
+	}
+
+	stream.timer.Stop()
+	delete(g.catchUps, addr)
+	return false
+}
+
+// catchUp starts a stream sending the rumors to the peer, unless one is
+// already running. It must be called with g.mux held.
+func (g *Gossiper) catchUp(to *net.UDPAddr, rumors []*RumorMessage) {
+
+	key := to.String()
+
+	if _, ok := g.catchUps[key]; ok {
+		return
+	}
+
+	stream := &catchUpStream{
+		rumors: rumors,
+		last:   make(map[string]uint32),
+	}
+	g.catchUps[key] = stream
+
+	var next func()
+	next = func() {
+
+		g.mux.Lock()
+		defer g.mux.Unlock()
+
+		// the stream was stopped or
+		// has been replaced
+		if g.catchUps[key] != stream {
+			return
+		}
+
+		// give the peer some time to acknowledge
+		// the last rumors before letting another
+		// status start a new stream
+		if len(stream.rumors) == 0 {
+			delete(g.catchUps, key)
+			return
+		}
+
+		// queued in order, we are
+		// not in the Run() routine
+		if g.readsBatches(to) {
+			g.send(GossipPacket{Batch: g.nextBatch(stream, to)}, to)
+		} else {
+			rumor := stream.rumors[0]
+			stream.rumors = stream.rumors[1:]
+			stream.last[rumor.Origin] = rumor.ID
+
+			g.send(GossipPacket{Rumor: rumor}, to)
+		}
+
+		if len(stream.rumors) == 0 {
+			stream.timer = g.clock.AfterFunc(catchUpGrace, next)
+		} else {
+			stream.timer = g.clock.AfterFunc(catchUpInterval, next)
+		}
+	}
+
+	// the first rumor leaves right away
+	stream.timer = g.clock.AfterFunc(0, next)
+}
+
+// readsBatches tells whether the peer reads batches. It must be called with
+// g.mux held.
+func (g *Gossiper) readsBatches(to *net.UDPAddr) bool {
+
+	return g.wireFormat == WireBinary && g.peerWire[to.String()] >= batchVersion
+}
+
+// nextBatch takes from the stream as many rumors as fit in a datagram, at
+// least one. The last batch of the stream also carries our status if it fits,
+// so that the peer sends us the rumors we miss. It must be called with g.mux
+// held.
+func (g *Gossiper) nextBatch(stream *catchUpStream, to *net.UDPAddr) *BatchPacket {
+
+	max := g.maxDatagramSize - g.envelopeSize()
+	size := binaryHeaderSize
+
+	batch := &BatchPacket{Rumors: make([]*RumorMessage, 0)}
+
+	for len(stream.rumors) > 0 {
+
+		rumor := stream.rumors[0]
+
+		s := batchEntrySize(&BatchPacket{Rumors: []*RumorMessage{rumor}})
+		if len(batch.Rumors) > 0 && size+s > max {
+			return batch
+		}
+
+		batch.Rumors = append(batch.Rumors, rumor)
+		size += s
+
+		stream.rumors = stream.rumors[1:]
+		stream.last[rumor.Origin] = rumor.ID
+	}
+
+	status := &StatusPacket{Want: g.map2slice()}
+	if size+batchEntrySize(&BatchPacket{Status: status}) <= max {
+		batch.Status = status
+	}
+
+	return batch
+}
+
+// batchEntrySize returns the size the rumors and status of the batch add to a
+// batch in the binary format.
+func batchEntrySize(b *BatchPacket) int {
+
+	p, err := encodeBinary(GossipPacket{Batch: b}, batchVersion)
+
+	// Should really never happen
+	if err != nil {
+		panic(fmt.Sprintf("Could not encode batch: %v", err))
+	}
+
+	return len(p) - binaryHeaderSize
+}
+
+// stopCatchUps stops every running stream. It must be called with g.mux
+// held.
+func (g *Gossiper) stopCatchUps() {
+
+	for addr, stream := range g.catchUps {
+		stream.timer.Stop()
+		delete(g.catchUps, addr)
+	}
+}
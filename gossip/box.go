@@ -0,0 +1,220 @@
+package gossip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// boxContext is mixed into the key of every encrypted private message.
+const boxContext = "peerster private v1"
+
+// privateSignatureContext prefixes the signed bytes of a private message.
+const privateSignatureContext = "peerster private message v1"
+
+// privateSignedBytes returns the bytes the signature of a private message
+// covers: its origin, destination and text.
+func privateSignedBytes(origin, dest, text string) []byte {
+	w := &tlvWriter{b: []byte(privateSignatureContext)}
+	w.bytes(1, []byte(origin))
+	w.bytes(2, []byte(dest))
+	w.bytes(3, []byte(text))
+	return w.b
+}
+
+// boxKeyFor derives the AEAD key of a message from the Diffie-Hellman secret
+// and both public keys.
+func boxKeyFor(secret, ephemeral, recipient []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(boxContext))
+	h.Write(secret)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	return h.Sum(nil)
+}
+
+// seal encrypts the plaintext for the owner of the given X25519 public key,
+// with a new ephemeral key drawn from entropy. The destination is
+// authenticated too. It returns the ephemeral public key and the nonce
+// followed by the ciphertext.
+func seal(entropy io.Reader, recipient []byte, dest string, plaintext []byte) ([]byte, []byte, error) {
+
+	pub, err := ecdh.X25519().NewPublicKey(recipient)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("invalid encryption key: %v", err)
+	}
+
+	// GenerateKey may read an extra byte
+	// at random, the key is read as is so
+	// that a seeded reader replays it
+	seed := make([]byte, 32)
+	_, err = io.ReadFull(entropy, seed)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("failed to generate key: %v", err)
+	}
+
+	ephemeral, err := ecdh.X25519().NewPrivateKey(seed)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("failed to generate key: %v", err)
+	}
+
+	secret, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("failed to agree on a key: %v", err)
+	}
+
+	aead, err := newAEAD(boxKeyFor(secret, ephemeral.PublicKey().Bytes(), recipient))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(entropy, nonce)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("failed to generate nonce: %v", err)
+	}
+
+	return ephemeral.PublicKey().Bytes(), aead.Seal(nonce, nonce, plaintext, []byte(dest)), nil
+}
+
+// open decrypts a message sealed for the given X25519 private key.
+func open(key *ecdh.PrivateKey, dest string, ephemeral, ciphertext []byte) ([]byte, error) {
+
+	pub, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid ephemeral key: %v", err)
+	}
+
+	secret, err := key.ECDH(pub)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to agree on a key: %v", err)
+	}
+
+	aead, err := newAEAD(boxKeyFor(secret, ephemeral, key.PublicKey().Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, xerrors.Errorf("truncated ciphertext")
+	}
+
+	nonce := ciphertext[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[aead.NonceSize():], []byte(dest))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to decrypt: %v", err)
+	}
+
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create cipher: %v", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create AEAD: %v", err)
+	}
+
+	return aead, nil
+}
+
+// encryptPrivate replaces the origin, ID and text of the message by their
+// encryption for the destination, along with a signature of the sender. It
+// must be called with g.mux held.
+func (g *Gossiper) encryptPrivate(msg *PrivateMessage) error {
+
+	recipient, ok := g.boxKeys[msg.Destination]
+
+	// Might happen sometimes
+	// No route rumor from the destination yet
+	if !ok {
+		return xerrors.Errorf("no encryption key for %v", msg.Destination)
+	}
+
+	inner := &tlvWriter{}
+	inner.string(1, msg.Origin)
+	inner.uint(2, uint64(msg.ID))
+	inner.string(3, msg.Text)
+	inner.blob(4, g.GetPublicKey())
+	inner.blob(5, ed25519.Sign(g.key, privateSignedBytes(msg.Origin, msg.Destination, msg.Text)))
+
+	ephemeral, ciphertext, err := seal(g.entropy, recipient, msg.Destination, inner.b)
+	if err != nil {
+		return err
+	}
+
+	msg.Origin = ""
+	msg.ID = 0
+	msg.Text = ""
+	msg.EphemeralKey = ephemeral
+	msg.Ciphertext = ciphertext
+
+	return nil
+}
+
+// decryptPrivate returns the message sent to us, decrypted. The message is
+// authenticated if the sender signed it with the key bound to its origin, by
+// the rumors of that origin. It must be called with g.mux held.
+func (g *Gossiper) decryptPrivate(msg *PrivateMessage) (*PrivateMessage, error) {
+
+	plaintext, err := open(g.boxKey, msg.Destination, msg.EphemeralKey, msg.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &PrivateMessage{
+		Destination: msg.Destination,
+		HopLimit:    msg.HopLimit,
+		Decrypted:   true,
+	}
+
+	var key, signature []byte
+
+	err = readFields(plaintext, func(tag byte, v []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			out.Origin = string(v)
+		case 2:
+			out.ID, err = readUint32(v)
+		case 3:
+			out.Text = string(v)
+		case 4:
+			key = v
+		case 5:
+			signature = v
+		}
+		return err
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("invalid private message: %v", err)
+	}
+
+	if len(key) != ed25519.PublicKeySize ||
+		!ed25519.Verify(key, privateSignedBytes(out.Origin, out.Destination, out.Text), signature) {
+		return out, nil
+	}
+
+	// only the signed rumors bind a key to
+	// an origin, a private message cannot
+	// claim an origin we never heard of
+	known, ok := g.keys[out.Origin]
+	out.Authenticated = ok && known.Equal(ed25519.PublicKey(key))
+	return out, nil
+}
+
+// GetBoxKey returns the X25519 public key private messages to this gossiper
+// are encrypted with.
+func (g *Gossiper) GetBoxKey() []byte {
+	return g.boxKey.PublicKey().Bytes()
+}
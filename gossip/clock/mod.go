@@ -0,0 +1,20 @@
+package clock
+
+import "time"
+
+// Clock provides the time to a gossiper, so that it can run either on the
+// wall clock or on a virtual time driven by a simulator.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc waits for the duration to elapse and then calls f. The
+	// returned timer can cancel the call.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a call scheduled by Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the call from happening. It returns false if the call
+	// already happened or was already stopped.
+	Stop() bool
+}
@@ -0,0 +1,19 @@
+package clock
+
+import "time"
+
+// Real is the wall clock. Calls scheduled with AfterFunc run in their own
+// routine.
+//
+// - implements clock.Clock
+type Real struct{}
+
+// Now implements clock.Clock
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// AfterFunc implements clock.Clock
+func (Real) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,184 @@
+package clock
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Virtual is a clock whose time only advances when its owner steps it.
+// Scheduled calls run one at a time, in the routine stepping the clock, in the
+// order of their deadlines. Calls with the same deadline run in the order they
+// were scheduled, which makes a run reproducible.
+//
+// - implements clock.Clock
+type Virtual struct {
+	sync.Mutex
+
+	now   time.Time
+	seq   uint64
+	queue eventQueue
+}
+
+// NewVirtual returns a virtual clock starting at the given time.
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+// Now implements clock.Clock
+func (v *Virtual) Now() time.Time {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.now
+}
+
+// AfterFunc implements clock.Clock. The call happens during a later Step, even
+// if the duration is zero.
+func (v *Virtual) AfterFunc(d time.Duration, f func()) Timer {
+	v.Lock()
+	defer v.Unlock()
+
+	if d < 0 {
+		d = 0
+	}
+
+	v.seq++
+	e := &event{
+		clock: v,
+		when:  v.now.Add(d),
+		seq:   v.seq,
+		f:     f,
+	}
+	heap.Push(&v.queue, e)
+
+	return e
+}
+
+// Step advances the time to the next scheduled call and runs it. It returns
+// false if no call is scheduled.
+func (v *Virtual) Step() bool {
+	v.Lock()
+
+	if len(v.queue) == 0 {
+		v.Unlock()
+		return false
+	}
+
+	e := heap.Pop(&v.queue).(*event)
+	v.now = e.when
+
+	// the call may schedule other calls
+	v.Unlock()
+	e.f()
+
+	return true
+}
+
+// RunUntil runs, in order, every call scheduled up to the given time, then
+// sets the time to it.
+func (v *Virtual) RunUntil(t time.Time) {
+	for {
+		next, ok := v.Next()
+		if !ok || next.After(t) {
+			break
+		}
+		v.Step()
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	if t.After(v.now) {
+		v.now = t
+	}
+}
+
+// Advance runs the calls scheduled within the given duration from now.
+func (v *Virtual) Advance(d time.Duration) {
+	v.RunUntil(v.Now().Add(d))
+}
+
+// Next returns the deadline of the next scheduled call, if any.
+func (v *Virtual) Next() (time.Time, bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	if len(v.queue) == 0 {
+		return time.Time{}, false
+	}
+
+	return v.queue[0].when, true
+}
+
+// Pending returns the number of scheduled calls.
+func (v *Virtual) Pending() int {
+	v.Lock()
+	defer v.Unlock()
+
+	return len(v.queue)
+}
+
+// event is a call scheduled on a virtual clock.
+//
+// - implements clock.Timer
+type event struct {
+	clock *Virtual
+	when  time.Time
+	seq   uint64
+	f     func()
+	// index in the queue, -1 once popped or removed
+	index int
+}
+
+// Stop implements clock.Timer
+func (e *event) Stop() bool {
+	e.clock.Lock()
+	defer e.clock.Unlock()
+
+	if e.index < 0 {
+		return false
+	}
+
+	heap.Remove(&e.clock.queue, e.index)
+	return true
+}
+
+// eventQueue is a min-heap of events ordered by deadline, then by scheduling
+// order.
+//
+// - implements heap.Interface
+type eventQueue []*event
+
+func (q eventQueue) Len() int {
+	return len(q)
+}
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].when.Equal(q[j].when) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].when.Before(q[j].when)
+}
+
+func (q eventQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *eventQueue) Push(x interface{}) {
+	e := x.(*event)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*q = old[:n-1]
+	return e
+}
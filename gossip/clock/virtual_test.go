@@ -0,0 +1,56 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtual_Order(t *testing.T) {
+	start := time.Unix(0, 0)
+	v := NewVirtual(start)
+
+	calls := make([]string, 0)
+	record := func(name string) func() {
+		return func() {
+			calls = append(calls, name)
+		}
+	}
+
+	v.AfterFunc(2*time.Second, record("c"))
+	v.AfterFunc(time.Second, record("a"))
+	v.AfterFunc(time.Second, record("b"))
+	v.AfterFunc(3*time.Second, func() {
+		// scheduled from a call, runs at the same time
+		v.AfterFunc(0, record("e"))
+		calls = append(calls, "d")
+	})
+
+	v.Advance(2 * time.Second)
+	require.Equal(t, []string{"a", "b", "c"}, calls)
+	require.Equal(t, start.Add(2*time.Second), v.Now())
+
+	for v.Step() {
+	}
+	require.Equal(t, []string{"a", "b", "c", "d", "e"}, calls)
+	require.Equal(t, start.Add(3*time.Second), v.Now())
+}
+
+func TestVirtual_Stop(t *testing.T) {
+	v := NewVirtual(time.Unix(0, 0))
+
+	called := false
+	timer := v.AfterFunc(time.Second, func() {
+		called = true
+	})
+	other := v.AfterFunc(2*time.Second, func() {})
+
+	require.True(t, timer.Stop())
+	require.False(t, timer.Stop())
+	require.Equal(t, 1, v.Pending())
+
+	v.Advance(time.Minute)
+	require.False(t, called)
+	require.False(t, other.Stop())
+}
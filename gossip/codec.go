@@ -0,0 +1,517 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net"
+
+	"golang.org/x/xerrors"
+)
+
+// WireFormat is the encoding of the packets sent to the peers.
+type WireFormat int
+
+const (
+	// WireJSON encodes every packet in JSON, like the first version of the
+	// protocol.
+	WireJSON WireFormat = iota
+	// WireBinary encodes the packets in a compact binary format for the peers
+	// known to read it, and in JSON for the others. The JSON packets
+	// advertise the binary format, so that peers learn it from each other.
+	WireBinary
+)
+
+// binaryMagic starts every packet in the binary format. A packet in JSON
+// starts with '{' and a fragment with fragmentMagic.
+const binaryMagic byte = 0xB1
+
+// wireVersion is the latest version of the binary format. A version only
+// adds fields, that older readers skip, or packet types, that are only sent
+// to the peers reading that version and that older readers drop.
+const wireVersion uint8 = 6
+
+// batchVersion is the version of the binary format that adds the batches.
+const batchVersion uint8 = 5
+
+// reads tells whether the peer reads the packets added by the given version
+// of the binary format. The peers we do not know the version of, and the ones
+// sending JSON without a version, read nothing newer than JSON. It must be
+// called with g.mux held.
+func (g *Gossiper) reads(to *net.UDPAddr, version uint8) bool {
+	return g.peerWire[to.String()] >= version
+}
+
+// errUnknownType is returned for a binary packet of a type we do not read,
+// added by a later version. Such packets are dropped silently.
+var errUnknownType = xerrors.New("unknown binary packet type")
+
+// binaryHeaderSize is the size of the header of a binary packet: the magic
+// byte, the version and the type of the packet.
+const binaryHeaderSize = 3
+
+// types of the binary packets
+const (
+	typeSimple       byte = 1
+	typeRumor        byte = 2
+	typeStatus       byte = 3
+	typePrivate      byte = 4
+	typePeerExchange byte = 5
+	typeDigest       byte = 6
+	typeIHave        byte = 7
+	typeGraft        byte = 8
+	typePrune        byte = 9
+	typeBatch        byte = 10
+)
+
+// encodeJSON encodes the packet in JSON. It advertises the given version of
+// the binary format, none if it is 0.
+func encodeJSON(p GossipPacket, version uint8) ([]byte, error) {
+	p.WireVersion = version
+	return json.Marshal(p)
+}
+
+// encodeBinary encodes the packet, which must carry a single message, in the
+// given version of the binary format. The body of a packet is a list of
+// fields, each of them made of a tag, the length of the value and the value.
+func encodeBinary(p GossipPacket, version uint8) ([]byte, error) {
+
+	w := &tlvWriter{b: []byte{binaryMagic, version, 0}}
+
+	count := 0
+
+	if p.Simple != nil {
+		count++
+		w.b[2] = typeSimple
+		w.string(1, p.Simple.OriginPeerName)
+		w.string(2, p.Simple.RelayPeerAddr)
+		w.string(3, p.Simple.Contents)
+	}
+
+	if p.Rumor != nil {
+		count++
+		w.b[2] = typeRumor
+		w.rumor(p.Rumor)
+	}
+
+	if p.Status != nil {
+		count++
+		w.b[2] = typeStatus
+		w.status(p.Status)
+	}
+
+	if p.Private != nil {
+		count++
+		w.b[2] = typePrivate
+		w.string(1, p.Private.Origin)
+		w.uint(2, uint64(p.Private.ID))
+		w.string(3, p.Private.Text)
+		w.string(4, p.Private.Destination)
+		w.int(5, int64(p.Private.HopLimit))
+		w.blob(6, p.Private.EphemeralKey)
+		w.blob(7, p.Private.Ciphertext)
+	}
+
+	if p.PeerExchange != nil {
+		count++
+		w.b[2] = typePeerExchange
+		for _, peer := range p.PeerExchange.Peers {
+			w.bytes(1, []byte(peer))
+		}
+	}
+
+	if p.Digest != nil {
+		count++
+		w.b[2] = typeDigest
+		w.blob(1, p.Digest.Hash)
+	}
+
+	if p.IHave != nil {
+		count++
+		w.b[2] = typeIHave
+		w.string(1, p.IHave.Origin)
+		w.uint(2, uint64(p.IHave.ID))
+	}
+
+	if p.Graft != nil {
+		count++
+		w.b[2] = typeGraft
+		w.string(1, p.Graft.Origin)
+		w.uint(2, uint64(p.Graft.ID))
+	}
+
+	if p.Prune != nil {
+		count++
+		w.b[2] = typePrune
+		w.string(1, p.Prune.Origin)
+	}
+
+	if p.Batch != nil {
+		count++
+		w.b[2] = typeBatch
+		for _, r := range p.Batch.Rumors {
+			entry := &tlvWriter{}
+			entry.rumor(r)
+			w.bytes(1, entry.b)
+		}
+		if p.Batch.Status != nil {
+			entry := &tlvWriter{}
+			entry.status(p.Batch.Status)
+			w.bytes(2, entry.b)
+		}
+	}
+
+	if count != 1 {
+		return nil, xerrors.Errorf("binary packets carry one message, not %d", count)
+	}
+
+	return w.b, nil
+}
+
+// decodePacket decodes a packet in JSON or in the binary format. It returns
+// the version of the binary format the sender reads: the one of the packet,
+// or the one advertised by a JSON packet.
+func decodePacket(b []byte) (GossipPacket, uint8, error) {
+
+	var p GossipPacket
+
+	if len(b) == 0 || b[0] != binaryMagic {
+		err := json.Unmarshal(b, &p)
+		if err != nil {
+			return p, 0, xerrors.Errorf("failed to decode JSON: %v", err)
+		}
+		return p, p.WireVersion, nil
+	}
+
+	if len(b) < binaryHeaderSize {
+		return p, 0, xerrors.Errorf("truncated binary header")
+	}
+
+	version := b[1]
+	if version == 0 || version > wireVersion {
+		return p, 0, xerrors.Errorf("unsupported binary version %d", version)
+	}
+
+	var err error
+	body := b[binaryHeaderSize:]
+
+	switch b[2] {
+	case typeSimple:
+		p.Simple, err = decodeSimple(body)
+	case typeRumor:
+		p.Rumor, err = decodeRumor(body)
+	case typeStatus:
+		p.Status, err = decodeStatus(body)
+	case typePrivate:
+		p.Private, err = decodePrivate(body)
+	case typePeerExchange:
+		p.PeerExchange, err = decodePeerExchange(body)
+	case typeDigest:
+		p.Digest, err = decodeDigest(body)
+	case typeIHave:
+		p.IHave = &IHavePacket{}
+		p.IHave.Origin, p.IHave.ID, err = decodeRumorID(body)
+	case typeGraft:
+		p.Graft = &GraftPacket{}
+		p.Graft.Origin, p.Graft.ID, err = decodeRumorID(body)
+	case typePrune:
+		p.Prune = &PrunePacket{}
+		p.Prune.Origin, _, err = decodeRumorID(body)
+	case typeBatch:
+		p.Batch, err = decodeBatch(body)
+	default:
+		err = xerrors.Errorf("type %d: %w", b[2], errUnknownType)
+	}
+
+	if err != nil {
+		return GossipPacket{}, 0, err
+	}
+
+	return p, version, nil
+}
+
+func decodeSimple(b []byte) (*SimpleMessage, error) {
+	msg := &SimpleMessage{}
+
+	err := readFields(b, func(tag byte, v []byte) error {
+		switch tag {
+		case 1:
+			msg.OriginPeerName = string(v)
+		case 2:
+			msg.RelayPeerAddr = string(v)
+		case 3:
+			msg.Contents = string(v)
+		}
+		return nil
+	})
+
+	return msg, err
+}
+
+func decodeRumor(b []byte) (*RumorMessage, error) {
+	msg := &RumorMessage{}
+
+	err := readFields(b, func(tag byte, v []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			msg.Origin = string(v)
+		case 2:
+			msg.ID, err = readUint32(v)
+		case 3:
+			msg.Text = string(v)
+		case 4:
+			msg.PublicKey = append([]byte(nil), v...)
+		case 5:
+			msg.Signature = append([]byte(nil), v...)
+		case 6:
+			msg.BoxKey = append([]byte(nil), v...)
+		}
+		return err
+	})
+
+	return msg, err
+}
+
+func decodeStatus(b []byte) (*StatusPacket, error) {
+	msg := &StatusPacket{Want: make([]PeerStatus, 0)}
+
+	err := readFields(b, func(tag byte, v []byte) error {
+		switch tag {
+		case 2:
+			msg.Probe = len(v) > 0 && v[0] != 0
+			return nil
+		case 3:
+			msg.Push = len(v) > 0 && v[0] != 0
+			return nil
+		case 4:
+			msg.Pull = len(v) > 0 && v[0] != 0
+			return nil
+		}
+		if tag != 1 {
+			return nil
+		}
+
+		var s PeerStatus
+		err := readFields(v, func(tag byte, v []byte) error {
+			var err error
+			switch tag {
+			case 1:
+				s.Identifier = string(v)
+			case 2:
+				s.NextID, err = readUint32(v)
+			}
+			return err
+		})
+
+		msg.Want = append(msg.Want, s)
+		return err
+	})
+
+	return msg, err
+}
+
+func decodePrivate(b []byte) (*PrivateMessage, error) {
+	msg := &PrivateMessage{}
+
+	err := readFields(b, func(tag byte, v []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			msg.Origin = string(v)
+		case 2:
+			msg.ID, err = readUint32(v)
+		case 3:
+			msg.Text = string(v)
+		case 4:
+			msg.Destination = string(v)
+		case 5:
+			msg.HopLimit, err = readInt(v)
+		case 6:
+			msg.EphemeralKey = append([]byte(nil), v...)
+		case 7:
+			msg.Ciphertext = append([]byte(nil), v...)
+		}
+		return err
+	})
+
+	return msg, err
+}
+
+func decodePeerExchange(b []byte) (*PeerExchangePacket, error) {
+	msg := &PeerExchangePacket{Peers: make([]string, 0)}
+
+	err := readFields(b, func(tag byte, v []byte) error {
+		if tag == 1 {
+			msg.Peers = append(msg.Peers, string(v))
+		}
+		return nil
+	})
+
+	return msg, err
+}
+
+func decodeDigest(b []byte) (*DigestPacket, error) {
+	msg := &DigestPacket{}
+
+	err := readFields(b, func(tag byte, v []byte) error {
+		if tag == 1 {
+			msg.Hash = append([]byte(nil), v...)
+		}
+		return nil
+	})
+
+	return msg, err
+}
+
+func decodeBatch(b []byte) (*BatchPacket, error) {
+	msg := &BatchPacket{Rumors: make([]*RumorMessage, 0)}
+
+	err := readFields(b, func(tag byte, v []byte) error {
+		switch tag {
+		case 1:
+			r, err := decodeRumor(v)
+			if err != nil {
+				return err
+			}
+			msg.Rumors = append(msg.Rumors, r)
+		case 2:
+			s, err := decodeStatus(v)
+			if err != nil {
+				return err
+			}
+			msg.Status = s
+		}
+		return nil
+	})
+
+	return msg, err
+}
+
+// decodeRumorID decodes the origin and ID of a rumor, which IHAVE and GRAFT
+// packets carry.
+func decodeRumorID(b []byte) (string, uint32, error) {
+	var origin string
+	var id uint32
+
+	err := readFields(b, func(tag byte, v []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			origin = string(v)
+		case 2:
+			id, err = readUint32(v)
+		}
+		return err
+	})
+
+	return origin, id, err
+}
+
+// tlvWriter appends fields to a binary packet. Empty strings and blobs, and
+// zero integers, are left out, readers take missing fields for zero values.
+type tlvWriter struct {
+	b []byte
+}
+
+func (w *tlvWriter) rumor(r *RumorMessage) {
+	w.string(1, r.Origin)
+	w.uint(2, uint64(r.ID))
+	w.string(3, r.Text)
+	w.blob(4, r.PublicKey)
+	w.blob(5, r.Signature)
+	w.blob(6, r.BoxKey)
+}
+
+func (w *tlvWriter) status(s *StatusPacket) {
+	for _, p := range s.Want {
+		entry := &tlvWriter{}
+		entry.string(1, p.Identifier)
+		entry.uint(2, uint64(p.NextID))
+		w.bytes(1, entry.b)
+	}
+	if s.Probe {
+		w.uint(2, 1)
+	}
+	if s.Push {
+		w.uint(3, 1)
+	}
+	if s.Pull {
+		w.uint(4, 1)
+	}
+}
+
+func (w *tlvWriter) bytes(tag byte, v []byte) {
+	var n [binary.MaxVarintLen64]byte
+	w.b = append(w.b, tag)
+	w.b = append(w.b, n[:binary.PutUvarint(n[:], uint64(len(v)))]...)
+	w.b = append(w.b, v...)
+}
+
+func (w *tlvWriter) blob(tag byte, v []byte) {
+	if len(v) > 0 {
+		w.bytes(tag, v)
+	}
+}
+
+func (w *tlvWriter) string(tag byte, s string) {
+	if s != "" {
+		w.bytes(tag, []byte(s))
+	}
+}
+
+func (w *tlvWriter) uint(tag byte, v uint64) {
+	if v != 0 {
+		var n [binary.MaxVarintLen64]byte
+		w.bytes(tag, n[:binary.PutUvarint(n[:], v)])
+	}
+}
+
+func (w *tlvWriter) int(tag byte, v int64) {
+	if v != 0 {
+		var n [binary.MaxVarintLen64]byte
+		w.bytes(tag, n[:binary.PutVarint(n[:], v)])
+	}
+}
+
+// readFields calls f for every field of b, in order. Fields with unknown tags
+// are given to f too, which ignores them.
+func readFields(b []byte, f func(tag byte, v []byte) error) error {
+
+	for len(b) > 0 {
+
+		tag := b[0]
+		length, n := binary.Uvarint(b[1:])
+		if n <= 0 || length > uint64(len(b)-1-n) {
+			return xerrors.Errorf("truncated field %d", tag)
+		}
+
+		start := 1 + n
+		end := start + int(length)
+
+		err := f(tag, b[start:end])
+		if err != nil {
+			return err
+		}
+
+		b = b[end:]
+	}
+
+	return nil
+}
+
+func readUint32(v []byte) (uint32, error) {
+	i, n := binary.Uvarint(v)
+	if n != len(v) || i > math.MaxUint32 {
+		return 0, xerrors.Errorf("invalid integer field")
+	}
+	return uint32(i), nil
+}
+
+func readInt(v []byte) (int, error) {
+	i, n := binary.Varint(v)
+	if n != len(v) || i > math.MaxInt32 || i < math.MinInt32 {
+		return 0, xerrors.Errorf("invalid integer field")
+	}
+	return int(i), nil
+}
@@ -0,0 +1,98 @@
+package gossip
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// compressMagic starts every compressed packet, followed by the packet
+// compressed with DEFLATE. The packet is compressed before being split into
+// fragments.
+const compressMagic byte = 0xC1
+
+// compressVersion is the version of the binary format that adds the
+// compressed packets.
+const compressVersion uint8 = 6
+
+// defaultCompressThreshold is the size above which the packets are
+// compressed.
+const defaultCompressThreshold = 512
+
+// compress compresses the packet if it is larger than the threshold, the peer
+// reads compressed packets, and it saves space. It must be called with g.mux
+// held.
+func (g *Gossiper) compress(b []byte, to *net.UDPAddr) []byte {
+
+	if g.compressThreshold <= 0 || len(b) <= g.compressThreshold {
+		return b
+	}
+
+	if g.wireFormat != WireBinary || g.peerWire[to.String()] < compressVersion {
+		return b
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(compressMagic)
+
+	if g.compressor == nil {
+		w, err := flate.NewWriter(&buf, flate.BestSpeed)
+
+		// Should really never happen
+		if err != nil {
+			log.Error("Could not create compressor:", err)
+			return b
+		}
+		g.compressor = w
+	} else {
+		g.compressor.Reset(&buf)
+	}
+
+	_, err := g.compressor.Write(b)
+	if err == nil {
+		err = g.compressor.Close()
+	}
+
+	// Should really never happen
+	if err != nil {
+		log.Error("Could not compress packet:", err)
+		return b
+	}
+
+	// random texts do not compress
+	if buf.Len() >= len(b) {
+		return b
+	}
+
+	return buf.Bytes()
+}
+
+// decompress returns the packet of a compressed packet, which must not be
+// larger than max once decompressed.
+func decompress(b []byte, max int) ([]byte, error) {
+
+	if len(b) == 0 || b[0] != compressMagic {
+		return nil, xerrors.Errorf("not a compressed packet")
+	}
+
+	r := flate.NewReader(bytes.NewReader(b[1:]))
+	defer r.Close()
+
+	// stop reading as soon as
+	// the packet is too large
+	p, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to decompress packet: %v", err)
+	}
+
+	if len(p) > max {
+		return nil, xerrors.Errorf("decompressed packet larger than %d bytes", max)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,102 @@
+package gossip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// AntiEntropyMode is what a gossiper sends to a random peer every
+// anti-entropy interval.
+type AntiEntropyMode int
+
+const (
+	// AntiEntropyStatus sends the status, one entry per origin.
+	AntiEntropyStatus AntiEntropyMode = iota
+	// AntiEntropyDigest sends a digest of the status, whose size does not
+	// depend on the number of origins. The peer answers with its status
+	// only if its digest differs, which starts the usual status exchange.
+	// The peers reading older versions of the binary format get the
+	// status.
+	AntiEntropyDigest
+)
+
+// SyncMode is the direction of the rumors exchanged with the peers contacted
+// by the anti-entropy.
+type SyncMode int
+
+const (
+	// SyncPushPull sends the peer the rumors it misses, and asks it for the
+	// rumors we miss.
+	SyncPushPull SyncMode = iota
+	// SyncPush only sends the peer the rumors it misses. The peer answers
+	// with its status if it misses some.
+	SyncPush
+	// SyncPull only asks the peer for the rumors we miss.
+	SyncPull
+)
+
+// digestVersion is the version of the binary format that adds the digests.
+const digestVersion uint8 = 3
+
+// digestSize is the size of a digest, a truncated SHA-256 of the status.
+const digestSize = 16
+
+// statusDigest returns the digest of our status. It is computed once for
+// each new rumor. It must be called with g.mux held.
+func (g *Gossiper) statusDigest() []byte {
+
+	if g.digest != nil {
+		return g.digest
+	}
+
+	var n [binary.MaxVarintLen64]byte
+
+	h := sha256.New()
+	for _, s := range g.map2slice() {
+		h.Write(n[:binary.PutUvarint(n[:], uint64(len(s.Identifier)))])
+		h.Write([]byte(s.Identifier))
+		h.Write(n[:binary.PutUvarint(n[:], uint64(s.NextID))])
+	}
+
+	g.digest = h.Sum(nil)[:digestSize]
+	return g.digest
+}
+
+// sendAntiEntropy sends our status, or its digest if the peer reads digests,
+// to the peer. The status tells the peer the direction of the exchange, a
+// digest always starts a push-pull exchange. It must be called with g.mux
+// held.
+func (g *Gossiper) sendAntiEntropy(to *net.UDPAddr) {
+
+	if g.antiEntropyMode != AntiEntropyDigest || !g.reads(to, digestVersion) {
+		g.send(GossipPacket{
+			Status: &StatusPacket{
+				Want: g.map2slice(),
+				Push: g.syncMode == SyncPush,
+				Pull: g.syncMode == SyncPull,
+			},
+		}, to)
+		return
+	}
+
+	g.send(GossipPacket{Digest: &DigestPacket{Hash: g.statusDigest()}}, to)
+}
+
+// Exec is the function that the gossiper uses to execute the handler for a
+// DigestPacket. We answer with our status if we are not in sync with the
+// sender.
+func (msg *DigestPacket) Exec(g *Gossiper, addr *net.UDPAddr) error {
+
+	g.addAddress(addr)
+
+	if bytes.Equal(msg.Hash, g.statusDigest()) {
+		fmt.Fprintf(g.out, "IN SYNC WITH %v\n", addr.String())
+		return nil
+	}
+
+	g.sendStatus(addr)
+	return nil
+}
@@ -0,0 +1,209 @@
+package gossip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"go.dedis.ch/cs438/hw1/gossip/transport"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// DefaultDiscoveryGroup is the multicast group the gossipers announce
+// themselves on, unless another one is given.
+const DefaultDiscoveryGroup = "239.255.43.8:33333"
+
+// beacon announces a gossiper on the discovery group. It is sealed with the
+// network key, if any, like the other datagrams.
+type beacon struct {
+	Network    string `json:"network"`
+	Identifier string `json:"identifier"`
+	Addr       string `json:"addr"`
+}
+
+// startDiscovery joins the discovery group, if any, and then announces this
+// gossiper every discovery interval until the gossiper stops. The gossipers
+// of our network announced on the group become peers. It must be called with
+// g.mux held.
+func (g *Gossiper) startDiscovery() {
+
+	if g.discoveryGroup == "" {
+		return
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", g.discoveryGroup)
+	if err == nil {
+		g.discovery, err = transport.NewMulticast(g.discoveryGroup)
+	}
+
+	// Might happen sometimes
+	// No multicast on this host
+	if err != nil {
+		log.Error("Discovery disabled:", err)
+		return
+	}
+
+	go g.receiveBeacons(g.discovery)
+
+	var tick func()
+	tick = func() {
+
+		g.mux.Lock()
+		defer g.mux.Unlock()
+
+		if g.stopped {
+			return
+		}
+
+		g.announce(group)
+		g.discoveryTimer = g.clock.AfterFunc(g.discoveryInterval, tick)
+	}
+
+	g.announce(group)
+	g.discoveryTimer = g.clock.AfterFunc(g.discoveryInterval, tick)
+}
+
+// announce sends our beacon to the discovery group. It must be called with
+// g.mux held.
+func (g *Gossiper) announce(group *net.UDPAddr) {
+
+	b, err := json.Marshal(beacon{
+		Network:    g.networkID,
+		Identifier: g.identifier,
+		Addr:       g.addr,
+	})
+
+	// Should really never happen
+	if err != nil {
+		log.Error("Could not encode beacon:", err)
+		return
+	}
+
+	err = g.discovery.Send(g.sealDatagram(b), group)
+
+	// Might happen once a day
+	if err != nil {
+		log.Error("Could not announce on", group, ":", err)
+	}
+}
+
+// receiveBeacons adds the gossipers announced on the discovery group to the
+// peers, until the discovery transport is closed.
+func (g *Gossiper) receiveBeacons(t transport.Transport) {
+
+	b := make([]byte, maxReceiveSize)
+
+	for {
+		n, sender, err := t.Receive(b)
+		if err == transport.ErrClosed {
+			return
+		}
+
+		// Might happen once a day
+		if err != nil {
+			log.Error("Could not receive beacon:", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		g.handleBeacon(b[:n], sender)
+	}
+}
+
+// isLocal tells whether the IP is one of the addresses of this host.
+func isLocal(ip net.IP) bool {
+
+	if ip.IsLoopback() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+
+	// Should really never happen
+	if err != nil {
+		return false
+	}
+
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleBeacon adds the gossiper announced by the beacon to the peers, if it
+// is a gossiper of our network other than us. The gossipers discovered are
+// learnt from the sender, within the same bounds as the peers exchanged.
+func (g *Gossiper) handleBeacon(b []byte, sender *net.UDPAddr) {
+
+	if !g.admit(sender) {
+		return
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if g.stopped {
+		return
+	}
+
+	// sealed for another network
+	b = g.openDatagram(b, sender)
+	if b == nil {
+		return
+	}
+
+	var bc beacon
+	err := json.Unmarshal(b, &bc)
+
+	// Might happen once a day
+	if err != nil {
+		log.Lvl2("Dropping invalid beacon from", sender, ":", err)
+		return
+	}
+
+	if bc.Network != g.networkID {
+		return
+	}
+
+	// our own beacon
+	if bc.Addr == g.addr && bc.Identifier == g.identifier {
+		return
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", bc.Addr)
+
+	// Might happen once a day
+	if err != nil {
+		log.Lvl2("Dropping invalid beacon from", sender, ":", err)
+		return
+	}
+
+	// the gossiper listens on every
+	// interface, the sender address
+	// is one of them
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = sender.IP
+	}
+
+	// a loopback address is only
+	// reachable on the same host
+	if addr.IP.IsLoopback() && !isLocal(sender.IP) {
+		addr.IP = sender.IP
+	}
+
+	if addr.String() == g.addr || g.isPeer(addr) {
+		return
+	}
+
+	if !g.learnPeer(addr, sender) {
+		log.Lvl2("Ignoring beacon from", sender, ": too many peers learnt")
+		return
+	}
+
+	fmt.Fprintf(g.out, "DISCOVERED %v at %v\n", bc.Identifier, addr)
+}
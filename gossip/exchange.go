@@ -0,0 +1,238 @@
+package gossip
+
+import (
+	"fmt"
+	"net"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// peerExchangeSample is the number of addresses sent in a peer exchange, at
+// most. The addresses beyond it in a received exchange are ignored.
+const peerExchangeSample = 8
+
+// defaultMaxPeers bounds the number of peers learnt from peer exchanges. The
+// peers given by the user and the ones that contact us are always added. The
+// peers learnt from exchanges are forgotten once dead, which makes room for
+// new ones.
+const defaultMaxPeers = 64
+
+// exchangeVersion is the version of the binary format that adds the peer
+// exchanges.
+const exchangeVersion uint8 = 2
+
+// maxPeersPerSource bounds the number of peers a single peer can make us
+// learn, so that it cannot fill the table with its own addresses.
+const maxPeersPerSource = 16
+
+// startPeerExchange sends a sample of our live peers to a random peer every
+// exchange interval, until the gossiper stops. An interval of 0 disables the
+// peer exchange. It must be called with g.mux held.
+func (g *Gossiper) startPeerExchange() {
+
+	if g.exchangeInterval <= 0 {
+		return
+	}
+
+	var tick func()
+	tick = func() {
+
+		g.mux.Lock()
+		defer g.mux.Unlock()
+
+		if g.stopped {
+			return
+		}
+
+		to := g.randomPeer()
+
+		// Might happen sometimes
+		if to != nil {
+			g.sendPeerExchange(to)
+		}
+
+		g.exchangeTimer = g.clock.AfterFunc(g.exchangeInterval, tick)
+	}
+
+	g.exchangeTimer = g.clock.AfterFunc(g.exchangeInterval, tick)
+}
+
+// sendPeerExchange sends a random sample of our live peers, other than the
+// receiver, to the receiver if it reads peer exchanges. It must be called
+// with g.mux held.
+func (g *Gossiper) sendPeerExchange(to *net.UDPAddr) {
+
+	if !g.reads(to, exchangeVersion) {
+		return
+	}
+
+	candidates := make([]string, 0, len(g.peers))
+	for _, peer := range g.peers {
+		if peer.String() != to.String() && !g.isDead(peer) {
+			candidates = append(candidates, peer.String())
+		}
+	}
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	g.ran.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	if len(candidates) > peerExchangeSample {
+		candidates = candidates[:peerExchangeSample]
+	}
+
+	g.send(GossipPacket{PeerExchange: &PeerExchangePacket{Peers: candidates}}, to)
+}
+
+// Exec is the function that the gossiper uses to execute the handler for a
+// PeerExchangePacket. The new addresses are added to the peers, within the
+// limits on the peers learnt from exchanges and from this sender.
+func (msg *PeerExchangePacket) Exec(g *Gossiper, addr *net.UDPAddr) error {
+
+	g.addAddress(addr)
+
+	peers := msg.Peers
+	if len(peers) > peerExchangeSample {
+		peers = peers[:peerExchangeSample]
+	}
+
+	for _, p := range peers {
+
+		peer, err := net.ResolveUDPAddr("udp", p)
+
+		// Might happen once a day
+		if err != nil {
+			log.Lvl2("Ignoring invalid peer", p, "from", addr)
+			continue
+		}
+
+		if peer.String() == g.addr || g.isPeer(peer) {
+			continue
+		}
+
+		if !g.learnPeer(peer, addr) {
+			log.Lvl2("Ignoring peers from", addr, ": too many peers learnt")
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// learnPeer adds the peer learnt from the source, unless we learnt too many
+// peers, or too many from the source, in which case it returns false. It must
+// be called with g.mux held.
+func (g *Gossiper) learnPeer(peer, source *net.UDPAddr) bool {
+
+	if len(g.learntFrom) >= g.maxPeers || g.injected[source.String()] >= maxPeersPerSource {
+		return false
+	}
+
+	g.addAddress(peer)
+	g.learn(peer.String(), source.String())
+	g.persist(learntRecord(peer.String(), source.String()))
+
+	return true
+}
+
+// learn records that the peer was learnt from the source. It must be called
+// with g.mux held.
+func (g *Gossiper) learn(peer, source string) {
+
+	g.learntFrom[peer] = source
+	g.injected[source]++
+}
+
+// unlearn removes the record of the peer learnt, and returns false if it was
+// not learnt from a source. It must be called with g.mux held.
+func (g *Gossiper) unlearn(peer string) bool {
+
+	source, ok := g.learntFrom[peer]
+	if !ok {
+		return false
+	}
+
+	delete(g.learntFrom, peer)
+	g.injected[source]--
+	if g.injected[source] == 0 {
+		delete(g.injected, source)
+	}
+
+	return true
+}
+
+// removePeer removes the address from our peers. It must be called with g.mux
+// held.
+func (g *Gossiper) removePeer(addr string) {
+
+	for i, peer := range g.peers {
+		if peer.String() == addr {
+			g.peers = append(g.peers[:i], g.peers[i+1:]...)
+			break
+		}
+	}
+
+	delete(g.liveness, addr)
+}
+
+// isPeer tells whether the address is one of our peers. It must be called
+// with g.mux held.
+func (g *Gossiper) isPeer(addr *net.UDPAddr) bool {
+
+	_, ok := g.liveness[addr.String()]
+	return ok
+}
+
+// forgetPeer removes a peer learnt from an exchange, along with the rumors
+// waiting for its acks and the catch up it gets. It must be called with g.mux
+// held.
+func (g *Gossiper) forgetPeer(addr string) {
+
+	if !g.unlearn(addr) {
+		return
+	}
+
+	g.removePeer(addr)
+	g.persist(forgetRecord(addr))
+
+	delete(g.peerWire, addr)
+
+	if q, ok := g.queues[addr]; ok {
+		q.close()
+		delete(g.queues, addr)
+	}
+
+	// the anti-entropy spreads the
+	// rumors it did not acknowledge
+	for _, entry := range g.mongering[addr] {
+		entry.timer.Stop()
+	}
+	delete(g.mongering, addr)
+
+	if stream, ok := g.catchUps[addr]; ok {
+		stream.timer.Stop()
+		delete(g.catchUps, addr)
+	}
+
+	for _, m := range g.missing {
+		for i, a := range m.announcers {
+			if a.String() == addr {
+				m.announcers = append(m.announcers[:i:i], m.announcers[i+1:]...)
+				break
+			}
+		}
+	}
+
+	for origin, peers := range g.lazy {
+		delete(peers, addr)
+		if len(peers) == 0 {
+			delete(g.lazy, origin)
+		}
+	}
+
+	fmt.Fprintf(g.out, "PEER %v FORGOTTEN\n", addr)
+}
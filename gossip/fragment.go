@@ -0,0 +1,273 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"go.dedis.ch/cs438/hw1/gossip/clock"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// fragmentMagic starts every fragment. A packet in JSON starts with '{', so
+// both can be told apart from their first byte.
+const fragmentMagic byte = 0xF1
+
+// fragmentHeaderSize is the size of the header of a fragment: the magic byte,
+// the ID of the packet, the index of the fragment and the number of
+// fragments.
+const fragmentHeaderSize = 1 + 4 + 2 + 2
+
+// defaultMaxDatagramSize is the size of the largest datagram sent. It is the
+// usual size of a MTU, which is also what peers without reassembly read.
+const defaultMaxDatagramSize = 1500
+
+// defaultMaxPacketSize bounds the size of a packet, once reassembled.
+const defaultMaxPacketSize = 1 << 20
+
+// maxReceiveSize is the size of the largest UDP datagram, the size of the
+// buffer Run reads into.
+const maxReceiveSize = 65535
+
+// reassemblyTimeout is how long the fragments of a packet are kept waiting
+// for the missing ones.
+const reassemblyTimeout = 5 * time.Second
+
+// maxReassemblyPackets is how many packets, of at most the maximum packet
+// size, can be reassembled at the same time.
+const maxReassemblyPackets = 4
+
+// minFragmentPayload is the smallest payload of a fragment, but the last one
+// of a packet. It bounds the number of fragments of a packet.
+const minFragmentPayload = 256
+
+// maxPartials bounds the number of incomplete packets, and
+// maxPartialsPerSender the number of those from a single sender.
+const (
+	maxPartials          = 64
+	maxPartialsPerSender = 8
+)
+
+// fragmentOverhead is the memory taken by each fragment of an incomplete
+// packet besides its payload, the header of its slice.
+const fragmentOverhead = 24
+
+// partialPacket holds the fragments of a packet received so far.
+type partialPacket struct {
+	sender    string
+	fragments [][]byte
+	received  int
+	size      int
+	timer     clock.Timer
+}
+
+// checkFragmentSizes returns an error if the sizes of the datagrams and the
+// packets do not leave room for the fragments, or make too many of them.
+func (g *Gossiper) checkFragmentSizes() error {
+
+	if g.maxPacketSize <= 0 {
+		return xerrors.Errorf("invalid maximum packet size %d", g.maxPacketSize)
+	}
+
+	payload := g.maxDatagramSize - g.envelopeSize() - fragmentHeaderSize
+	if payload < minFragmentPayload {
+		return xerrors.Errorf("datagrams of %d bytes leave less than %d bytes to fragments",
+			g.maxDatagramSize, minFragmentPayload)
+	}
+
+	if g.maxFragments() > 0xFFFF {
+		return xerrors.Errorf("packets of %d bytes need too many fragments", g.maxPacketSize)
+	}
+
+	return nil
+}
+
+// maxFragments is the number of fragments of a packet of the maximum size,
+// at most.
+func (g *Gossiper) maxFragments() int {
+	return (g.maxPacketSize + minFragmentPayload - 1) / minFragmentPayload
+}
+
+// fragment splits the packet into datagrams of at most maxDatagramSize bytes,
+// once sealed. A packet that fits in a datagram is sent as is. It must be
+// called with g.mux held.
+func (g *Gossiper) fragment(b []byte) ([][]byte, error) {
+
+	max := g.maxDatagramSize - g.envelopeSize()
+
+	if len(b) <= max {
+		return [][]byte{b}, nil
+	}
+
+	if len(b) > g.maxPacketSize {
+		return nil, xerrors.Errorf("packet of %d bytes is larger than the maximum of %d bytes",
+			len(b), g.maxPacketSize)
+	}
+
+	payload := max - fragmentHeaderSize
+	count := (len(b) + payload - 1) / payload
+
+	// Should really never happen
+	// The maximum packet size is too large
+	if count > 0xFFFF {
+		return nil, xerrors.Errorf("packet of %d bytes needs too many fragments", len(b))
+	}
+
+	g.fragmentID++
+
+	datagrams := make([][]byte, count)
+	for i := range datagrams {
+
+		start := i * payload
+		end := start + payload
+		if end > len(b) {
+			end = len(b)
+		}
+
+		d := make([]byte, fragmentHeaderSize+end-start)
+		d[0] = fragmentMagic
+		binary.BigEndian.PutUint32(d[1:5], g.fragmentID)
+		binary.BigEndian.PutUint16(d[5:7], uint16(i))
+		binary.BigEndian.PutUint16(d[7:9], uint16(count))
+		copy(d[fragmentHeaderSize:], b[start:end])
+
+		datagrams[i] = d
+	}
+
+	return datagrams, nil
+}
+
+// reassemble keeps the fragment until all the fragments of its packet are
+// received, and then returns the packet. It returns nil as long as the packet
+// is not complete. It must be called with g.mux held.
+func (g *Gossiper) reassemble(d []byte, sender *net.UDPAddr) []byte {
+
+	// Might happen once a day
+	if len(d) <= fragmentHeaderSize {
+		log.Error("Dropping truncated fragment from", sender)
+		return nil
+	}
+
+	id := binary.BigEndian.Uint32(d[1:5])
+	index := int(binary.BigEndian.Uint16(d[5:7]))
+	count := int(binary.BigEndian.Uint16(d[7:9]))
+
+	// Might happen once a day
+	if index >= count || count > g.maxFragments() {
+		log.Error("Dropping invalid fragment from", sender)
+		return nil
+	}
+
+	key := fmt.Sprintf("%v/%d", sender, id)
+	partial, ok := g.partials[key]
+
+	if !ok {
+
+		// Might happen sometimes
+		// Bounds the packets a peer
+		// can leave incomplete
+		if !g.admitPartial(sender.String(), count) {
+			log.Error("Dropping fragment from", sender, ": too many incomplete packets")
+			return nil
+		}
+
+		partial = &partialPacket{
+			sender:    sender.String(),
+			fragments: make([][]byte, count),
+		}
+		g.partials[key] = partial
+		g.reassemblySize += count * fragmentOverhead
+
+		partial.timer = g.clock.AfterFunc(reassemblyTimeout, func() {
+			g.mux.Lock()
+			defer g.mux.Unlock()
+
+			if g.partials[key] == partial {
+				log.Lvl2("Dropping incomplete packet from", sender)
+				g.dropPartial(key)
+			}
+		})
+	}
+
+	// Might happen sometimes
+	// Fragments can be duplicated
+	if len(partial.fragments) != count || partial.fragments[index] != nil {
+		return nil
+	}
+
+	payload := d[fragmentHeaderSize:]
+
+	// Might happen sometimes
+	// Bounds the memory a peer can use
+	if partial.size+len(payload) > g.maxPacketSize ||
+		g.reassemblySize+len(payload) > maxReassemblyPackets*g.maxPacketSize {
+
+		log.Error("Dropping packet from", sender, ": too large to reassemble")
+		g.dropPartial(key)
+		return nil
+	}
+
+	partial.fragments[index] = append([]byte(nil), payload...)
+	partial.received++
+	partial.size += len(payload)
+	g.reassemblySize += len(payload)
+
+	if partial.received < count {
+		return nil
+	}
+
+	b := make([]byte, 0, partial.size)
+	for _, f := range partial.fragments {
+		b = append(b, f...)
+	}
+
+	g.dropPartial(key)
+	return b
+}
+
+// admitPartial tells whether a new incomplete packet of count fragments from
+// sender can be kept. It must be called with g.mux held.
+func (g *Gossiper) admitPartial(sender string, count int) bool {
+
+	if len(g.partials) >= maxPartials {
+		return false
+	}
+
+	if g.reassemblySize+count*fragmentOverhead > maxReassemblyPackets*g.maxPacketSize {
+		return false
+	}
+
+	fromSender := 0
+	for _, p := range g.partials {
+		if p.sender == sender {
+			fromSender++
+		}
+	}
+
+	return fromSender < maxPartialsPerSender
+}
+
+// dropPartial forgets the fragments of a packet. It must be called with g.mux
+// held.
+func (g *Gossiper) dropPartial(key string) {
+
+	partial, ok := g.partials[key]
+	if !ok {
+		return
+	}
+
+	partial.timer.Stop()
+	g.reassemblySize -= partial.size + len(partial.fragments)*fragmentOverhead
+	delete(g.partials, key)
+}
+
+// stopReassembly forgets every incomplete packet. It must be called with
+// g.mux held.
+func (g *Gossiper) stopReassembly() {
+
+	for key := range g.partials {
+		g.dropPartial(key)
+	}
+}
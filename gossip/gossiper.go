@@ -4,16 +4,25 @@
 package gossip
 
 import (
+	"compress/flate"
 	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"go.dedis.ch/cs438/hw1/gossip/clock"
+	"go.dedis.ch/cs438/hw1/gossip/store"
+	"go.dedis.ch/cs438/hw1/gossip/transport"
 	"go.dedis.ch/cs438/hw1/gossip/watcher"
 	"reflect"
 	"net"
 	"fmt"
 	"sync"
+	"io"
+	"os"
+	"sort"
 
 	"math/rand"
     "time"
-	"encoding/json"
 	"golang.org/x/xerrors"
 	"go.dedis.ch/onet/v3/log"
 )
@@ -23,13 +32,9 @@ import (
 // - implements gossip.GossipFactory
 type BaseGossipFactory struct{}
 
-// stopMsg is used to notifier the listener when we want to close the
-// connection, so that the listener knows it can stop listening.
-const stopMsg = "stop"
-
 // New implements gossip.GossipFactory. It creates a new gossiper.
-func (f BaseGossipFactory) New(address, identifier string, antiEntropy int, routeTimer int) (BaseGossiper, error) {
-	return NewGossiper(address, identifier, antiEntropy, routeTimer)
+func (f BaseGossipFactory) New(address, identifier string, antiEntropy int, routeTimer int, opts ...Option) (BaseGossiper, error) {
+	return NewGossiper(address, identifier, antiEntropy, routeTimer, opts...)
 }
 
 // Gossiper privides the functionalities to handle a distributes gossip
@@ -38,6 +43,12 @@ func (f BaseGossipFactory) New(address, identifier string, antiEntropy int, rout
 // - implements gossip.BaseGossiper
 type Gossiper struct {
 
+	// mux guards the protocol state: the messages, pending rumors, routes,
+	// mongered rumors, catch ups, fragments, peers and their wire versions,
+	// identifier, keys, callback, timers and random generator. Handlers are executed with mux held, any other routine
+	// (timers, calls from the controller) must hold it to touch the state.
+	mux sync.Mutex
+
 	// watchers
 	inWatcher  watcher.Watcher
 	outWatcher watcher.Watcher
@@ -49,20 +60,158 @@ type Gossiper struct {
 
 	addr string
 	identifier string
-	conn *net.UDPConn
-	udpAddr *net.UDPAddr
+
+	// transport sends and receives the datagrams. If no
+	// transport is given, Run listens to addr over UDP
+	transport transport.Transport
 	callback NewMessageCallback
-	peers []*net.UDPAddr
-	messages map[string][]string
-	mongering map[string]*RumorMessage
 
-	stopRun chan int
-	stopAntiEntropy chan int
-	peers_mux sync.Mutex
+	// callbacks are called one after the other
+	// by a single routine, in the order the
+	// messages were delivered
+	callbacks []func()
+	callbacksRunning bool
+	callbacks_mux sync.Mutex
+	peers []*net.UDPAddr
+	messages map[string][]*RumorMessage
+
+	// liveness holds, for each peer address,
+	// when it was last heard from. Peers are
+	// probed every probeInterval if it is set
+	liveness map[string]*peerLiveness
+	probeInterval time.Duration
+	probeTimer clock.Timer
+
+	// peers are exchanged every exchangeInterval
+	// if it is set. learntFrom holds the source
+	// of each peer learnt from an exchange, and
+	// injected the number of peers of each source
+	exchangeInterval time.Duration
+	exchangeTimer clock.Timer
+	maxPeers int
+	learntFrom map[string]string
+	injected map[string]int
+
+	// the gossipers announce themselves on the
+	// discoveryGroup, if set, every interval
+	discoveryGroup string
+	discoveryInterval time.Duration
+	discovery transport.Transport
+	discoveryTimer clock.Timer
+
+	// key signs our rumors, keys holds the
+	// key bound to each origin
+	key ed25519.PrivateKey
+	keys map[string]ed25519.PublicKey
+
+	// boxKey decrypts the private messages to
+	// us, boxKeys holds the box key of each
+	// origin, learnt from its route rumors
+	boxKey *ecdh.PrivateKey
+	boxKeys map[string][]byte
+
+	// entropy draws the ephemeral keys and
+	// the nonces of the private messages
+	entropy io.Reader
+
+	// pending holds, for each origin, the rumors
+	// received before their predecessors
+	pending map[string]map[uint32]*pendingRumor
+
+	// mongering holds, for each peer address, the rumors
+	// sent to that peer which are not acknowledged yet
+	mongering map[string][]*mongerEntry
+	ackTimeout time.Duration
+
+	// catchUps holds, for each peer address, the
+	// rumors being sent to that peer after a
+	// status exchange
+	catchUps map[string]*catchUpStream
+
+	// packets larger than maxDatagramSize are
+	// sent in fragments, partials holds the
+	// fragments received for each packet
+	maxDatagramSize int
+	maxPacketSize int
+	fragmentID uint32
+	partials map[string]*partialPacket
+	reassemblySize int
+
+	// datagrams are sealed with the network
+	// key, the others are dropped, if set
+	networkID string
+	networkKey []byte
+
+	// peerWire holds, for each peer address, the
+	// version of the binary format the peer reads
+	wireFormat WireFormat
+	peerWire map[string]uint8
+
+	// limits drops the datagrams of the banned
+	// peers and of the peers sending too many
+	limits *limiter
+
+	// the packets larger than compressThreshold
+	// are compressed for the peers reading them
+	compressThreshold int
+	compressor *flate.Writer
+
+	// queues holds, for each peer address, the
+	// datagrams waiting to be sent by a worker.
+	// senders counts the running workers
+	queueDepth int
+	queuePolicy QueuePolicy
+	queues map[string]*sendQueue
+	senders sync.WaitGroup
+
+	// store keeps the messages, peers, routes
+	// and keys on disk, if storePath is set
+	storePath string
+	storeSyncEvery int
+	store *store.Log
+	storeRecords [][]byte
+	storeAppends int
+
+	// stopRun is closed when the Run() loop
+	// returns, nil if Run() was not called
+	stopRun chan struct{}
+
+	// clock drives every timer. The timers
+	// check stopped before doing anything
+	clock clock.Clock
+	stopped bool
+	antiEntropyTimer clock.Timer
+	routeRumorTimer clock.Timer
 
 	antiEntropy int
 	routeTimer int
 
+	// antiEntropyMode tells whether the status
+	// or its digest is sent every antiEntropy
+	// seconds, digest caches the digest
+	antiEntropyMode AntiEntropyMode
+	digest []byte
+
+	// each rumor is mongered with fanout peers,
+	// and the anti-entropy contacts antiEntropyPeers
+	// peers, in the direction given by syncMode
+	fanout int
+	antiEntropyPeers int
+	syncMode SyncMode
+
+	// in plumtree mode, rumors are pushed to the
+	// peers not in lazy and announced to the lazy
+	// ones, lazy holds the lazy peers of each
+	// origin. missing holds the rumors announced
+	// to us that we did not receive yet
+	dissemination DisseminationMode
+	lazy map[string]map[string]bool
+	missing map[rumorKey]*missingRumor
+
+	// out is where the protocol
+	// messages are printed
+	out io.Writer
+
 	// each gossiper
 	// has its own random
 	// generator. This
@@ -77,7 +226,7 @@ type Gossiper struct {
 // address. This method can panic if it is not possible to create a
 // listener on that address. To run the gossip protocol, call `Run` on the
 // gossiper.
-func NewGossiper(address, identifier string, antiEntropy int, routeTimer int) (BaseGossiper, error) {
+func NewGossiper(address, identifier string, antiEntropy int, routeTimer int, opts ...Option) (BaseGossiper, error) {
 
 	g := Gossiper{
 
@@ -85,23 +234,94 @@ func NewGossiper(address, identifier string, antiEntropy int, routeTimer int) (B
 		outWatcher: watcher.NewSimpleWatcher(),
 
 		Handlers: make(map[reflect.Type]interface{}),
-		messages: make(map[string][]string),
-		mongering: make(map[string]*RumorMessage),
+		messages: make(map[string][]*RumorMessage),
+		keys: make(map[string]ed25519.PublicKey),
+		boxKeys: make(map[string][]byte),
+		pending: make(map[string]map[uint32]*pendingRumor),
+		routes: make(map[string]*RouteStruct),
+		mongering: make(map[string][]*mongerEntry),
+		catchUps: make(map[string]*catchUpStream),
+		partials: make(map[string]*partialPacket),
+		peerWire: make(map[string]uint8),
+		queues: make(map[string]*sendQueue),
+		queueDepth: defaultQueueDepth,
+		compressThreshold: defaultCompressThreshold,
+		limits: newLimiter(),
+		wireFormat: WireBinary,
 		addr: address,
 		identifier: identifier,
 		peers: make([]*net.UDPAddr, 0),
-
-		stopRun: make(chan int),
-		stopAntiEntropy: make(chan int),
+		liveness: make(map[string]*peerLiveness),
+		learntFrom: make(map[string]string),
+		injected: make(map[string]int),
+		lazy: make(map[string]map[string]bool),
+		missing: make(map[rumorKey]*missingRumor),
+		maxPeers: defaultMaxPeers,
+		fanout: 1,
+		antiEntropyPeers: 1,
+
+		clock: clock.Real{},
+		out: os.Stdout,
+		entropy: crand.Reader,
 
 		antiEntropy: antiEntropy,
 		routeTimer: routeTimer,
+		ackTimeout: defaultAckTimeout,
+		maxDatagramSize: defaultMaxDatagramSize,
+		maxPacketSize: defaultMaxPacketSize,
 	}
 
-	g.source = rand.NewSource(time.Now().UnixNano())
+	for _, opt := range opts {
+		opt(&g)
+	}
+
+	err := g.checkFragmentSizes()
+	if err != nil {
+		return nil, err
+	}
+
+	// WithSeed() makes the
+	// choices reproducible
+	if g.source == nil {
+		g.source = rand.NewSource(time.Now().UnixNano())
+	}
 	g.ran = rand.New(g.source)
 
-	message_types := []interface{} {&SimpleMessage{}, &RumorMessage{}, &StatusPacket{}, &PrivateMessage{}}
+	if g.storePath != "" {
+		err := g.openStore()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if g.key == nil {
+		_, key, err := ed25519.GenerateKey(crand.Reader)
+
+		// Should really never happen
+		if err != nil {
+			return nil, xerrors.Errorf("failed to generate key: %v", err)
+		}
+		g.key = key
+	}
+
+	if g.boxKey == nil {
+		key, err := ecdh.X25519().GenerateKey(crand.Reader)
+
+		// Should really never happen
+		if err != nil {
+			return nil, xerrors.Errorf("failed to generate box key: %v", err)
+		}
+		g.boxKey = key
+	}
+
+	// nobody else can use our name
+	g.keys[g.identifier] = g.GetPublicKey()
+
+	g.restoreStore()
+
+	message_types := []interface{} {&SimpleMessage{}, &RumorMessage{}, &StatusPacket{}, &PrivateMessage{}, &PeerExchangePacket{},
+		&DigestPacket{}, &IHavePacket{}, &GraftPacket{}, &PrunePacket{},
+		&BatchPacket{}}
 
 	for _, i := range message_types {
 
@@ -115,148 +335,316 @@ func NewGossiper(address, identifier string, antiEntropy int, routeTimer int) (B
 	return &g, nil
 }
 
-// Run implements gossip.BaseGossiper. It starts the listening of UDP datagrams
-// on the given address and starts the antientropy. This is a blocking function.
+// Run implements gossip.BaseGossiper. It starts the gossiper and the
+// listening of datagrams on the transport, a UDP socket on the given address
+// by default. This is a blocking function.
 func (g *Gossiper) Run(ready chan struct{}) {
 
-	go g.runAntiEntropy()
+	g.mux.Lock()
+	g.stopRun = make(chan struct{})
+	g.mux.Unlock()
 
-	udpAddr, err := net.ResolveUDPAddr("udp", g.addr)
+	defer close(g.stopRun)
 
-	// Should really never happen
-	// We cannot continue if there is an error here
-	if err != nil {
-		panic(fmt.Sprintf("Could not resolve UDP addr: %v", err))
-	}
-	g.udpAddr = udpAddr
-	g.conn, err = net.ListenUDP("udp", g.udpAddr)
-
-	// Should really never happen
-	if err != nil {
-		panic(fmt.Sprintf("Could not listen to UDP addr: %v", err))
-	}
+	g.Start()
 
 	ready <- struct{}{}
 
-	// The usual size of a MTU
-	// is 1500 bytes
-	b := make([]byte, 1500)
+	// large enough for any datagram,
+	// larger packets come in fragments
+	b := make([]byte, maxReceiveSize)
 
 	for  {
 
-		n, sender, err := g.conn.ReadFromUDP(b)
+		n, sender, err := g.transport.Receive(b)
+
+		// Stop() closed the transport
+		if err == transport.ErrClosed {
+			break
+		}
 
 		// Should really never happen
 		if err != nil {
-			panic(fmt.Sprintf("Could not read from UDP addr: %v", err))
+			panic(fmt.Sprintf("Could not read from transport: %v", err))
 		}
 
-		// Close after having received the packet
-		// otherwise the connection is closed
-		// while reading
-		if string(b[:n]) == stopMsg {
-			g.stopAntiEntropy <- 1
-			break
-		}
+		g.Process(b[:n], sender)
+	}
+}
 
-		var packet GossipPacket
-		err = json.Unmarshal(b[:n], &packet)
+// Start creates the transport, if none was given, and starts the timers of
+// the gossiper without listening to the transport. The datagrams must then be
+// given to Process, which is what a simulator does. Run calls Start.
+func (g *Gossiper) Start() {
 
-		// Might happen once a day
-		// In theory, we could receive anything
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if g.transport == nil {
+
+		t, err := transport.NewUDP(g.addr)
+
+		// Should really never happen
+		// We cannot continue if there is an error here
 		if err != nil {
-			log.Error("Error parsing message:", err)
-			continue
+			panic(fmt.Sprintf("Could not create transport: %v", err))
 		}
+		g.transport = t
+	}
 
-		g.inWatcher.Notify(CallbackPacket{Addr: sender.String(), Msg: packet})
-
-		if (packet.Simple != nil) {
-			err = g.ExecuteHandler(packet.Simple, sender)
-		} else if (packet.Rumor != nil) {
-			err = g.ExecuteHandler(packet.Rumor, sender)
-		}else if(packet.Status != nil) {
-			err = g.ExecuteHandler(packet.Status, sender)
-		}else if(packet.Private != nil) {
-			err = g.ExecuteHandler(packet.Private, sender)
-		}else {
-			log.Error("Error parsing message: all fields were nil")
-			continue
+	// all need the transport
+	g.startAntiEntropy()
+	g.startRouteRumors()
+	g.startProbes()
+	g.startPeerExchange()
+	g.startDiscovery()
+}
+
+// Process handles a datagram received from sender. Datagrams that are not
+// sealed for our network are dropped. A fragment is kept until its packet is
+// complete.
+func (g *Gossiper) Process(b []byte, sender *net.UDPAddr) {
+
+	if !g.admit(sender) {
+		return
+	}
+
+	// the packets to a slow peer wait
+	// for room, so do the ones it sends
+	g.mux.Lock()
+	q := g.queues[sender.String()]
+	g.mux.Unlock()
+
+	if q != nil {
+		q.wait()
+	}
+
+	b = g.openDatagram(b, sender)
+	if b == nil {
+		return
+	}
+
+	if len(b) > 0 && b[0] == fragmentMagic {
+
+		g.mux.Lock()
+		if !g.stopped {
+			b = g.reassemble(b, sender)
+		} else {
+			b = nil
 		}
+		g.mux.Unlock()
 
-		// Might happen sometimes
+		if b == nil {
+			return
+		}
+	}
+
+	// the size of the packet is bounded
+	// once decompressed, not only on
+	// the wire
+	if len(b) > 0 && b[0] == compressMagic {
+
+		var err error
+		b, err = decompress(b, g.maxPacketSize)
+
+		// Might happen once a day
 		if err != nil {
-			log.Error("Error executing handler:", err)
-			continue
+			log.Error("Dropping packet from", sender, ":", err)
+			g.strike(sender)
+			return
 		}
+	}
+
+	packet, version, err := decodePacket(b)
+
+	// Might happen sometimes
+	// A packet added by a later version
+	if xerrors.Is(err, errUnknownType) {
+		log.Lvl2("Dropping packet from", sender, ":", err)
+		return
+	}
+
+	// Might happen once a day
+	// In theory, we could receive anything
+	if err != nil {
+		log.Error("Error parsing message:", err)
+		g.strike(sender)
+		return
+	}
 
-		g.printPeers()
+	g.inWatcher.Notify(CallbackPacket{Addr: sender.String(), Msg: packet})
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	// the timers are stopped, so
+	// should be the handlers
+	if g.stopped {
+		return
+	}
+
+	// a peer may restart with
+	// another version
+	if version > 0 {
+		g.peerWire[sender.String()] = version
+	} else {
+		delete(g.peerWire, sender.String())
+	}
+
+	g.heard(sender)
+
+	err = g.handlePacket(packet, sender)
+
+	// Might happen sometimes
+	if err != nil {
+		log.Error("Error executing handler:", err)
 	}
 }
 
-// Stop implements gossip.BaseGossiper. It closes the UDP connection. You should
-// be sure that you stopped listening before closing the connection. For that
-// you can send a stop message to the listener, which then knows that it can
-// stop listening.
-func (g *Gossiper) Stop() { 
-	
-	_, err := g.conn.WriteToUDP([]byte(stopMsg), g.udpAddr)
+// handlePacket executes the handler of the message carried by the packet. It
+// must be called with g.mux held.
+func (g *Gossiper) handlePacket(packet GossipPacket, sender *net.UDPAddr) error {
+
+	var err error
+
+	if packet.Simple != nil {
+		err = g.ExecuteHandler(packet.Simple, sender)
+	} else if packet.Rumor != nil {
+		err = g.ExecuteHandler(packet.Rumor, sender)
+	} else if packet.Status != nil {
+		err = g.ExecuteHandler(packet.Status, sender)
+	} else if packet.Private != nil {
+		err = g.ExecuteHandler(packet.Private, sender)
+	} else if packet.PeerExchange != nil {
+		err = g.ExecuteHandler(packet.PeerExchange, sender)
+	} else if packet.Digest != nil {
+		err = g.ExecuteHandler(packet.Digest, sender)
+	} else if packet.IHave != nil {
+		err = g.ExecuteHandler(packet.IHave, sender)
+	} else if packet.Graft != nil {
+		err = g.ExecuteHandler(packet.Graft, sender)
+	} else if packet.Prune != nil {
+		err = g.ExecuteHandler(packet.Prune, sender)
+	} else if packet.Batch != nil {
+		err = g.ExecuteHandler(packet.Batch, sender)
+	} else {
+		return xerrors.Errorf("all fields were nil")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	g.printPeers()
+	return nil
+}
+
+// Stop implements gossip.BaseGossiper. It closes the transport, which stops
+// the listening, and waits for the gossiper to stop.
+func (g *Gossiper) Stop() {
+
+	g.mux.Lock()
+	t := g.transport
+	done := g.stopRun
+	g.mux.Unlock()
+
+	// Start() was not called
+	if t == nil {
+		g.mux.Lock()
+		g.closeStore()
+		g.mux.Unlock()
+		return
+	}
+
+	err := t.Close()
 
 	// Should really never happen
-	// We should be able to write to ourselves
 	if err != nil {
-		panic(fmt.Sprintf("Could not write to UDP addr: %v", err))
+		log.Error("Could not close transport:", err)
+	}
+
+	// Stop() blocks until the gossiper
+	// is stopped. Avoids the same address
+	// being reused while the gossiper is
+	// still running
+	if done != nil {
+		<- done
 	}
 
-	// Stop() blocks until the connection
-	// is closed. Avoids same port being reused
-	// after a call to Stop() and which is 
-	// not closed yet
-	<- g.stopRun
-	g.conn.Close()
+	// pending timers would otherwise
+	// write to the closed transport
+	g.mux.Lock()
+	g.stopped = true
+	if g.antiEntropyTimer != nil {
+		g.antiEntropyTimer.Stop()
+	}
+	if g.routeRumorTimer != nil {
+		g.routeRumorTimer.Stop()
+	}
+	if g.probeTimer != nil {
+		g.probeTimer.Stop()
+	}
+	if g.exchangeTimer != nil {
+		g.exchangeTimer.Stop()
+	}
+	if g.discoveryTimer != nil {
+		g.discoveryTimer.Stop()
+	}
+	if g.discovery != nil {
+		g.discovery.Close()
+	}
+	g.stopMongering()
+	g.stopGrafts()
+	g.stopCatchUps()
+	g.stopReassembly()
+	g.stopQueues()
+	g.closeStore()
+	g.mux.Unlock()
+
+	g.senders.Wait()
 }
 
-func (g *Gossiper) addMessage(id string, msg string) {
+// addMessage stores the rumor, which must be the next one expected from its
+// origin. It must be called with g.mux held.
+func (g *Gossiper) addMessage(rumor *RumorMessage) {
 
-	// Todo: should we lock here ?
-	g.messages[id] = append(g.messages[id], msg)
+	g.messages[rumor.Origin] = append(g.messages[rumor.Origin], rumor)
+	g.digest = nil
+	g.persist(rumorRecord(rumor))
 }
 
-func (g *Gossiper) runAntiEntropy() {
+// startAntiEntropy sends our status to random peers every antiEntropy
+// seconds, until the gossiper stops. An antiEntropy of 0 disables it. It must
+// be called with g.mux held.
+func (g *Gossiper) startAntiEntropy() {
 
-	// Todo: how to stop this on stopMessage ?
+	if g.antiEntropy <= 0 {
+		return
+	}
 
-	ticker := time.NewTicker(time.Duration(g.antiEntropy) * time.Second)
-	defer ticker.Stop()
+	var tick func()
+	tick = func() {
 
-	for {
-		select {
-			case <- g.stopAntiEntropy:
-				g.stopRun <- 1
-				return
-			case <- ticker.C:
-
-				// Todo factor this in a function
-				addr := g.randomPeer()
-				if addr != nil {
-
-					want := g.map2slice()
-					
-					packet := GossipPacket {
-						Status: &StatusPacket {
-							Want: want,
-						},
-					}
-					go g.send(packet, addr)
-				}
+		g.mux.Lock()
+		defer g.mux.Unlock()
+
+		if g.stopped {
+			return
 		}
+
+		for _, addr := range g.randomPeers(g.antiEntropyPeers) {
+			g.sendAntiEntropy(addr)
+		}
+
+		g.antiEntropyTimer = g.clock.AfterFunc(time.Duration(g.antiEntropy) * time.Second, tick)
 	}
+
+	g.antiEntropyTimer = g.clock.AfterFunc(time.Duration(g.antiEntropy) * time.Second, tick)
 }
 
+// getLatest must be called with g.mux held.
 func (g *Gossiper) getLatest(id string) uint32 {
 
-	// Todo: should we lock here ?
-
 	if val, ok := g.messages[id]; ok {
 		return uint32(len(val))
 	}else {
@@ -264,94 +652,177 @@ func (g *Gossiper) getLatest(id string) uint32 {
 	}
 }
 
+// map2slice must be called with g.mux held.
 func (g* Gossiper) map2slice() []PeerStatus {
 
-	// Todo: lock a mutex here ?
 	want := make([]PeerStatus, 0)
 	for key, value := range g.messages {
 
 		want = append(want, PeerStatus {Identifier: key, NextID: uint32(1 + len(value))})
 	}
+
+	// the same messages always
+	// give the same packet
+	sort.Slice(want, func(i, j int) bool {
+		return want[i].Identifier < want[j].Identifier
+	})
 	return want
 }
 
-func (g *Gossiper) printPeers() {
+// sendStatus sends the current status of the messages seen so far to the
+// given peer. It must be called with g.mux held.
+func (g *Gossiper) sendStatus(to *net.UDPAddr) {
+
+	packet := GossipPacket {
+		Status: &StatusPacket {
+			Want: g.map2slice(),
+		},
+	}
+
+	g.send(packet, to)
+}
 
-	g.peers_mux.Lock()
+// printPeers must be called with g.mux held.
+func (g *Gossiper) printPeers() {
 
-	fmt.Printf("PEERS ")
+	fmt.Fprintf(g.out, "PEERS ")
 	for i, peer := range g.peers {
 		if i==0 {
-			fmt.Printf("%v",peer)
+			fmt.Fprintf(g.out, "%v",peer)
 		} else {
-			fmt.Printf(",%v",peer)
+			fmt.Fprintf(g.out, ",%v",peer)
 		}
 	}
 
-	g.peers_mux.Unlock()
-	fmt.Println()
+	fmt.Fprintln(g.out)
 }
 
-// returns random peer, or nil of no was found
+// returns random peer, or nil of no was found,
+// among the peers not blacklisted nor dead
+// must be called with g.mux held
 func (g *Gossiper) randomPeer(blacklisted ...string) *net.UDPAddr {
 
-	g.peers_mux.Lock()
-	defer g.peers_mux.Unlock()
+	candidates := g.candidatePeers(blacklisted...)
 
-	n := len(g.peers)
-	if n == 0 {return nil}
+	if len(candidates) == 0 {return nil}
 
-	r := g.ran.Intn(n)
+	// the addAddress function
+	// guarantees that all addresses
+	// are different
+	return candidates[g.ran.Intn(len(candidates))]
+}
 
-	bl := false
-	for _, b := range blacklisted {
-		if b == g.peers[r].String() {
-			bl = true
+// randomPeers returns n different random peers, or less if there are not
+// enough, among the peers not blacklisted nor dead. It must be called with
+// g.mux held.
+func (g *Gossiper) randomPeers(n int, blacklisted ...string) []*net.UDPAddr {
+
+	// a single peer is drawn
+	// like randomPeer does
+	if n <= 1 {
+		peer := g.randomPeer(blacklisted...)
+		if peer == nil || n < 1 {
+			return nil
 		}
+		return []*net.UDPAddr{peer}
 	}
-	if !bl {
-		return g.peers[r]
+
+	candidates := g.candidatePeers(blacklisted...)
+
+	g.ran.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	if len(candidates) > n {
+		candidates = candidates[:n]
 	}
+	return candidates
+}
 
-	s := (r+1)%n
-	if s == r {return nil}
+// candidatePeers returns the peers not blacklisted nor dead. It must be
+// called with g.mux held.
+func (g *Gossiper) candidatePeers(blacklisted ...string) []*net.UDPAddr {
 
-	// the addAddress function
-	// guarantees that all addresses
-	// are different
-	return g.peers[s]
+	candidates := make([]*net.UDPAddr, 0, len(g.peers))
+
+	for _, peer := range g.peers {
 
+		bl := false
+		for _, b := range blacklisted {
+			if b == peer.String() {
+				bl = true
+			}
+		}
+
+		if bl || g.isDead(peer) {continue}
+		candidates = append(candidates, peer)
+	}
+
+	return candidates
 }
 
+// send queues the packet for the given peer, in fragments if it does not fit
+// in a datagram. It must be called with g.mux held.
 func (g *Gossiper) send(p GossipPacket, to *net.UDPAddr) {
 
-	if p.Rumor != nil {
-		fmt.Printf("MONGERING with %v\n", to.String())
+	b, err := g.encode(p, to)
+
+	// Should really never happen
+	if err != nil {
+		panic(fmt.Sprintf("Could not encode packet: %v", err))
 	}
 
-	b, err := json.Marshal(p)
+	datagrams, err := g.fragment(g.compress(b, to))
 
-	// Should really never happen
+	// Might happen sometimes
+	// A client sent a huge message
 	if err != nil {
-		panic(fmt.Sprintf("Could not parse JSON: %v", err))
+		log.Error("Could not send to", to, ":", err)
+		return
+	}
+
+	for i, d := range datagrams {
+		datagrams[i] = g.sealDatagram(d)
 	}
 
-	_, err = g.conn.WriteToUDP(b, to)
+	g.enqueue(datagrams, to)
 
-	// Might happen once a day
-	// The peer may have closed the socket
+	g.outWatcher.Notify(CallbackPacket{Addr: to.String(), Msg: p})
+}
+
+// encode encodes the packet in the binary format if the peer reads it, and
+// in JSON otherwise. It must be called with g.mux held.
+func (g *Gossiper) encode(p GossipPacket, to *net.UDPAddr) ([]byte, error) {
+
+	if g.wireFormat != WireBinary {
+		return encodeJSON(p, 0)
+	}
+
+	version, ok := g.peerWire[to.String()]
+	if !ok {
+		return encodeJSON(p, wireVersion)
+	}
+
+	if version > wireVersion {
+		version = wireVersion
+	}
+
+	b, err := encodeBinary(p, version)
+
+	// Should really never happen
+	// We send one message per packet
 	if err != nil {
-		log.Error("Could not write to UDP addr:", err)
-	} else {
-		g.outWatcher.Notify(CallbackPacket{Addr: to.String(), Msg: p})
+		log.Error("Could not encode binary packet:", err)
+		return encodeJSON(p, wireVersion)
 	}
+
+	return b, nil
 }
 
+// broadcast sends the packet to the peers not blacklisted nor dead. It must
+// be called with g.mux held.
 func (g *Gossiper) broadcast(p GossipPacket, blacklisted ...string) {
 
-	g.peers_mux.Lock()
-	defer g.peers_mux.Unlock()
-
 	for _, peer := range g.peers {
 
 		bl := false
@@ -361,7 +832,7 @@ func (g *Gossiper) broadcast(p GossipPacket, blacklisted ...string) {
 			}
 		}
 
-		if bl {continue}
+		if bl || g.isDead(peer) {continue}
 		g.send(p, peer)
 	}
 }
@@ -370,7 +841,10 @@ func (g *Gossiper) broadcast(p GossipPacket, blacklisted ...string) {
 // spread through the gossip network with the identifier of g.
 func (g *Gossiper) AddSimpleMessage(text string) {
 
-	fmt.Printf("CLIENT MESSAGE %v\n", text)
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	fmt.Fprintf(g.out, "CLIENT MESSAGE %v\n", text)
 	g.printPeers()
 
 	var msg = SimpleMessage {
@@ -383,14 +857,10 @@ func (g *Gossiper) AddSimpleMessage(text string) {
 		Simple: &msg,
 	}
 
-	go g.broadcast(packet)
-}
-
-// AddPrivateMessage sends the message to the next hop.
-func (g *Gossiper) AddPrivateMessage(text, dest, origin string, hoplimit int) {
-	log.Error("Implement me")
+	g.broadcast(packet)
 }
 
+// addAddress must be called with g.mux held.
 func (g *Gossiper) addAddress(addr *net.UDPAddr) {
 
 	// Should really never happen
@@ -398,9 +868,6 @@ func (g *Gossiper) addAddress(addr *net.UDPAddr) {
 		panic(fmt.Sprintf("Cannot add nil address"))
 	}
 
-	g.peers_mux.Lock()
-	defer g.peers_mux.Unlock()
-
 	for _, peer := range g.peers {
 
 		if peer.String() == addr.String() {
@@ -409,6 +876,8 @@ func (g *Gossiper) addAddress(addr *net.UDPAddr) {
 	}
 
 	g.peers = append(g.peers, addr)
+	g.liveness[addr.String()] = &peerLiveness{lastHeard: g.clock.Now()}
+	g.persist(peerRecord(addr))
 }
 
 // AddAddresses implements gossip.BaseGossiper. It takes any number of node
@@ -432,80 +901,95 @@ func (g *Gossiper) AddAddresses(addresses ...string) error {
 			continue
 		}
 
+		g.mux.Lock()
 		g.addAddress(udpAddr)
+		g.mux.Unlock()
 	}
 	return err
 }
 
 func (g* Gossiper) AddMessage(text string) uint32 {
 
-	fmt.Printf("CLIENT MESSAGE %v\n", text)
-	g.printPeers()
+	g.mux.Lock()
+	defer g.mux.Unlock()
 
-	g.addMessage(g.identifier, text)
-	id := g.getLatest(g.identifier)
+	fmt.Fprintf(g.out, "CLIENT MESSAGE %v\n", text)
+	g.printPeers()
 
-	receiver := g.randomPeer()
+	rumor := g.newRumor(text)
 
 	// Might happen once a day
-	if receiver == nil {
-
+	if !g.disseminate(rumor) {
 		log.Error("No receiver found")
-
-	}else {
-
-		var packet = GossipPacket {
-			Rumor: &RumorMessage {
-
-				Origin: g.identifier,
-				ID: 1,
-				Text: text,
-			},
-		}
-
-		// asynchronous because the Run()
-		// method wants to go back to
-		// listening to new messages
-		go g.send(packet, receiver)
 	}
 
-	// Todo: mutex
-	return id
+	return rumor.ID
 }
 
 // GetNodes implements gossip.BaseGossiper. It returns the list of nodes this
-// gossiper knows currently in the network.
+// gossiper knows currently in the network, without the dead ones.
 func (g *Gossiper) GetNodes() []string {
 
-	g.peers_mux.Lock()
-	defer g.peers_mux.Unlock()
+	g.mux.Lock()
+	defer g.mux.Unlock()
 
 	// return a copy otherwise the caller
 	// gets a pointer to the real peers which
 	// can change and which he can modify
 
-	cpy := make([]string, len(g.peers))
-	for i, peer := range g.peers {
-		cpy[i] = peer.String()
+	cpy := make([]string, 0, len(g.peers))
+	for _, peer := range g.peers {
+
+		// dead peers are not
+		// gossiped with anymore
+		if g.isDead(peer) {continue}
+		cpy = append(cpy, peer.String())
 	}
 	return cpy
 }
 
-// GetDirectNodes implements gossip.BaseGossiper. It returns the list of nodes whose routes are known to this node
-func (g *Gossiper) GetDirectNodes() []string {
-	log.Error("Implement me")
-	return make([]string,0)
+// GetStatus returns, for each origin, the ID of the next rumor this gossiper
+// expects from it, sorted by origin. This is the status sent to the peers.
+func (g *Gossiper) GetStatus() []PeerStatus {
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	return g.map2slice()
 }
 
 // SetIdentifier implements gossip.BaseGossiper. It changes the identifier sent
-// with messages originating from this gossiper.
-func (g *Gossiper) SetIdentifier(id string) {
+// with messages originating from this gossiper. It returns an error if the
+// identifier is bound to another key than ours: the peers would reject our
+// rumors as forged.
+func (g *Gossiper) SetIdentifier(id string) error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	known, ok := g.keys[id]
+	if ok && !known.Equal(g.GetPublicKey()) {
+		return xerrors.Errorf("identifier %v is bound to another key", id)
+	}
+
+	// a new identifier starts its own
+	// sequence, one of ours goes on
+	// where we left it
+	if !ok {
+		delete(g.messages, id)
+		delete(g.pending, id)
+		g.keys[id] = g.GetPublicKey()
+	}
+
 	g.identifier = id
+	return nil
 }
 
 // GetIdentifier implements gossip.BaseGossiper. It returns the currently used
 // identifier for outgoing messages from this gossiper.
 func (g *Gossiper) GetIdentifier() string {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
 	return g.identifier
 }
 
@@ -513,18 +997,59 @@ func (g *Gossiper) BroadcastMessage(GossipPacket) {
 
 }
 
-// GetRoutingTable implements gossip.BaseGossiper. It returns the known routes.
-func (g *Gossiper) GetRoutingTable() map[string]*RouteStruct {
-	log.Error("Implement me")
-	return nil
-}
-
 // RegisterCallback implements gossip.BaseGossiper. It sets the callback that
 // must be called each time a new message arrives.
 func (g *Gossiper) RegisterCallback(m NewMessageCallback) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
 	g.callback = m
 }
 
+// notify calls the registered callback, if any, without blocking the caller.
+// Callbacks are called in the order of the calls to notify. It must be called
+// with g.mux held.
+func (g *Gossiper) notify(origin string, packet GossipPacket) {
+
+	callback := g.callback
+	if callback == nil {
+		return
+	}
+
+	g.callbacks_mux.Lock()
+	defer g.callbacks_mux.Unlock()
+
+	g.callbacks = append(g.callbacks, func() {
+		callback(origin, packet)
+	})
+
+	if !g.callbacksRunning {
+		g.callbacksRunning = true
+		go g.runCallbacks()
+	}
+}
+
+func (g *Gossiper) runCallbacks() {
+
+	for {
+		g.callbacks_mux.Lock()
+
+		if len(g.callbacks) == 0 {
+			g.callbacksRunning = false
+			g.callbacks_mux.Unlock()
+			return
+		}
+
+		f := g.callbacks[0]
+		g.callbacks = g.callbacks[1:]
+
+		g.callbacks_mux.Unlock()
+
+		// the callback might block or be very long
+		f()
+	}
+}
+
 // Watch implements gossip.BaseGossiper. It returns a chan populated with new
 // incoming packets
 func (g *Gossiper) Watch(ctx context.Context, fromIncoming bool) <-chan CallbackPacket {
@@ -2,12 +2,24 @@ package gossip
 
 import (
 	"context"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cs438/hw1/gossip/clock"
+	"go.dedis.ch/cs438/hw1/gossip/transport"
+	"go.dedis.ch/cs438/hw1/topology"
+	"golang.org/x/xerrors"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -18,7 +30,9 @@ var factory = GetFactory()
 
 func TestGossiper_Topo1_2Nodes_RumorReceived(t *testing.T) {
 	antiEntropy := 1000
-	routeTimer := 100
+	// no route rumor, the first rumor sent
+	// by A must be the one we add
+	routeTimer := 0
 	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer)
 	n2, addr2 := createNode(t, "B", antiEntropy, routeTimer)
 	addAddresses(t, n1, addr2)
@@ -64,7 +78,9 @@ func TestGossiper_Topo1_2Nodes_RumorReceived(t *testing.T) {
 
 func TestGossiper_Topo1_2Nodes_AckRumor(t *testing.T) {
 	antiEntropy := 1000
-	routeTimer := 100
+	// no route rumor, the status must only
+	// acknowledge the rumor sent by A
+	routeTimer := 0
 	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer)
 	n2, addr2 := createNode(t, "B", antiEntropy, routeTimer)
 	addAddresses(t, n1, addr2)
@@ -330,214 +346,2461 @@ func TestGossiper_Topo4_5Nodes(t *testing.T) {
 	}
 }
 
-func TestGossiper_Topo1_5Nodes_DSDV1(t *testing.T) {
+func TestGossiper_Topo5_3Nodes_MongerTimeout(t *testing.T) {
 	// arrange
-	antiEntropy := 10
-	routeTimer := 100
-	numberOfNodes := 5
-	nodeAddr := make(map[string]string)      // name -> addr
-	nodeId := make(map[string]string)      // name -> identifier
-	nodeSet := make(map[string]BaseGossiper) // name -> node
-	nodeSlice := make([]BaseGossiper, numberOfNodes)
+	antiEntropy := 1000
+	// no route rumor, the rumor we add
+	// is the first peer A picks
+	routeTimer := 0
+	ackTimeout := WithAckTimeout(300*time.Millisecond)
+
+	// the first peer drawn with this
+	// seed is the first one added
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer, ackTimeout, WithSeed(0))
+	n2, addr2 := createNode(t, "B", antiEntropy, routeTimer, ackTimeout)
+
+	// nobody listens on this address, rumors
+	// sent there are never acknowledged
+	deadAddr := fmt.Sprintf("127.0.0.1:%v", getRandomPort())
+	addAddresses(t, n1, deadAddr, addr2)
+	addAddresses(t, n2, addr1)
 
-	// generate nodes
-	for i := 0; i<numberOfNodes; i++ {
-		id := string(byte('A')+byte(i)) // compute A-E
-		n, addr := createNode(t, id, antiEntropy, routeTimer)
-		nodeSet[id] = n
-		nodeAddr[id] = addr
-		nodeSlice[i] = n
-		nodeId[id] = n.GetIdentifier()
+	const expectedMessage string = "Anybody out there?"
+	msgRecN2 := streamIncomingGossips(n2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	out1 := n1.Watch(ctx, false)
+
+	// act
+	startNodesBlocking(t, n1, n2)
+	defer n1.Stop()
+	defer n2.Stop()
+
+	start := time.Now()
+	n1.AddMessage(expectedMessage)
+
+	// assert: the rumor goes to the dead
+	// address first, then to B once the
+	// ack timeout expires
+	rumorsTo := make([]string, 0, 2)
+	for len(rumorsTo) < 2 {
+		select {
+		case p := <- out1:
+			if p.Msg.Rumor != nil {
+				rumorsTo = append(rumorsTo, p.Addr)
+			}
+		case <- ctx.Done():
+			require.Fail(t, "Expected A to send the rumor twice", "%v", rumorsTo)
+		}
 	}
+	require.Equal(t, []string{deadAddr, addr2}, rumorsTo)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(300*time.Millisecond))
 
-	n := func (name string) BaseGossiper {
-		return nodeSet[name]
+	select {
+	case m := <- msgRecN2:
+		require.Equal(t, n1.GetIdentifier(), m.Rumor.Origin)
+		require.Equal(t, expectedMessage, m.Rumor.Text)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Expected B to receive the rumor")
 	}
+}
 
-	addAddresses(t, n("A"), nodeAddr["B"], nodeAddr["C"])
-	addAddresses(t, n("B"), nodeAddr["D"], nodeAddr["E"])
-	addAddresses(t, n("C"), nodeAddr["A"])
-	addAddresses(t, n("D"), nodeAddr["B"])
-	addAddresses(t, n("E"), nodeAddr["B"])
+func TestGossiper_CoinFlip(t *testing.T) {
+	peers := []string{"127.0.0.1:5001", "127.0.0.1:5002"}
 
-	// act
-	startNodesBlocking(t, nodeSlice...)
-	defer func() {
-		for _, n := range nodeSlice {
-			n.Stop()
+	// flip returns the peers the rumor of a gossiper seeded with seed is
+	// mongered with, first, and after the first peer acknowledges it
+	flip := func(seed int64) (string, []string) {
+		c := clock.NewVirtual(time.Unix(0, 0))
+		network := transport.NewMemoryNetwork(1)
+		tr, err := network.Listen("127.0.0.1:5000")
+		require.NoError(t, err)
+
+		n, err := NewGossiper("127.0.0.1:5000", "A", 0, 0, WithClock(c),
+			WithSeed(seed), WithTransport(tr), WithOutput(ioutil.Discard))
+		require.NoError(t, err)
+		g := n.(*Gossiper)
+		require.NoError(t, g.AddAddresses(peers...))
+
+		g.AddMessage("Heads or tails?")
+
+		g.mux.Lock()
+		defer g.mux.Unlock()
+
+		require.Len(t, g.mongering, 1)
+		var first string
+		for addr := range g.mongering {
+			first = addr
 		}
-	}()
 
-	for _, n := range nodeSet {
-		n.AddMessage("I am alive!")
+		to, err := net.ResolveUDPAddr("udp", first)
+		require.NoError(t, err)
+
+		status := &StatusPacket{Want: []PeerStatus{{Identifier: "A", NextID: 2}}}
+		require.NoError(t, status.Exec(g, to))
+
+		next := make([]string, 0, 1)
+		for addr := range g.mongering {
+			next = append(next, addr)
+		}
+		return first, next
 	}
 
-	<- time.After(5*time.Second)
+	heads := 0
+	for seed := int64(0); seed < 100; seed++ {
+		first, next := flip(seed)
 
-	// assert
-	rtA := n("A").GetRoutingTable()
-	require.Contains(t, rtA, nodeId["B"])
-	require.Equal(t, nodeAddr["B"], rtA[nodeId["B"]].NextHop)
-	require.Contains(t, rtA, nodeId["C"])
-	require.Equal(t, nodeAddr["C"], rtA[nodeId["C"]].NextHop)
+		// the same seed makes
+		// the same choices
+		first2, next2 := flip(seed)
+		require.Equal(t, first, first2)
+		require.Equal(t, next, next2)
 
-	rtD := n("D").GetRoutingTable()
-	require.Contains(t, rtD, nodeId["B"])
-	require.Equal(t, nodeAddr["B"], rtD[nodeId["B"]].NextHop)
+		// the rumor goes on to
+		// the other peer, or stops
+		if len(next) == 0 {
+			continue
+		}
+		heads++
+		require.Len(t, next, 1)
+		require.NotEqual(t, first, next[0])
+	}
+
+	// one rumor in two goes on
+	require.InDelta(t, 50, heads, 15)
 }
 
-func TestGossiper_Topo1_5Nodes_DSDV2(t *testing.T) {
-	// arrange
-	antiEntropy := 10
+func TestGossiper_Topo1_2Nodes_OutOfOrderRumors(t *testing.T) {
+	antiEntropy := 1000
 	routeTimer := 100
-	numberOfNodes := 5
-	nodeAddr := make(map[string]string)      // name -> addr
-	nodeId := make(map[string]string)      // name -> identifier
-	nodeSet := make(map[string]BaseGossiper) // name -> node
-	nodeSlice := make([]BaseGossiper, numberOfNodes)
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer)
 
-	// generate nodes
-	for i := 0; i<numberOfNodes; i++ {
-		id := string(byte('A')+byte(i)) // compute A-E
-		n, addr := createNode(t, id, antiEntropy, routeTimer)
-		nodeSet[id] = n
-		nodeAddr[id] = addr
-		nodeId[id] = n.GetIdentifier()
-		nodeSlice[i] = n
+	// a raw socket plays the role of the
+	// second node to control the order
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msgRecN1 := streamIncomingGossips(n1)
+
+	startNodesBlocking(t, n1)
+	defer n1.Stop()
+
+	to, err := net.ResolveUDPAddr("udp", addr1)
+	require.NoError(t, err)
+
+	const origin string = "B"
+	key := newKey(t)
+	for _, id := range []uint32{3, 2, 1} {
+		sendRawPacket(t, conn, to, GossipPacket{
+			Rumor: signRumor(key, &RumorMessage{
+				Origin: origin,
+				ID:     id,
+				Text:   fmt.Sprintf("message %v", id),
+			}),
+		})
 	}
 
-	n := func (name string) BaseGossiper {
-		return nodeSet[name]
+	for id := uint32(1); id <= 3; id++ {
+		select {
+		case m := <- msgRecN1:
+			require.Equal(t, origin, m.Rumor.Origin)
+			require.Equal(t, id, m.Rumor.ID)
+		case <- time.After(3*time.Second):
+			require.Fail(t, "Timed out on reception")
+		}
 	}
+}
 
-	addAddresses(t, n("A"), nodeAddr["B"], nodeAddr["C"])
-	addAddresses(t, n("B"), nodeAddr["D"], nodeAddr["E"])
-	addAddresses(t, n("C"), nodeAddr["A"])
-	addAddresses(t, n("D"), nodeAddr["B"])
-	addAddresses(t, n("E"), nodeAddr["B"])
+func TestGossiper_Topo1_2Nodes_CatchUpBothSides(t *testing.T) {
+	antiEntropy := 1000
+	routeTimer := 100
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer)
 
-	// act
-	startNodesBlocking(t, nodeSlice...)
-	defer func() {
-		for _, n := range nodeSlice {
-			n.Stop()
-		}
-	}()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
 
-	n("A").AddMessage("Hi!")
-	<- time.After(5*time.Second)
-	n("B").AddMessage("Hi there!")
-	n("C").AddMessage("Hi there!")
-	n("D").AddMessage("Hi there!")
-	n("E").AddMessage("Hi there!")
-	<- time.After(5*time.Second)
+	startNodesBlocking(t, n1)
+	defer n1.Stop()
 
-	// assert
-	rtA := n("A").GetRoutingTable()
-	require.Contains(t, rtA, nodeId["B"])
-	require.Equal(t, nodeAddr["B"], rtA[nodeId["B"]].NextHop)
-	require.Contains(t, rtA, nodeId["C"])
-	require.Equal(t, nodeAddr["C"], rtA[nodeId["C"]].NextHop)
-	require.Contains(t, rtA, nodeId["D"])
-	require.Equal(t, nodeAddr["B"], rtA[nodeId["D"]].NextHop)
-	require.Contains(t, rtA, nodeId["E"])
-	require.Equal(t, nodeAddr["B"], rtA[nodeId["E"]].NextHop)
+	// A has no peer yet, its messages
+	// stay local
+	const msgCount int = 3
+	for i := 0; i < msgCount; i++ {
+		n1.AddMessage(fmt.Sprintf("message %v", i + 1))
+	}
 
-	rtD := n("B").GetRoutingTable()
-	require.Contains(t, rtD, nodeId["A"])
-	require.Equal(t, nodeAddr["A"], rtD[nodeId["A"]].NextHop)
-	require.Contains(t, rtD, nodeId["C"])
-	require.Equal(t, nodeAddr["A"], rtD[nodeId["C"]].NextHop)
-	require.Contains(t, rtD, nodeId["D"])
-	require.Equal(t, nodeAddr["D"], rtD[nodeId["D"]].NextHop)
-	require.Contains(t, rtD, nodeId["E"])
-	require.Equal(t, nodeAddr["E"], rtD[nodeId["E"]].NextHop)
+	to, err := net.ResolveUDPAddr("udp", addr1)
+	require.NoError(t, err)
+
+	// both sides miss messages
+	sendRawPacket(t, conn, to, GossipPacket{
+		Status: &StatusPacket{
+			Want: []PeerStatus{{Identifier: "B", NextID: 3}},
+		},
+	})
+
+	gotStatus := false
+	nextID := uint32(1)
+	for !gotStatus || nextID <= uint32(msgCount) {
+		packet := readRawPacket(t, conn)
+
+		if packet.Status != nil {
+			gotStatus = true
+			continue
+		}
+
+		require.NotNil(t, packet.Rumor)
+		require.Equal(t, n1.GetIdentifier(), packet.Rumor.Origin)
+		require.Equal(t, nextID, packet.Rumor.ID)
+		nextID++
+	}
 }
 
-// -----------------------------------------------------------------------------
-// Utility functions
+func TestGossiper_Topo1_2Nodes_LongRumor(t *testing.T) {
+	antiEntropy := 1000
+	routeTimer := 0
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer)
+	n2, addr2 := createNode(t, "B", antiEntropy, routeTimer)
 
-func createNode(t *testing.T, name string, antiEntropy int,
-	routeTimer int) (BaseGossiper, string) {
+	addAddresses(t, n1, addr2)
+	addAddresses(t, n2, addr1)
 
-	addr := fmt.Sprintf("127.0.0.1:%v", getRandomPort())
-	fullName := fmt.Sprintf("%v---%v", name, t.Name())
-	node, err := factory.New(addr, fullName, antiEntropy, routeTimer)
-	require.NoError(t, err)
-	require.Len(t, node.GetNodes(), 0)
-	require.Equal(t, fullName, node.GetIdentifier())
+	msgRecN2 := streamIncomingGossips(n2)
 
-	return node, addr
-}
+	startNodesBlocking(t, n1, n2)
+	defer n1.Stop()
+	defer n2.Stop()
 
-// addAddresses takes any number of node addresses that the gossiper can
-// contact in the gossiping network.
-func addAddresses(t *testing.T, node BaseGossiper, addresses ...string) {
-	numNodes := len(node.GetNodes())
-	err := node.AddAddresses(addresses...)
-	require.Nil(t, err, "Could not add addresses")
+	// several times the size of a datagram
+	text := strings.Repeat("a long chat message ", 1000)
+	n1.AddMessage(text)
 
-	// Assumes we're not adding twice the same address.
-	require.Len(t, node.GetNodes(), numNodes + len(addresses))
+	select {
+	case m := <- msgRecN2:
+		require.Equal(t, text, m.Rumor.Text)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Timed out on reception")
+	}
 }
 
-// startNodesBlocking waits until the node is started
-func startNodesBlocking(t *testing.T, nodes ...BaseGossiper) {
-	wg := new(sync.WaitGroup)
-	wg.Add(len(nodes))
-	for idx, _ := range nodes {
-		go func(i int) {
-			defer wg.Done()
-			ready := make(chan struct{})
-			go nodes[i].Run(ready)
-			<- ready
-		}(idx)
+func TestGossiper_Topo1_2Nodes_Fragments(t *testing.T) {
+	antiEntropy := 1000
+	routeTimer := 0
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer,
+		WithMaxPacketSize(20000))
+
+	// a raw socket plays the role of the
+	// second node to control the fragments
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msgRecN1 := streamIncomingGossips(n1)
+
+	startNodesBlocking(t, n1)
+	defer n1.Stop()
+
+	to, err := net.ResolveUDPAddr("udp", addr1)
+	require.NoError(t, err)
+
+	sender := &Gossiper{
+		maxDatagramSize: 1000,
+		maxPacketSize:   defaultMaxPacketSize,
 	}
-	wg.Wait()
-}
 
-func streamIncomingGossips(node BaseGossiper) chan GossipPacket {
-	ch := make(chan GossipPacket)
-	node.RegisterCallback(
-		func(origin string, message GossipPacket) {
-			ch <- message
+	key := newKey(t)
+	fragments := func(text string) [][]byte {
+		b, err := json.Marshal(GossipPacket{
+			Rumor: signRumor(key, &RumorMessage{Origin: "B", ID: 1, Text: text}),
 		})
-	return ch
-}
+		require.NoError(t, err)
 
-func waitStatusMsg(t *testing.T, ctx context.Context,
-	ch <- chan CallbackPacket) *CallbackPacket {
-	for {
-		select {
-		case <-ctx.Done():
-			require.Fail(t, "Timed out on reception")
-		case p := <-ch:
-			if p.Msg.Status != nil {
-				return &p
-			}
-		}
+		datagrams, err := sender.fragment(b)
+		require.NoError(t, err)
+		require.True(t, len(datagrams) > 1)
+		return datagrams
 	}
-}
 
-func waitRumorMsg(t *testing.T, ctx context.Context,
-	ch <- chan CallbackPacket) *CallbackPacket {
-	for {
-		select {
-		case <- ctx.Done():
-			require.Fail(t, "Timed out on reception")
-		case p := <- ch:
-			if p.Msg.Rumor != nil {
-				return &p
-			}
-		}
+	// too large to be reassembled
+	for _, d := range fragments(strings.Repeat("x", 30000)) {
+		_, err = conn.WriteToUDP(d, to)
+		require.NoError(t, err)
+	}
+
+	// in reverse order, with a duplicate
+	text := strings.Repeat("y", 5000)
+	datagrams := fragments(text)
+	datagrams = append(datagrams, datagrams[0])
+	for i := len(datagrams) - 1; i >= 0; i-- {
+		_, err = conn.WriteToUDP(datagrams[i], to)
+		require.NoError(t, err)
 	}
-}
 
-func waitChannel(t *testing.T, ctx context.Context, c <-chan struct{}) {
 	select {
-	case <- ctx.Done():
+	case m := <- msgRecN1:
+		require.Equal(t, text, m.Rumor.Text)
+	case <- time.After(3*time.Second):
 		require.Fail(t, "Timed out on reception")
-	case <- c:
+	}
+
+	select {
+	case m := <- msgRecN1:
+		require.Fail(t, "Unexpected rumor", len(m.Rumor.Text))
+	case <- time.After(500*time.Millisecond):
+	}
+}
+
+func TestGossiper_FragmentFlood(t *testing.T) {
+	c := clock.NewVirtual(time.Unix(0, 0))
+	n, err := NewGossiper("127.0.0.1:0", "A", 0, 0, WithClock(c))
+	require.NoError(t, err)
+	g := n.(*Gossiper)
+
+	fragment := func(id uint32, count int) []byte {
+		d := make([]byte, fragmentHeaderSize+1)
+		d[0] = fragmentMagic
+		binary.BigEndian.PutUint32(d[1:5], id)
+		binary.BigEndian.PutUint16(d[5:7], 0)
+		binary.BigEndian.PutUint16(d[7:9], uint16(count))
+		return d
+	}
+
+	// act: one-byte fragments of packets
+	// that never complete, from a few
+	// senders
+	for i := 0; i < 3000; i++ {
+		sender := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000 + i%20}
+		g.Process(fragment(uint32(i), 0xFFFF), sender)
+		g.Process(fragment(uint32(i), g.maxFragments()), sender)
+	}
+
+	// assert
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	require.LessOrEqual(t, len(g.partials), maxPartials)
+	require.LessOrEqual(t, g.reassemblySize, maxReassemblyPackets*g.maxPacketSize)
+
+	perSender := make(map[string]int)
+	for _, p := range g.partials {
+		perSender[p.sender]++
+		require.Len(t, p.fragments, g.maxFragments())
+	}
+	for _, count := range perSender {
+		require.LessOrEqual(t, count, maxPartialsPerSender)
+	}
+
+	// the incomplete packets expire
+	g.mux.Unlock()
+	c.Advance(reassemblyTimeout)
+	g.mux.Lock()
+
+	require.Empty(t, g.partials)
+	require.Equal(t, 0, g.reassemblySize)
+
+	// the sizes must leave room
+	// for the fragments
+	_, err = NewGossiper("127.0.0.1:0", "A", 0, 0, WithMaxDatagramSize(0))
+	require.Error(t, err)
+	_, err = NewGossiper("127.0.0.1:0", "A", 0, 0, WithMaxPacketSize(0))
+	require.Error(t, err)
+	_, err = NewGossiper("127.0.0.1:0", "A", 0, 0, WithMaxPacketSize(1<<30))
+	require.Error(t, err)
+}
+
+func TestGossiper_Codec_Binary(t *testing.T) {
+	packets := []GossipPacket{
+		{Simple: &SimpleMessage{OriginPeerName: "A", RelayPeerAddr: "127.0.0.1:5000", Contents: "hi"}},
+		{Rumor: &RumorMessage{Origin: "A", ID: 42, Text: "hello"}},
+		{Rumor: &RumorMessage{Origin: "A", ID: 1}},
+		{Status: &StatusPacket{Want: []PeerStatus{{"A", 2}, {"B", 300000}}}},
+		{Status: &StatusPacket{Want: []PeerStatus{}}},
+		{Status: &StatusPacket{Want: []PeerStatus{{"A", 1}}, Probe: true}},
+		{Status: &StatusPacket{Want: []PeerStatus{{"A", 1}}, Push: true}},
+		{Status: &StatusPacket{Want: []PeerStatus{{"A", 1}}, Pull: true}},
+		{PeerExchange: &PeerExchangePacket{Peers: []string{"127.0.0.1:5000", "127.0.0.1:5001"}}},
+		{Digest: &DigestPacket{Hash: make([]byte, digestSize)}},
+		{IHave: &IHavePacket{Origin: "A", ID: 7}},
+		{Graft: &GraftPacket{Origin: "A", ID: 7}},
+		{Prune: &PrunePacket{Origin: "A"}},
+		{Batch: &BatchPacket{Rumors: []*RumorMessage{
+			{Origin: "A", ID: 1, Text: "one"}, {Origin: "B", ID: 5, Text: "two"}}}},
+		{Batch: &BatchPacket{Rumors: []*RumorMessage{{Origin: "A", ID: 1}},
+			Status: &StatusPacket{Want: []PeerStatus{{"A", 2}}}}},
+		{Private: &PrivateMessage{Origin: "A", Text: "psst", Destination: "B", HopLimit: 10}},
+		{Rumor: signRumor(newKey(t), &RumorMessage{Origin: "A", ID: 2, Text: "signed"})},
+		{Rumor: signRumor(newKey(t), &RumorMessage{Origin: "A", ID: 3, BoxKey: make([]byte, 32)})},
+		{Private: &PrivateMessage{Destination: "B", HopLimit: 10,
+			EphemeralKey: make([]byte, 32), Ciphertext: []byte("sealed")}},
+	}
+
+	for _, p := range packets {
+		b, err := encodeBinary(p, wireVersion)
+		require.NoError(t, err)
+		require.Equal(t, binaryMagic, b[0])
+
+		j, err := encodeJSON(p, wireVersion)
+		require.NoError(t, err)
+		require.Less(t, len(b), len(j))
+
+		decoded, version, err := decodePacket(b)
+		require.NoError(t, err)
+		require.Equal(t, wireVersion, version)
+		require.Equal(t, p, decoded)
+
+		decoded, version, err = decodePacket(j)
+		require.NoError(t, err)
+		require.Equal(t, wireVersion, version)
+		p.WireVersion = wireVersion
+		require.Equal(t, p, decoded)
+	}
+
+	// fields added by later versions are skipped
+	b, err := encodeBinary(packets[1], wireVersion)
+	require.NoError(t, err)
+	b = append(b, 99, 3, 'n', 'e', 'w')
+	decoded, _, err := decodePacket(b)
+	require.NoError(t, err)
+	require.Equal(t, packets[1], decoded)
+
+	// types added by later versions are
+	// dropped, and do not count as invalid
+	unknown := []byte{binaryMagic, wireVersion, 200, 1, 1, 'x'}
+	_, _, err = decodePacket(unknown)
+	require.True(t, xerrors.Is(err, errUnknownType))
+
+	n, err := NewGossiper("127.0.0.1:0", "A", 0, 0, WithBans(1, time.Minute))
+	require.NoError(t, err)
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	for i := 0; i < 3; i++ {
+		n.(*Gossiper).Process(unknown, peer)
+	}
+	require.Equal(t, 0, n.GetLimitStats().Invalid)
+	require.Empty(t, n.GetBans())
+
+	// versions we do not read are rejected
+	b[1] = wireVersion + 1
+	_, _, err = decodePacket(b)
+	require.Error(t, err)
+
+	// truncated packets are rejected
+	b, err = encodeBinary(packets[1], wireVersion)
+	require.NoError(t, err)
+	_, _, err = decodePacket(b[:len(b)-1])
+	require.Error(t, err)
+
+	// a binary packet carries one message
+	_, err = encodeBinary(GossipPacket{Rumor: packets[1].Rumor, Status: packets[3].Status}, wireVersion)
+	require.Error(t, err)
+}
+
+func TestGossiper_Topo1_2Nodes_WireNegotiation(t *testing.T) {
+	antiEntropy := 1000
+	routeTimer := 0
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer)
+
+	// a raw socket plays the role of the
+	// second node to choose its format
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	startNodesBlocking(t, n1)
+	defer n1.Stop()
+
+	to, err := net.ResolveUDPAddr("udp", addr1)
+	require.NoError(t, err)
+
+	readFormat := func() byte {
+		b := make([]byte, 1500)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+		n, _, err := conn.ReadFromUDP(b)
+		require.NoError(t, err)
+		require.True(t, n > 0)
+		return b[0]
+	}
+
+	key := newKey(t)
+	rumor := func(id uint32) GossipPacket {
+		return GossipPacket{Rumor: signRumor(key, &RumorMessage{Origin: "B", ID: id, Text: "hi"})}
+	}
+
+	// a JSON-only peer gets JSON
+	sendRawPacket(t, conn, to, rumor(1))
+	require.Equal(t, byte('{'), readFormat())
+
+	// a peer advertising the binary format gets it
+	p := rumor(2)
+	p.WireVersion = wireVersion
+	sendRawPacket(t, conn, to, p)
+	require.Equal(t, binaryMagic, readFormat())
+
+	// a binary packet is read and answered in binary
+	b, err := encodeBinary(rumor(3), wireVersion)
+	require.NoError(t, err)
+	_, err = conn.WriteToUDP(b, to)
+	require.NoError(t, err)
+	require.Equal(t, binaryMagic, readFormat())
+
+	// back to JSON if the peer stops advertising
+	sendRawPacket(t, conn, to, rumor(4))
+	require.Equal(t, byte('{'), readFormat())
+}
+
+func TestGossiper_Topo1_2Nodes_MixedWireFormats(t *testing.T) {
+	antiEntropy := 1000
+	routeTimer := 0
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer)
+	n2, addr2 := createNode(t, "B", antiEntropy, routeTimer, WithWireFormat(WireJSON))
+
+	addAddresses(t, n1, addr2)
+	addAddresses(t, n2, addr1)
+
+	msgRecN1 := streamIncomingGossips(n1)
+	msgRecN2 := streamIncomingGossips(n2)
+
+	startNodesBlocking(t, n1, n2)
+	defer n1.Stop()
+	defer n2.Stop()
+
+	n1.AddMessage("from the binary node")
+	n2.AddMessage("from the JSON node")
+
+	select {
+	case m := <- msgRecN2:
+		require.Equal(t, "from the binary node", m.Rumor.Text)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Timed out on reception by B")
+	}
+
+	select {
+	case m := <- msgRecN1:
+		require.Equal(t, "from the JSON node", m.Rumor.Text)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Timed out on reception by A")
+	}
+}
+
+func TestGossiper_Topo1_2Nodes_ForgedRumors(t *testing.T) {
+	antiEntropy := 1000
+	routeTimer := 0
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer)
+
+	// a raw socket plays the role of
+	// the second node and of a forger
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msgRecN1 := streamIncomingGossips(n1)
+
+	startNodesBlocking(t, n1)
+	defer n1.Stop()
+
+	to, err := net.ResolveUDPAddr("udp", addr1)
+	require.NoError(t, err)
+
+	key, forger := newKey(t), newKey(t)
+
+	send := func(rumor *RumorMessage) {
+		sendRawPacket(t, conn, to, GossipPacket{Rumor: rumor})
+		// the node acknowledges valid rumors
+		// only, do not wait for the others
+		time.Sleep(100*time.Millisecond)
+	}
+
+	// unsigned
+	send(&RumorMessage{Origin: "B", ID: 1, Text: "unsigned"})
+
+	// tampered with
+	tampered := signRumor(key, &RumorMessage{Origin: "B", ID: 1, Text: "original"})
+	tampered.Text = "tampered"
+	send(tampered)
+
+	// the first valid key binds the origin
+	send(signRumor(key, &RumorMessage{Origin: "B", ID: 1, Text: "genuine"}))
+
+	// another key for the same origin
+	send(signRumor(forger, &RumorMessage{Origin: "B", ID: 2, Text: "forged"}))
+
+	// the name of the node itself
+	send(signRumor(forger, &RumorMessage{Origin: n1.GetIdentifier(), ID: 1, Text: "impersonated"}))
+
+	send(signRumor(key, &RumorMessage{Origin: "B", ID: 2, Text: "genuine again"}))
+
+	for _, text := range []string{"genuine", "genuine again"} {
+		select {
+		case m := <- msgRecN1:
+			require.Equal(t, "B", m.Rumor.Origin)
+			require.Equal(t, text, m.Rumor.Text)
+		case <- time.After(3*time.Second):
+			require.Fail(t, "Timed out on reception")
+		}
+	}
+
+	select {
+	case m := <- msgRecN1:
+		require.Fail(t, "Unexpected rumor", m.Rumor.Text)
+	case <- time.After(500*time.Millisecond):
+	}
+
+	keys := n1.(*Gossiper).GetKeys()
+	require.Equal(t, key.Public(), keys["B"])
+	require.Equal(t, n1.(*Gossiper).GetPublicKey(), keys[n1.GetIdentifier()])
+}
+
+func TestGossiper_Topo3_3Nodes_Impersonation(t *testing.T) {
+	antiEntropy := 1
+	routeTimer := 0
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer)
+	n2, addr2 := createNode(t, "B", antiEntropy, routeTimer)
+	n3, addr3 := createNode(t, "C", antiEntropy, routeTimer)
+
+	// A <-> B <-> C
+	addAddresses(t, n1, addr2)
+	addAddresses(t, n2, addr1, addr3)
+	addAddresses(t, n3, addr2)
+
+	msgRecN2 := streamIncomingGossips(n2)
+
+	startNodesBlocking(t, n1, n2, n3)
+	defer n1.Stop()
+	defer n2.Stop()
+	defer n3.Stop()
+
+	n1.AddMessage("from A")
+
+	select {
+	case m := <- msgRecN2:
+		require.Equal(t, "from A", m.Rumor.Text)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Timed out on reception")
+	}
+
+	// C knows the key of A
+	require.Eventually(t, func() bool {
+		_, ok := n3.(*Gossiper).GetKeys()[n1.GetIdentifier()]
+		return ok
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// C cannot take the name of A
+	require.Error(t, n3.SetIdentifier(n1.GetIdentifier()))
+	require.Equal(t, "C---"+t.Name(), n3.GetIdentifier())
+
+	// a new name starts a new sequence,
+	// the old one goes on where it stopped
+	require.Equal(t, uint32(1), n3.AddMessage("from C"))
+	require.NoError(t, n3.SetIdentifier("D"))
+	require.Equal(t, uint32(1), n3.AddMessage("from D"))
+	require.NoError(t, n3.SetIdentifier("C---"+t.Name()))
+	require.Equal(t, uint32(2), n3.AddMessage("from C again"))
+}
+
+func TestGossiper_Discovery(t *testing.T) {
+	antiEntropy := 1
+	routeTimer := 0
+	group := "239.255.43.8:" + getRandomPort()
+
+	// C is in another network
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer,
+		WithDiscovery(group, 50*time.Millisecond))
+	n2, addr2 := createNode(t, "B", antiEntropy, routeTimer,
+		WithDiscovery(group, 50*time.Millisecond))
+	n3, _ := createNode(t, "C", antiEntropy, routeTimer,
+		WithDiscovery(group, 50*time.Millisecond), WithNetwork("other", nil))
+
+	startNodesBlocking(t, n1, n2, n3)
+	defer n1.Stop()
+	defer n2.Stop()
+	defer n3.Stop()
+
+	if n1.(*Gossiper).discovery == nil {
+		t.Skip("no multicast on this host")
+	}
+
+	deadline := time.After(3*time.Second)
+	for len(n1.GetNodes()) == 0 || len(n2.GetNodes()) == 0 {
+		select {
+		case <- deadline:
+			require.Fail(t, "Timed out waiting for the discovery")
+		case <- time.After(10*time.Millisecond):
+		}
+	}
+
+	// the beacons of C are ignored
+	time.Sleep(200*time.Millisecond)
+	require.Equal(t, []string{addr2}, n1.GetNodes())
+	require.Equal(t, []string{addr1}, n2.GetNodes())
+	require.Len(t, n3.GetNodes(), 0)
+
+	n1.AddMessage("found you")
+	waitRoute(t, n2, n1.GetIdentifier(), 3*time.Second)
+}
+
+func TestGossiper_DiscoveryBounds(t *testing.T) {
+	n, err := NewGossiper("127.0.0.1:5000", "A", 0, 0,
+		WithPeerExchange(0, 2), WithOutput(ioutil.Discard))
+	require.NoError(t, err)
+	g := n.(*Gossiper)
+
+	announce := func(addr string, sender string) {
+		b, err := json.Marshal(beacon{Identifier: "B", Addr: addr})
+		require.NoError(t, err)
+		from, err := net.ResolveUDPAddr("udp", sender)
+		require.NoError(t, err)
+		g.handleBeacon(b, from)
+	}
+
+	// act
+	announce("127.0.0.1:5000", "127.0.0.1:33333")
+	announce("127.0.0.1:6001", "192.0.2.1:33333")
+	announce("0.0.0.0:6002", "192.0.2.2:33333")
+	announce("192.0.2.3:6003", "192.0.2.3:33333")
+
+	// assert: we are not our peer, the loopback
+	// address of another host is its address,
+	// and no more than 2 peers are learnt
+	require.Equal(t, []string{"192.0.2.1:6001", "192.0.2.2:6002"}, n.GetNodes())
+	require.Equal(t, "192.0.2.1:33333", g.learntFrom["192.0.2.1:6001"])
+}
+
+func TestGossiper_Topo1_5Nodes_DSDV1(t *testing.T) {
+	// arrange
+	antiEntropy := 10
+	routeTimer := 100
+	numberOfNodes := 5
+	nodeAddr := make(map[string]string)      // name -> addr
+	nodeId := make(map[string]string)      // name -> identifier
+	nodeSet := make(map[string]BaseGossiper) // name -> node
+	nodeSlice := make([]BaseGossiper, numberOfNodes)
+
+	// generate nodes
+	for i := 0; i<numberOfNodes; i++ {
+		id := string(byte('A')+byte(i)) // compute A-E
+		n, addr := createNode(t, id, antiEntropy, routeTimer)
+		nodeSet[id] = n
+		nodeAddr[id] = addr
+		nodeSlice[i] = n
+		nodeId[id] = n.GetIdentifier()
+	}
+
+	n := func (name string) BaseGossiper {
+		return nodeSet[name]
+	}
+
+	addAddresses(t, n("A"), nodeAddr["B"], nodeAddr["C"])
+	addAddresses(t, n("B"), nodeAddr["D"], nodeAddr["E"])
+	addAddresses(t, n("C"), nodeAddr["A"])
+	addAddresses(t, n("D"), nodeAddr["B"])
+	addAddresses(t, n("E"), nodeAddr["B"])
+
+	// act
+	startNodesBlocking(t, nodeSlice...)
+	defer func() {
+		for _, n := range nodeSlice {
+			n.Stop()
+		}
+	}()
+
+	for _, n := range nodeSet {
+		n.AddMessage("I am alive!")
+	}
+
+	<- time.After(5*time.Second)
+
+	// assert
+	rtA := n("A").GetRoutingTable()
+	require.Contains(t, rtA, nodeId["B"])
+	require.Equal(t, nodeAddr["B"], rtA[nodeId["B"]].NextHop)
+	require.Contains(t, rtA, nodeId["C"])
+	require.Equal(t, nodeAddr["C"], rtA[nodeId["C"]].NextHop)
+
+	rtD := n("D").GetRoutingTable()
+	require.Contains(t, rtD, nodeId["B"])
+	require.Equal(t, nodeAddr["B"], rtD[nodeId["B"]].NextHop)
+}
+
+func TestGossiper_Topo1_5Nodes_DSDV2(t *testing.T) {
+	// arrange
+	antiEntropy := 10
+	routeTimer := 100
+	numberOfNodes := 5
+	nodeAddr := make(map[string]string)      // name -> addr
+	nodeId := make(map[string]string)      // name -> identifier
+	nodeSet := make(map[string]BaseGossiper) // name -> node
+	nodeSlice := make([]BaseGossiper, numberOfNodes)
+
+	// generate nodes
+	for i := 0; i<numberOfNodes; i++ {
+		id := string(byte('A')+byte(i)) // compute A-E
+		n, addr := createNode(t, id, antiEntropy, routeTimer)
+		nodeSet[id] = n
+		nodeAddr[id] = addr
+		nodeId[id] = n.GetIdentifier()
+		nodeSlice[i] = n
+	}
+
+	n := func (name string) BaseGossiper {
+		return nodeSet[name]
+	}
+
+	addAddresses(t, n("A"), nodeAddr["B"], nodeAddr["C"])
+	addAddresses(t, n("B"), nodeAddr["D"], nodeAddr["E"])
+	addAddresses(t, n("C"), nodeAddr["A"])
+	addAddresses(t, n("D"), nodeAddr["B"])
+	addAddresses(t, n("E"), nodeAddr["B"])
+
+	// act
+	startNodesBlocking(t, nodeSlice...)
+	defer func() {
+		for _, n := range nodeSlice {
+			n.Stop()
+		}
+	}()
+
+	n("A").AddMessage("Hi!")
+	<- time.After(5*time.Second)
+	n("B").AddMessage("Hi there!")
+	n("C").AddMessage("Hi there!")
+	n("D").AddMessage("Hi there!")
+	n("E").AddMessage("Hi there!")
+	<- time.After(5*time.Second)
+
+	// assert
+	rtA := n("A").GetRoutingTable()
+	require.Contains(t, rtA, nodeId["B"])
+	require.Equal(t, nodeAddr["B"], rtA[nodeId["B"]].NextHop)
+	require.Contains(t, rtA, nodeId["C"])
+	require.Equal(t, nodeAddr["C"], rtA[nodeId["C"]].NextHop)
+	require.Contains(t, rtA, nodeId["D"])
+	require.Equal(t, nodeAddr["B"], rtA[nodeId["D"]].NextHop)
+	require.Contains(t, rtA, nodeId["E"])
+	require.Equal(t, nodeAddr["B"], rtA[nodeId["E"]].NextHop)
+
+	rtD := n("B").GetRoutingTable()
+	require.Contains(t, rtD, nodeId["A"])
+	require.Equal(t, nodeAddr["A"], rtD[nodeId["A"]].NextHop)
+	require.Contains(t, rtD, nodeId["C"])
+	require.Equal(t, nodeAddr["A"], rtD[nodeId["C"]].NextHop)
+	require.Contains(t, rtD, nodeId["D"])
+	require.Equal(t, nodeAddr["D"], rtD[nodeId["D"]].NextHop)
+	require.Contains(t, rtD, nodeId["E"])
+	require.Equal(t, nodeAddr["E"], rtD[nodeId["E"]].NextHop)
+}
+
+func TestGossiper_Topo6_3Nodes_PrivateMessage(t *testing.T) {
+	// arrange
+	antiEntropy := 1
+	routeTimer := 1
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer)
+	n2, addr2 := createNode(t, "B", antiEntropy, routeTimer)
+	n3, addr3 := createNode(t, "C", antiEntropy, routeTimer)
+
+	// A <-> B <-> C
+	addAddresses(t, n1, addr2)
+	addAddresses(t, n2, addr1, addr3)
+	addAddresses(t, n3, addr2)
+
+	msgRecN3 := make(chan PrivateMessage, 10)
+	n3.RegisterCallback(
+		func(origin string, message GossipPacket) {
+			if message.Private != nil {
+				msgRecN3 <- *message.Private
+			}
+		})
+
+	startNodesBlocking(t, n1, n2, n3)
+	defer n1.Stop()
+	defer n2.Stop()
+	defer n3.Stop()
+
+	err := n1.AddPrivateMessage("nobody", "Z", n1.GetIdentifier(), 10)
+	require.Error(t, err, "Expected an error without route")
+
+	waitRoute(t, n1, n3.GetIdentifier(), 5*time.Second)
+	require.Equal(t, addr2, n1.GetRoutingTable()[n3.GetIdentifier()].NextHop)
+
+	// act
+	err = n1.AddPrivateMessage("too far", n3.GetIdentifier(), n1.GetIdentifier(), 1)
+	require.NoError(t, err)
+	err = n1.AddPrivateMessage("psst", n3.GetIdentifier(), n1.GetIdentifier(), 10)
+	require.NoError(t, err)
+
+	// assert
+	select {
+	case m := <- msgRecN3:
+		require.Equal(t, n1.GetIdentifier(), m.Origin)
+		require.Equal(t, "psst", m.Text)
+		require.Equal(t, 9, m.HopLimit)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Expected C to receive the private message")
+	}
+
+	// no hop limit
+	err = n1.AddPrivateMessage("default", n3.GetIdentifier(), n1.GetIdentifier(), 0)
+	require.NoError(t, err)
+
+	select {
+	case m := <- msgRecN3:
+		require.Equal(t, "default", m.Text)
+		require.Equal(t, DefaultHopLimit-1, m.HopLimit)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Expected C to receive the private message")
+	}
+
+	select {
+	case m := <- msgRecN3:
+		require.Fail(t, "Unexpected private message", m.Text)
+	case <- time.After(500*time.Millisecond):
+	}
+}
+
+func TestGossiper_Topo6_3Nodes_EncryptedPrivateMessage(t *testing.T) {
+	// arrange
+	antiEntropy := 1
+	routeTimer := 1
+	n1, addr1 := createNode(t, "A", antiEntropy, routeTimer)
+	n2, addr2 := createNode(t, "B", antiEntropy, routeTimer)
+	n3, addr3 := createNode(t, "C", antiEntropy, routeTimer)
+
+	// A <-> B <-> C
+	addAddresses(t, n1, addr2)
+	addAddresses(t, n2, addr1, addr3)
+	addAddresses(t, n3, addr2)
+
+	msgRecN3 := make(chan PrivateMessage, 10)
+	n3.RegisterCallback(
+		func(origin string, message GossipPacket) {
+			if message.Private != nil {
+				msgRecN3 <- *message.Private
+			}
+		})
+
+	// B relays the message
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	relayedN2 := make(chan PrivateMessage, 10)
+	go func() {
+		for p := range n2.Watch(ctx, true) {
+			if p.Msg.Private != nil {
+				relayedN2 <- *p.Msg.Private
+			}
+		}
+	}()
+
+	startNodesBlocking(t, n1, n2, n3)
+	defer n1.Stop()
+	defer n2.Stop()
+	defer n3.Stop()
+
+	waitRoute(t, n1, n3.GetIdentifier(), 5*time.Second)
+
+	// act
+	err := n1.AddPrivateMessage("psst", n3.GetIdentifier(), n1.GetIdentifier(), 10)
+	require.NoError(t, err)
+
+	// assert
+	select {
+	case m := <- relayedN2:
+		require.Empty(t, m.Origin)
+		require.Empty(t, m.Text)
+		require.Equal(t, n3.GetIdentifier(), m.Destination)
+		require.NotEmpty(t, m.Ciphertext)
+		require.NotContains(t, string(m.Ciphertext), "psst")
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Expected B to relay the private message")
+	}
+
+	select {
+	case m := <- msgRecN3:
+		require.Equal(t, n1.GetIdentifier(), m.Origin)
+		require.Equal(t, "psst", m.Text)
+		require.True(t, m.Decrypted)
+		require.True(t, m.Authenticated)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Expected C to receive the private message")
+	}
+
+	// a peer that does not encrypt
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	to, err := net.ResolveUDPAddr("udp", addr3)
+	require.NoError(t, err)
+
+	sendRawPacket(t, conn, to, GossipPacket{Private: &PrivateMessage{
+		Origin: "D", Text: "in clear", Destination: n3.GetIdentifier(), HopLimit: 10}})
+
+	select {
+	case m := <- msgRecN3:
+		require.Equal(t, "in clear", m.Text)
+		require.False(t, m.Decrypted)
+		require.False(t, m.Authenticated)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Expected C to receive the private message")
+	}
+
+	// a message in clear from an origin
+	// C knows the box key of
+	sendRawPacket(t, conn, to, GossipPacket{Private: &PrivateMessage{
+		Origin: n1.GetIdentifier(), Text: "forged", Destination: n3.GetIdentifier(), HopLimit: 10}})
+
+	select {
+	case m := <- msgRecN3:
+		require.Fail(t, "Unexpected private message", m.Text)
+	case <- time.After(500*time.Millisecond):
+	}
+
+	// a signed message from an origin C
+	// never heard of does not bind its key
+	stranger := &Gossiper{
+		key:     newKey(t),
+		boxKeys: map[string][]byte{n3.GetIdentifier(): n3.(*Gossiper).GetBoxKey()},
+		entropy: crand.Reader,
+	}
+	msg := &PrivateMessage{Origin: "E", Text: "trust me", Destination: n3.GetIdentifier(), HopLimit: 10}
+	require.NoError(t, stranger.encryptPrivate(msg))
+	sendRawPacket(t, conn, to, GossipPacket{Private: msg})
+
+	select {
+	case m := <- msgRecN3:
+		require.Equal(t, "E", m.Origin)
+		require.Equal(t, "trust me", m.Text)
+		require.True(t, m.Decrypted)
+		require.False(t, m.Authenticated)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Expected C to receive the private message")
+	}
+	require.NotContains(t, n3.(*Gossiper).GetKeys(), "E")
+
+	// a message that was tampered with
+	sendRawPacket(t, conn, to, GossipPacket{Private: &PrivateMessage{
+		Destination: n3.GetIdentifier(), HopLimit: 10,
+		EphemeralKey: n1.(*Gossiper).GetBoxKey(), Ciphertext: make([]byte, 64)}})
+
+	select {
+	case m := <- msgRecN3:
+		require.Fail(t, "Unexpected private message", m.Text)
+	case <- time.After(500*time.Millisecond):
+	}
+}
+
+func TestGossiper_TopologyFile_Line(t *testing.T) {
+	// arrange
+	nodes := createTopology(t, "testdata/line.dot")
+	a, e := nodes["A"], nodes["E"]
+
+	msgRecE := make(chan PrivateMessage, 10)
+	e.RegisterCallback(
+		func(origin string, message GossipPacket) {
+			if message.Private != nil {
+				msgRecE <- *message.Private
+			}
+		})
+
+	for _, n := range nodes {
+		startNodesBlocking(t, n)
+		defer n.Stop()
+	}
+
+	waitRoute(t, a, e.GetIdentifier(), 10*time.Second)
+
+	// act
+	err := a.AddPrivateMessage("end to end", e.GetIdentifier(), a.GetIdentifier(), 10)
+	require.NoError(t, err)
+
+	// assert
+	select {
+	case m := <- msgRecE:
+		require.Equal(t, "end to end", m.Text)
+		// B, C and D relayed it
+		require.Equal(t, 7, m.HopLimit)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Expected E to receive the private message")
+	}
+}
+
+func TestGossiper_Stress_ConcurrentClients(t *testing.T) {
+	// arrange
+	antiEntropy := 1
+	routeTimer := 1
+	numberOfNodes := 6
+	clientsPerNode := 8
+	msgPerClient := 5
+
+	nodes := make([]BaseGossiper, numberOfNodes)
+	addrs := make([]string, numberOfNodes)
+	for i := range nodes {
+		nodes[i], addrs[i] = createNode(t, string(byte('A')+byte(i)),
+			antiEntropy, routeTimer)
+	}
+
+	// full mesh
+	for i, n := range nodes {
+		for j, addr := range addrs {
+			if i != j {
+				addAddresses(t, n, addr)
+			}
+		}
+	}
+
+	received := make([]map[string]int, numberOfNodes)
+	var receivedLock sync.Mutex
+	for i, n := range nodes {
+		i := i
+		received[i] = make(map[string]int)
+		n.RegisterCallback(func(origin string, message GossipPacket) {
+			receivedLock.Lock()
+			defer receivedLock.Unlock()
+			received[i][origin]++
+		})
+	}
+
+	startNodesBlocking(t, nodes...)
+	defer func() {
+		for _, n := range nodes {
+			n.Stop()
+		}
+	}()
+
+	// act
+	wg := new(sync.WaitGroup)
+	for _, n := range nodes {
+		for c := 0; c < clientsPerNode; c++ {
+			wg.Add(1)
+			go func(n BaseGossiper, c int) {
+				defer wg.Done()
+				for m := 0; m < msgPerClient; m++ {
+					n.AddMessage(fmt.Sprintf("client %v message %v", c, m))
+
+					// readers racing with the protocol
+					n.GetNodes()
+					n.GetRoutingTable()
+					n.GetDirectNodes()
+					require.NoError(t, n.SetIdentifier(n.GetIdentifier()))
+					require.NoError(t, n.AddAddresses(addrs...))
+				}
+			}(n, c)
+		}
+	}
+	wg.Wait()
+
+	// assert
+	expected := clientsPerNode * msgPerClient
+	deadline := time.After(15*time.Second)
+	for {
+		done := true
+
+		receivedLock.Lock()
+		for i := range nodes {
+			for j, n := range nodes {
+				if i != j && received[i][n.GetIdentifier()] < expected {
+					done = false
+				}
+			}
+		}
+		receivedLock.Unlock()
+
+		if done {
+			break
+		}
+
+		select {
+		case <- deadline:
+			receivedLock.Lock()
+			defer receivedLock.Unlock()
+			require.Fail(t, "Not every message was received", "%v", received)
+		case <- time.After(100*time.Millisecond):
+		}
+	}
+
+	receivedLock.Lock()
+	defer receivedLock.Unlock()
+	for i := range nodes {
+		for j, n := range nodes {
+			if i != j {
+				require.Equal(t, expected, received[i][n.GetIdentifier()])
+			}
+		}
+	}
+}
+
+func TestGossiper_Memory_LossyLine(t *testing.T) {
+	// arrange
+	antiEntropy := 1
+	routeTimer := 0
+	numberOfNodes := 5
+	network := transport.NewMemoryNetwork(1)
+	network.SetDropRate(0.3)
+	network.SetLatency(0, 5*time.Millisecond)
+
+	nodes := make([]BaseGossiper, numberOfNodes)
+	addrs := make([]string, numberOfNodes)
+	for i := range nodes {
+		nodes[i], addrs[i] = createMemoryNode(t, network,
+			string(byte('A')+byte(i)), antiEntropy, routeTimer,
+			WithAckTimeout(100*time.Millisecond))
+	}
+
+	// A <-> B <-> C <-> D <-> E
+	for i := 1; i < numberOfNodes; i++ {
+		addAddresses(t, nodes[i-1], addrs[i])
+		addAddresses(t, nodes[i], addrs[i-1])
+	}
+
+	received := make(chan string, numberOfNodes*numberOfNodes)
+	for _, n := range nodes {
+		n.RegisterCallback(func(origin string, message GossipPacket) {
+			received <- origin
+		})
+	}
+
+	startNodesBlocking(t, nodes...)
+	defer func() {
+		for _, n := range nodes {
+			n.Stop()
+		}
+	}()
+
+	// act
+	for _, n := range nodes {
+		n.AddMessage("Can you hear me?")
+	}
+
+	// assert
+	expected := numberOfNodes * (numberOfNodes - 1)
+	for i := 0; i < expected; i++ {
+		select {
+		case <- received:
+		case <- time.After(10*time.Second):
+			require.Fail(t, "Timed out on reception", "got %v of %v", i, expected)
+		}
+	}
+}
+
+func TestGossiper_Memory_Partition(t *testing.T) {
+	// arrange
+	antiEntropy := 1
+	routeTimer := 0
+	network := transport.NewMemoryNetwork(1)
+	n1, addr1 := createMemoryNode(t, network, "A", antiEntropy, routeTimer)
+	n2, addr2 := createMemoryNode(t, network, "B", antiEntropy, routeTimer)
+	addAddresses(t, n1, addr2)
+	addAddresses(t, n2, addr1)
+
+	msgRecN2 := streamIncomingGossips(n2)
+
+	startNodesBlocking(t, n1, n2)
+	defer n1.Stop()
+	defer n2.Stop()
+
+	// act
+	network.Partition([]string{addr1}, []string{addr2})
+	n1.AddMessage("Hello?")
+
+	// assert
+	select {
+	case <- msgRecN2:
+		require.Fail(t, "B received a message across the partition")
+	case <- time.After(500*time.Millisecond):
+	}
+
+	network.Heal()
+
+	select {
+	case m := <- msgRecN2:
+		require.Equal(t, "Hello?", m.Rumor.Text)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Expected anti-entropy to deliver the message")
+	}
+}
+
+func TestGossiper_Memory_NetworkIsolation(t *testing.T) {
+	// arrange
+	antiEntropy := 1
+	routeTimer := 0
+	network := transport.NewMemoryNetwork(1)
+
+	// A and B share the network, C has
+	// another key and D has none
+	n1, addr1 := createMemoryNode(t, network, "A", antiEntropy, routeTimer,
+		WithNetwork("lab", []byte("secret")), WithMaxDatagramSize(500))
+	n2, addr2 := createMemoryNode(t, network, "B", antiEntropy, routeTimer,
+		WithNetwork("lab", []byte("secret")))
+	n3, addr3 := createMemoryNode(t, network, "C", antiEntropy, routeTimer,
+		WithNetwork("lab", []byte("other")))
+	n4, addr4 := createMemoryNode(t, network, "D", antiEntropy, routeTimer)
+
+	addAddresses(t, n1, addr2, addr3, addr4)
+	addAddresses(t, n2, addr1)
+	addAddresses(t, n3, addr1)
+	addAddresses(t, n4, addr1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watched := make(chan string, 100)
+	for _, n := range []BaseGossiper{n1, n3, n4} {
+		name := n.GetIdentifier()
+		go func(ch <-chan CallbackPacket) {
+			for p := range ch {
+				watched <- fmt.Sprintf("%v from %v", name, p.Addr)
+			}
+		}(n.Watch(ctx, true))
+	}
+
+	msgRecN2 := streamIncomingGossips(n2)
+
+	startNodesBlocking(t, n1, n2, n3, n4)
+	defer n1.Stop()
+	defer n2.Stop()
+	defer n3.Stop()
+	defer n4.Stop()
+
+	// act
+	text := strings.Repeat("sealed ", 300)
+	n1.AddMessage(text)
+
+	// assert
+	select {
+	case m := <- msgRecN2:
+		require.Equal(t, text, m.Rumor.Text)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "Expected B to receive the rumor")
+	}
+
+	timeout := time.After(2*time.Second)
+	for {
+		select {
+		case w := <- watched:
+			require.Equal(t, fmt.Sprintf("%v from %v", n1.GetIdentifier(), addr2), w)
+		case <- timeout:
+			return
+		}
+	}
+}
+
+func TestGossiper_Memory_Restart(t *testing.T) {
+	// arrange
+	antiEntropy := 1
+	routeTimer := 0
+	network := transport.NewMemoryNetwork(1)
+
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "A.log")
+
+	n1, addr1 := createMemoryNode(t, network, "A", antiEntropy, routeTimer,
+		WithStore(path, 1))
+	n2, addr2 := createMemoryNode(t, network, "B", antiEntropy, routeTimer)
+	addAddresses(t, n1, addr2)
+	addAddresses(t, n2, addr1)
+
+	msgRecN2 := streamIncomingGossips(n2)
+
+	startNodesBlocking(t, n1, n2)
+	defer n2.Stop()
+
+	receive := func(text string) {
+		select {
+		case m := <- msgRecN2:
+			require.Equal(t, text, m.Rumor.Text)
+		case <- time.After(3*time.Second):
+			require.Fail(t, "Timed out on reception", text)
+		}
+	}
+
+	n1.AddMessage("before")
+	receive("before")
+	n1.AddMessage("crash")
+	receive("crash")
+	n1.Stop()
+
+	// act
+	tr, err := network.Listen(addr1)
+	require.NoError(t, err)
+	n1, err = factory.New(addr1, n1.GetIdentifier(), antiEntropy, routeTimer,
+		WithStore(path, 1), WithTransport(tr))
+	require.NoError(t, err)
+
+	// assert
+	messages := n1.GetMessages()
+	require.Len(t, messages, 2)
+	require.Equal(t, "crash", messages[1].Text)
+	require.Equal(t, []string{addr2}, n1.GetNodes())
+
+	startNodesBlocking(t, n1)
+	defer n1.Stop()
+
+	// B takes the next rumor for a new one,
+	// signed by the key it knows
+	id := n1.AddMessage("after")
+	require.Equal(t, uint32(3), id)
+	receive("after")
+}
+
+func TestGossiper_Store_ForgetPeer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "A.log")
+
+	n, err := NewGossiper("127.0.0.1:5000", "A", 0, 0,
+		WithStore(path, 1), WithOutput(ioutil.Discard))
+	require.NoError(t, err)
+	g := n.(*Gossiper)
+
+	source := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5001}
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5002}
+
+	g.mux.Lock()
+	require.NoError(t, (&PeerExchangePacket{Peers: []string{peer.String()}}).Exec(g, source))
+	g.forgetPeer(peer.String())
+	g.mux.Unlock()
+	n.Stop()
+
+	// act
+	n, err = NewGossiper("127.0.0.1:5000", "A", 0, 0,
+		WithStore(path, 1), WithOutput(ioutil.Discard))
+	require.NoError(t, err)
+	defer n.Stop()
+
+	// assert
+	require.Equal(t, []string{source.String()}, n.GetNodes())
+}
+
+func TestGossiper_Store_LearntPeer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "A.log")
+
+	n, err := NewGossiper("127.0.0.1:5000", "A", 0, 0,
+		WithStore(path, 1), WithOutput(ioutil.Discard))
+	require.NoError(t, err)
+	g := n.(*Gossiper)
+
+	source := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5001}
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5002}
+
+	g.mux.Lock()
+	require.NoError(t, (&PeerExchangePacket{Peers: []string{peer.String()}}).Exec(g, source))
+	g.compactStore()
+	g.mux.Unlock()
+	n.Stop()
+
+	// act
+	n, err = NewGossiper("127.0.0.1:5000", "A", 0, 0,
+		WithStore(path, 1), WithOutput(ioutil.Discard))
+	require.NoError(t, err)
+	defer n.Stop()
+	g = n.(*Gossiper)
+
+	// assert: the peer is still bounded
+	// and forgotten once dead
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	require.Equal(t, source.String(), g.learntFrom[peer.String()])
+	require.Equal(t, 1, g.injected[source.String()])
+
+	g.forgetPeer(peer.String())
+	require.False(t, g.isPeer(peer))
+}
+
+func TestGossiper_Memory_FailureDetector(t *testing.T) {
+	// arrange
+	antiEntropy := 0
+	routeTimer := 0
+	network := transport.NewMemoryNetwork(1)
+
+	// B only answers the probes of A
+	n1, _ := createMemoryNode(t, network, "A", antiEntropy, routeTimer,
+		WithFailureDetector(50*time.Millisecond))
+	n2, addr2 := createMemoryNode(t, network, "B", antiEntropy, routeTimer)
+	n3, addr3 := createMemoryNode(t, network, "C", antiEntropy, routeTimer)
+	addAddresses(t, n1, addr2, addr3)
+
+	startNodesBlocking(t, n1, n2, n3)
+	defer n1.Stop()
+	defer n2.Stop()
+
+	states := n1.(*Gossiper).GetPeerStates
+	waitState := func(addr string, state PeerState) {
+		deadline := time.After(3*time.Second)
+		for states()[addr] != state {
+			select {
+			case <- deadline:
+				require.Fail(t, "Timed out waiting for the peer state", "%v %v", addr, state)
+			case <- time.After(10*time.Millisecond):
+			}
+		}
+	}
+
+	// act
+	n3.Stop()
+
+	// assert
+	waitState(addr3, PeerDead)
+	require.Equal(t, PeerAlive, states()[addr2])
+	require.Equal(t, []string{addr2}, n1.GetNodes())
+
+	// only B is gossiped with
+	g := n1.(*Gossiper)
+	for i := 0; i < 20; i++ {
+		g.mux.Lock()
+		peer := g.randomPeer()
+		g.mux.Unlock()
+		require.Equal(t, addr2, peer.String())
+	}
+
+	// C comes back on the same address
+	tr, err := network.Listen(addr3)
+	require.NoError(t, err)
+	n3, err = factory.New(addr3, n3.GetIdentifier(), antiEntropy, routeTimer,
+		WithTransport(tr))
+	require.NoError(t, err)
+	startNodesBlocking(t, n3)
+	defer n3.Stop()
+
+	waitState(addr3, PeerAlive)
+	require.ElementsMatch(t, []string{addr2, addr3}, n1.GetNodes())
+}
+
+func TestGossiper_Memory_CatchUpBatches(t *testing.T) {
+	// arrange
+	antiEntropy := 1
+	routeTimer := 0
+	numberOfMessages := 200
+	network := transport.NewMemoryNetwork(1)
+
+	n1, addr1 := createMemoryNode(t, network, "A", antiEntropy, routeTimer)
+	n2, _ := createMemoryNode(t, network, "B", antiEntropy, routeTimer)
+
+	// B joins once A is far ahead
+	for i := 0; i < numberOfMessages; i++ {
+		n1.AddMessage(fmt.Sprintf("message %d", i))
+	}
+	addAddresses(t, n2, addr1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := n2.Watch(ctx, true)
+
+	// act
+	startNodesBlocking(t, n1, n2)
+	defer n1.Stop()
+	defer n2.Stop()
+
+	// assert
+	packets := 0
+	rumors := 0
+	deadline := time.After(5*time.Second)
+	for rumors < numberOfMessages {
+		select {
+		case p := <- in:
+			if p.Msg.Rumor != nil {
+				rumors++
+				packets++
+			}
+			if p.Msg.Batch != nil {
+				rumors += len(p.Msg.Batch.Rumors)
+				packets++
+			}
+		case <- deadline:
+			require.Fail(t, "Timed out waiting for the rumors", "got %d", rumors)
+		}
+	}
+
+	require.Equal(t, uint32(numberOfMessages+1), n2.(*Gossiper).GetStatus()[0].NextID)
+	require.Less(t, packets, numberOfMessages/5)
+}
+
+func TestGossiper_Compression(t *testing.T) {
+	n, err := NewGossiper("127.0.0.1:0", "A", 0, 0, WithCompression(100))
+	require.NoError(t, err)
+	g := n.(*Gossiper)
+
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	packet := []byte(strings.Repeat("hello ", 100))
+
+	// the peer does not read
+	// compressed packets yet
+	require.Equal(t, packet, g.compress(packet, to))
+
+	g.peerWire[to.String()] = compressVersion
+	c := g.compress(packet, to)
+	require.Equal(t, compressMagic, c[0])
+	require.Less(t, len(c), len(packet)/10)
+
+	d, err := decompress(c, len(packet))
+	require.NoError(t, err)
+	require.Equal(t, packet, d)
+
+	// small packets are sent as is
+	require.Equal(t, packet[:100], g.compress(packet[:100], to))
+
+	// a bomb is not expanded
+	// beyond the maximum size
+	bomb := g.compress(make([]byte, 10<<20), to)
+	require.Less(t, len(bomb), 100<<10)
+
+	_, err = decompress(bomb, defaultMaxPacketSize)
+	require.Error(t, err)
+}
+
+func TestGossiper_Memory_CompressedRumor(t *testing.T) {
+	// arrange
+	antiEntropy := 1
+	routeTimer := 0
+	network := transport.NewMemoryNetwork(1)
+
+	n1, addr1 := createMemoryNode(t, network, "A", antiEntropy, routeTimer)
+	n2, addr2 := createMemoryNode(t, network, "B", antiEntropy, routeTimer)
+	addAddresses(t, n1, addr2)
+	addAddresses(t, n2, addr1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := n2.Watch(ctx, true)
+
+	startNodesBlocking(t, n1, n2)
+	defer n1.Stop()
+	defer n2.Stop()
+
+	// the nodes learn that they
+	// read compressed packets
+	n1.AddMessage("hello")
+	waitRumorMsg(t, ctx, in)
+
+	// act
+	text := strings.Repeat("a long text ", 10000)
+	n1.AddMessage(text)
+
+	// assert
+	deadline := time.After(3*time.Second)
+	for {
+		select {
+		case p := <- in:
+			if p.Msg.Rumor != nil && p.Msg.Rumor.ID == 2 {
+				require.Equal(t, text, p.Msg.Rumor.Text)
+
+				g := n1.(*Gossiper)
+				g.mux.Lock()
+				defer g.mux.Unlock()
+				require.Equal(t, compressVersion, g.peerWire[addr2])
+				return
+			}
+		case <- deadline:
+			require.Fail(t, "Timed out waiting for the rumor")
+		}
+	}
+}
+
+func TestGossiper_RateLimits(t *testing.T) {
+	c := clock.NewVirtual(time.Unix(0, 0))
+	n, err := NewGossiper("127.0.0.1:0", "A", 0, 0, WithClock(c),
+		WithRateLimits(10, 5, 1, 2))
+	require.NoError(t, err)
+	g := n.(*Gossiper)
+
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5001}
+
+	// a burst of 5 datagrams, then
+	// one every 100 milliseconds
+	for i := 0; i < 5; i++ {
+		require.True(t, g.admit(peer))
+	}
+	require.False(t, g.admit(peer))
+	require.True(t, g.admit(other))
+
+	c.Advance(100*time.Millisecond)
+	require.True(t, g.admit(peer))
+	require.False(t, g.admit(peer))
+
+	// a burst of 2 new rumors,
+	// then one every second
+	require.True(t, g.admitOrigin("B"))
+	require.True(t, g.admitOrigin("B"))
+	require.False(t, g.admitOrigin("B"))
+	require.True(t, g.admitOrigin("C"))
+
+	c.Advance(time.Second)
+	require.True(t, g.admitOrigin("B"))
+
+	stats := g.GetLimitStats()
+	require.Equal(t, 2, stats.RateLimited)
+	require.Equal(t, 1, stats.OriginLimited)
+
+	// banning the IP bans
+	// every port until it
+	// expires
+	require.NoError(t, g.Ban("127.0.0.1", time.Minute))
+	require.False(t, g.admit(other))
+	require.Contains(t, g.GetBans(), "127.0.0.1")
+
+	c.Advance(time.Minute)
+	require.True(t, g.admit(other))
+	require.Empty(t, g.GetBans())
+
+	require.NoError(t, g.Ban(other.String(), 0))
+	require.False(t, g.admit(other))
+	g.Unban(other.String())
+	require.True(t, g.admit(other))
+
+	require.Error(t, g.Ban("not an address", 0))
+}
+
+func TestGossiper_Bans(t *testing.T) {
+	c := clock.NewVirtual(time.Unix(0, 0))
+	n, err := NewGossiper("127.0.0.1:0", "A", 0, 0, WithClock(c),
+		WithBans(3, time.Minute))
+	require.NoError(t, err)
+	g := n.(*Gossiper)
+
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+
+	// act: a burst of invalid packets
+	for i := 0; i < 4; i++ {
+		g.Process([]byte("not a packet"), peer)
+	}
+
+	// assert
+	require.Contains(t, g.GetBans(), peer.String())
+
+	status, err := json.Marshal(GossipPacket{Status: &StatusPacket{}})
+	require.NoError(t, err)
+	g.Process(status, peer)
+
+	stats := g.GetLimitStats()
+	require.Equal(t, 4, stats.Invalid)
+	require.Equal(t, 1, stats.Bans)
+	require.Equal(t, 1, stats.Banned)
+
+	// the ban expires
+	c.Advance(time.Minute)
+	require.Empty(t, g.GetBans())
+}
+
+func TestGossiper_Bans_KeyChange(t *testing.T) {
+	network := transport.NewMemoryNetwork(1)
+	tr, err := network.Listen("127.0.0.1:5001")
+	require.NoError(t, err)
+
+	n, err := NewGossiper("127.0.0.1:5001", "A", 0, 0, WithBans(3, time.Minute),
+		WithTransport(tr), WithOutput(ioutil.Discard))
+	require.NoError(t, err)
+	g := n.(*Gossiper)
+
+	relay := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	rumor := func(key ed25519.PrivateKey, id uint32) []byte {
+		b, err := json.Marshal(GossipPacket{Rumor: signRumor(key,
+			&RumorMessage{Origin: "B", ID: id, Text: "hello"})})
+		require.NoError(t, err)
+		return b
+	}
+
+	g.Process(rumor(newKey(t), 1), relay)
+
+	// act: B restarted with a new key,
+	// the relay forwards its rumors
+	restarted := newKey(t)
+	for i := uint32(2); i < 10; i++ {
+		g.Process(rumor(restarted, i), relay)
+	}
+
+	// assert
+	require.Empty(t, g.GetBans())
+	require.Equal(t, 0, g.GetLimitStats().Invalid)
+	require.Len(t, g.GetMessages(), 1)
+
+	// a bad signature is a strike
+	forged := signRumor(restarted, &RumorMessage{Origin: "B", ID: 2, Text: "hello"})
+	forged.Text = "forged"
+	b, err := json.Marshal(GossipPacket{Rumor: forged})
+	require.NoError(t, err)
+	g.Process(b, relay)
+	require.Equal(t, 1, g.GetLimitStats().Invalid)
+}
+
+func TestGossiper_Bans_Unsigned(t *testing.T) {
+	network := transport.NewMemoryNetwork(1)
+	tr, err := network.Listen("127.0.0.1:5001")
+	require.NoError(t, err)
+
+	n, err := NewGossiper("127.0.0.1:5001", "A", 0, 0,
+		WithTransport(tr), WithOutput(ioutil.Discard))
+	require.NoError(t, err)
+	g := n.(*Gossiper)
+
+	// act: a peer that does not sign
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	for i := uint32(1); i <= defaultBanStrikes+1; i++ {
+		b, err := json.Marshal(GossipPacket{Rumor: &RumorMessage{Origin: "B", ID: i, Text: "hello"}})
+		require.NoError(t, err)
+		g.Process(b, peer)
+	}
+
+	// assert
+	require.Empty(t, g.GetBans())
+	require.Equal(t, 0, g.GetLimitStats().Invalid)
+	require.Empty(t, g.GetMessages())
+	require.True(t, g.admit(peer))
+}
+
+// gatedTransport holds the datagrams sent until the gate is closed
+type gatedTransport struct {
+	transport.Transport
+	gate chan struct{}
+}
+
+func (g gatedTransport) Send(b []byte, to *net.UDPAddr) error {
+	<- g.gate
+	return g.Transport.Send(b, to)
+}
+
+func TestGossiper_Memory_SendQueue(t *testing.T) {
+	// arrange
+	network := transport.NewMemoryNetwork(1)
+
+	memoryPort++
+	addr1 := fmt.Sprintf("127.0.0.1:%v", memoryPort)
+	tr, err := network.Listen(addr1)
+	require.NoError(t, err)
+
+	gate := make(chan struct{})
+	n1, err := factory.New(addr1, "A---"+t.Name(), 0, 0,
+		WithTransport(gatedTransport{Transport: tr, gate: gate}),
+		WithSendQueue(2, QueueDrop))
+	require.NoError(t, err)
+
+	n2, addr2 := createMemoryNode(t, network, "B", 0, 0)
+	addAddresses(t, n1, addr2)
+
+	startNodesBlocking(t, n2)
+	defer n2.Stop()
+
+	// act: the peer does not read
+	// the packets fast enough
+	for i := 0; i < 10; i++ {
+		n1.AddSimpleMessage(fmt.Sprintf("hello %d", i))
+	}
+
+	// assert
+	stats := n1.(*Gossiper).GetQueueStats()[addr2]
+	require.Equal(t, 2, stats.MaxLength)
+	require.LessOrEqual(t, stats.Length, 2)
+	require.GreaterOrEqual(t, stats.Dropped, 7)
+
+	close(gate)
+
+	deadline := time.After(3*time.Second)
+	for {
+		stats = n1.(*Gossiper).GetQueueStats()[addr2]
+		if stats.Length == 0 && stats.Sent+stats.Dropped == 10 {
+			break
+		}
+
+		select {
+		case <- deadline:
+			require.Fail(t, "Timed out waiting for the queue", "%+v", stats)
+		case <- time.After(10*time.Millisecond):
+		}
+	}
+
+	n1.Stop()
+}
+
+func TestGossiper_Memory_SendQueueBlock(t *testing.T) {
+	// arrange
+	network := transport.NewMemoryNetwork(1)
+
+	memoryPort++
+	addr1 := fmt.Sprintf("127.0.0.1:%v", memoryPort)
+	tr, err := network.Listen(addr1)
+	require.NoError(t, err)
+
+	gate := make(chan struct{})
+	n1, err := factory.New(addr1, "A---"+t.Name(), 0, 0,
+		WithTransport(gatedTransport{Transport: tr, gate: gate}),
+		WithSendQueue(2, QueueBlock))
+	require.NoError(t, err)
+
+	n2, addr2 := createMemoryNode(t, network, "B", 0, 0)
+	addAddresses(t, n1, addr2)
+
+	startNodesBlocking(t, n2)
+	defer n2.Stop()
+
+	// act: the peer is stalled
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			n1.AddSimpleMessage(fmt.Sprintf("hello %d", i))
+		}
+
+		// the API goes on
+		n1.GetNodes()
+		require.NoError(t, n1.AddAddresses("127.0.0.1:1"))
+	}()
+
+	// assert
+	select {
+	case <- done:
+	case <- time.After(3*time.Second):
+		require.Fail(t, "The gossiper waits for the stalled peer")
+	}
+
+	stats := n1.(*Gossiper).GetQueueStats()[addr2]
+	require.Equal(t, 2, stats.MaxLength)
+	require.Equal(t, 0, stats.Dropped)
+	// the worker may hold one
+	// datagram, waiting to send it
+	require.GreaterOrEqual(t, stats.Blocked, 7)
+	require.LessOrEqual(t, stats.Blocked, 8)
+
+	close(gate)
+
+	deadline := time.After(3*time.Second)
+	for {
+		stats = n1.(*Gossiper).GetQueueStats()[addr2]
+		if stats.Length == 0 && stats.Blocked == 0 && stats.Sent == 10 {
+			break
+		}
+
+		select {
+		case <- deadline:
+			require.Fail(t, "Timed out waiting for the queue", "%+v", stats)
+		case <- time.After(10*time.Millisecond):
+		}
+	}
+
+	n1.Stop()
+}
+
+func TestGossiper_Memory_SendQueueBlockTimers(t *testing.T) {
+	// arrange
+	c := clock.NewVirtual(time.Unix(0, 0))
+	network := transport.NewMemoryNetwork(1)
+
+	memoryPort++
+	addr1 := fmt.Sprintf("127.0.0.1:%v", memoryPort)
+	tr, err := network.Listen(addr1)
+	require.NoError(t, err)
+
+	gate := make(chan struct{})
+	n1, err := factory.New(addr1, "A---"+t.Name(), 1, 0, WithClock(c),
+		WithTransport(gatedTransport{Transport: tr, gate: gate}),
+		WithSendQueue(2, QueueBlock))
+	require.NoError(t, err)
+
+	// B is stalled, C is not
+	n2, addr2 := createMemoryNode(t, network, "B", 0, 0)
+	n3, addr3 := createMemoryNode(t, network, "C", 0, 0)
+	addAddresses(t, n1, addr2)
+	addAddresses(t, n3, addr1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := n1.Watch(ctx, true)
+
+	startNodesBlocking(t, n1, n2, n3)
+	defer n2.Stop()
+	defer n3.Stop()
+
+	// act: a status for B every second
+	for i := 0; i < 2*maxBlocked; i++ {
+		c.Advance(time.Second)
+	}
+
+	// assert
+	stats := n1.(*Gossiper).GetQueueStats()[addr2]
+	require.LessOrEqual(t, stats.Blocked, maxBlocked)
+	require.Greater(t, stats.Dropped, 0)
+
+	// the datagrams of C are handled
+	n3.AddSimpleMessage("hello")
+
+	select {
+	case p := <- in:
+		require.Equal(t, addr3, p.Addr)
+	case <- time.After(3*time.Second):
+		require.Fail(t, "The gossiper waits for the stalled peer")
+	}
+
+	close(gate)
+	n1.Stop()
+}
+
+func TestGossiper_Memory_PeerExchange(t *testing.T) {
+	// arrange
+	antiEntropy := 1
+	routeTimer := 0
+	numberOfNodes := 6
+	network := transport.NewMemoryNetwork(1)
+
+	nodes := make([]BaseGossiper, numberOfNodes)
+	addrs := make([]string, numberOfNodes)
+	for i := range nodes {
+		nodes[i], addrs[i] = createMemoryNode(t, network,
+			string(byte('A')+byte(i)), antiEntropy, routeTimer,
+			WithPeerExchange(20*time.Millisecond, defaultMaxPeers))
+	}
+
+	// every node only knows the next one
+	for i := 1; i < numberOfNodes; i++ {
+		addAddresses(t, nodes[i-1], addrs[i])
+	}
+
+	startNodesBlocking(t, nodes...)
+	defer func() {
+		for _, n := range nodes {
+			n.Stop()
+		}
+	}()
+
+	// assert
+	deadline := time.After(5*time.Second)
+	for _, n := range nodes {
+		for len(n.GetNodes()) < numberOfNodes-1 {
+			select {
+			case <- deadline:
+				require.Fail(t, "Timed out waiting for the peers", "%v knows %v",
+					n.GetIdentifier(), n.GetNodes())
+			case <- time.After(10*time.Millisecond):
+			}
+		}
+	}
+}
+
+func TestGossiper_Memory_PeerExchangeLimits(t *testing.T) {
+	// arrange
+	network := transport.NewMemoryNetwork(1)
+	n1, addr1 := createMemoryNode(t, network, "A", 0, 0,
+		WithPeerExchange(0, 20))
+
+	startNodesBlocking(t, n1)
+	defer n1.Stop()
+
+	to, err := net.ResolveUDPAddr("udp", addr1)
+	require.NoError(t, err)
+
+	port := 20000
+	inject := func(source transport.Transport) {
+		peers := make([]string, 0)
+		for i := 0; i < peerExchangeSample; i++ {
+			port++
+			peers = append(peers, fmt.Sprintf("127.0.0.1:%d", port))
+		}
+
+		b, err := json.Marshal(GossipPacket{PeerExchange: &PeerExchangePacket{Peers: peers}})
+		require.NoError(t, err)
+		require.NoError(t, source.Send(b, to))
+		time.Sleep(50*time.Millisecond)
+	}
+
+	s1, err := network.Listen("127.0.0.1:19998")
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := network.Listen("127.0.0.1:19999")
+	require.NoError(t, err)
+	defer s2.Close()
+
+	// act
+	for i := 0; i < 3; i++ {
+		inject(s1)
+	}
+
+	// assert
+	// S1 and the peers it can inject
+	require.Len(t, n1.GetNodes(), 1+maxPeersPerSource)
+
+	inject(s2)
+
+	// S2 and the peers left in the table
+	require.Len(t, n1.GetNodes(), 1+maxPeersPerSource+1+20-maxPeersPerSource)
+}
+
+func TestGossiper_ForgetPeer(t *testing.T) {
+	c := clock.NewVirtual(time.Unix(0, 0))
+	network := transport.NewMemoryNetwork(1)
+	tr, err := network.Listen("127.0.0.1:5000")
+	require.NoError(t, err)
+
+	n, err := NewGossiper("127.0.0.1:5000", "A", 0, 0, WithClock(c),
+		WithTransport(tr), WithOutput(ioutil.Discard))
+	require.NoError(t, err)
+	g := n.(*Gossiper)
+
+	source := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5001}
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5002}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	// the peer learnt from the source waits
+	// for a rumor and gets a catch up
+	require.NoError(t, (&PeerExchangePacket{Peers: []string{peer.String()}}).Exec(g, source))
+	rumor := g.newRumor("hello")
+	g.monger(rumor, peer)
+	g.catchUp(peer, []*RumorMessage{rumor})
+
+	require.Contains(t, g.mongering, peer.String())
+	require.Contains(t, g.catchUps, peer.String())
+
+	// act
+	g.forgetPeer(peer.String())
+
+	// assert
+	require.False(t, g.isPeer(peer))
+	require.NotContains(t, g.mongering, peer.String())
+	require.NotContains(t, g.catchUps, peer.String())
+}
+
+func TestGossiper_WireVersionGates(t *testing.T) {
+	network := transport.NewMemoryNetwork(1)
+	tr, err := network.Listen("127.0.0.1:5000")
+	require.NoError(t, err)
+
+	n, err := NewGossiper("127.0.0.1:5000", "A", 0, 0,
+		WithTransport(tr), WithOutput(ioutil.Discard))
+	require.NoError(t, err)
+	g := n.(*Gossiper)
+
+	old := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5001}
+	recent := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5002}
+	require.NoError(t, g.AddAddresses(old.String(), recent.String()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := g.Watch(ctx, false)
+
+	// sent returns the packets sent to each peer by f, the first peer
+	// reads the first version of the binary format only
+	sent := func(f func()) map[string][]GossipPacket {
+		g.mux.Lock()
+		g.peerWire[old.String()] = 1
+		g.peerWire[recent.String()] = wireVersion
+		f()
+		g.mux.Unlock()
+
+		packets := make(map[string][]GossipPacket)
+		for {
+			select {
+			case p := <- out:
+				packets[p.Addr] = append(packets[p.Addr], p.Msg)
+			case <- time.After(100*time.Millisecond):
+				return packets
+			}
+		}
+	}
+
+	// the peer exchanges
+	packets := sent(func() {
+		g.sendPeerExchange(old)
+		g.sendPeerExchange(recent)
+	})
+	require.NotContains(t, packets, old.String())
+	require.Len(t, packets[recent.String()], 1)
+	require.NotNil(t, packets[recent.String()][0].PeerExchange)
+
+	// the digests
+	packets = sent(func() {
+		g.antiEntropyMode = AntiEntropyDigest
+		g.sendAntiEntropy(old)
+		g.sendAntiEntropy(recent)
+	})
+	require.Len(t, packets[old.String()], 1)
+	require.NotNil(t, packets[old.String()][0].Status)
+	require.Len(t, packets[recent.String()], 1)
+	require.NotNil(t, packets[recent.String()][0].Digest)
+
+	// a peer we did not hear from, or that
+	// sends JSON, reads nothing newer
+	packets = sent(func() {
+		delete(g.peerWire, old.String())
+		g.sendPeerExchange(old)
+		g.sendAntiEntropy(old)
+	})
+	require.Len(t, packets[old.String()], 1)
+	require.NotNil(t, packets[old.String()][0].Status)
+
+	// the lazy peers of the tree
+	packets = sent(func() {
+		g.dissemination = DisseminationPlumtree
+		rumor := g.newRumor("hello")
+		g.setLazy(rumor.Origin, old, true)
+		g.setLazy(rumor.Origin, recent, true)
+		g.disseminate(rumor)
+	})
+	require.Len(t, packets[old.String()], 1)
+	require.NotNil(t, packets[old.String()][0].Rumor)
+	require.Len(t, packets[recent.String()], 1)
+	require.NotNil(t, packets[recent.String()][0].IHave)
+
+	// the duplicates
+	packets = sent(func() {
+		rumor := g.messages[g.identifier][0]
+		g.setLazy(rumor.Origin, old, false)
+		g.setLazy(rumor.Origin, recent, false)
+		g.receivePlumtree(rumor, old)
+		g.receivePlumtree(rumor, recent)
+	})
+	require.NotContains(t, packets, old.String())
+	require.Len(t, packets[recent.String()], 1)
+	require.NotNil(t, packets[recent.String()][0].Prune)
+}
+
+func TestGossiper_Memory_PlumtreeJSONPeer(t *testing.T) {
+	antiEntropy := 1000
+	routeTimer := 0
+	numberOfMessages := 5
+	network := transport.NewMemoryNetwork(1)
+
+	// C speaks JSON only, like the nodes
+	// that do not read the trees
+	n1, addr1 := createMemoryNode(t, network, "A", antiEntropy, routeTimer,
+		WithDissemination(DisseminationPlumtree))
+	n2, addr2 := createMemoryNode(t, network, "B", antiEntropy, routeTimer,
+		WithDissemination(DisseminationPlumtree))
+	n3, addr3 := createMemoryNode(t, network, "C", antiEntropy, routeTimer,
+		WithWireFormat(WireJSON))
+	addAddresses(t, n1, addr2, addr3)
+	addAddresses(t, n2, addr1, addr3)
+	addAddresses(t, n3, addr1, addr2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := n3.Watch(ctx, true)
+
+	startNodesBlocking(t, n1, n2, n3)
+	defer n1.Stop()
+	defer n2.Stop()
+	defer n3.Stop()
+
+	// act
+	for i := 0; i < numberOfMessages; i++ {
+		n1.AddMessage(fmt.Sprintf("message %d", i))
+		time.Sleep(50*time.Millisecond)
+	}
+
+	// assert: C gets every rumor itself
+	rumors := make(map[uint32]bool)
+	deadline := time.After(3*time.Second)
+	for len(rumors) < numberOfMessages {
+		select {
+		case p := <- in:
+			require.Nil(t, p.Msg.IHave, "IHAVE sent to a JSON peer")
+			require.Nil(t, p.Msg.Graft, "GRAFT sent to a JSON peer")
+			require.Nil(t, p.Msg.Prune, "PRUNE sent to a JSON peer")
+			if p.Msg.Rumor != nil && p.Msg.Rumor.Origin == n1.GetIdentifier() {
+				rumors[p.Msg.Rumor.ID] = true
+			}
+		case <- deadline:
+			require.Fail(t, "Timed out waiting for the rumors", "got %d", len(rumors))
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		return len(n2.GetMessages()) == numberOfMessages
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+// -----------------------------------------------------------------------------
+// Utility functions
+
+func createNode(t *testing.T, name string, antiEntropy int,
+	routeTimer int, opts ...Option) (BaseGossiper, string) {
+
+	addr := fmt.Sprintf("127.0.0.1:%v", getRandomPort())
+	fullName := fmt.Sprintf("%v---%v", name, t.Name())
+	node, err := factory.New(addr, fullName, antiEntropy, routeTimer, opts...)
+	require.NoError(t, err)
+	require.Len(t, node.GetNodes(), 0)
+	require.Equal(t, fullName, node.GetIdentifier())
+
+	return node, addr
+}
+
+// createMemoryNode creates a node whose transport is attached to the given
+// memory network. No port is bound.
+func createMemoryNode(t *testing.T, network *transport.MemoryNetwork,
+	name string, antiEntropy int, routeTimer int,
+	opts ...Option) (BaseGossiper, string) {
+
+	memoryPort++
+	addr := fmt.Sprintf("127.0.0.1:%v", memoryPort)
+	tr, err := network.Listen(addr)
+	require.NoError(t, err)
+
+	fullName := fmt.Sprintf("%v---%v", name, t.Name())
+	opts = append(opts, WithTransport(tr))
+	node, err := factory.New(addr, fullName, antiEntropy, routeTimer, opts...)
+	require.NoError(t, err)
+
+	return node, addr
+}
+
+// createTopology creates the nodes of a topology file, on random ports, and
+// gives them the addresses of their peers. The nodes are not started.
+func createTopology(t *testing.T, path string) map[string]BaseGossiper {
+
+	topo, err := topology.Load(path)
+	require.NoError(t, err)
+
+	nodes := make(map[string]BaseGossiper)
+	for _, n := range topo.Nodes {
+		nodes[n.Name], n.Addr = createNode(t, n.Name, n.AntiEntropy, n.RouteTimer)
+	}
+
+	for _, n := range topo.Nodes {
+		peers := topo.Peers(n.Name)
+		if len(peers) > 0 {
+			addAddresses(t, nodes[n.Name], peers...)
+		}
+	}
+
+	return nodes
+}
+
+// memoryPort is the last port given to a node of a memory network.
+var memoryPort = 0
+
+// addAddresses takes any number of node addresses that the gossiper can
+// contact in the gossiping network.
+func addAddresses(t *testing.T, node BaseGossiper, addresses ...string) {
+	numNodes := len(node.GetNodes())
+	err := node.AddAddresses(addresses...)
+	require.Nil(t, err, "Could not add addresses")
+
+	// Assumes we're not adding twice the same address.
+	require.Len(t, node.GetNodes(), numNodes + len(addresses))
+}
+
+// startNodesBlocking waits until the node is started
+func startNodesBlocking(t *testing.T, nodes ...BaseGossiper) {
+	wg := new(sync.WaitGroup)
+	wg.Add(len(nodes))
+	for idx, _ := range nodes {
+		go func(i int) {
+			defer wg.Done()
+			ready := make(chan struct{})
+			go nodes[i].Run(ready)
+			<- ready
+		}(idx)
+	}
+	wg.Wait()
+}
+
+func streamIncomingGossips(node BaseGossiper) chan GossipPacket {
+	ch := make(chan GossipPacket)
+	node.RegisterCallback(
+		func(origin string, message GossipPacket) {
+			ch <- message
+		})
+	return ch
+}
+
+func waitStatusMsg(t *testing.T, ctx context.Context,
+	ch <- chan CallbackPacket) *CallbackPacket {
+	for {
+		select {
+		case <-ctx.Done():
+			require.Fail(t, "Timed out on reception")
+		case p := <-ch:
+			if p.Msg.Status != nil {
+				return &p
+			}
+		}
+	}
+}
+
+func waitRumorMsg(t *testing.T, ctx context.Context,
+	ch <- chan CallbackPacket) *CallbackPacket {
+	for {
+		select {
+		case <- ctx.Done():
+			require.Fail(t, "Timed out on reception")
+		case p := <- ch:
+			if p.Msg.Rumor != nil {
+				return &p
+			}
+		}
+	}
+}
+
+func waitChannel(t *testing.T, ctx context.Context, c <-chan struct{}) {
+	select {
+	case <- ctx.Done():
+		require.Fail(t, "Timed out on reception")
+	case <- c:
+	}
+}
+
+// sendRawPacket json encodes the packet and sends it from the given
+// connection, bypassing any gossiper.
+func sendRawPacket(t *testing.T, conn *net.UDPConn, to *net.UDPAddr,
+	packet GossipPacket) {
+
+	b, err := json.Marshal(packet)
+	require.NoError(t, err)
+	_, err = conn.WriteToUDP(b, to)
+	require.NoError(t, err)
+}
+
+// readRawPacket reads and decodes the next packet received on the given
+// connection.
+func readRawPacket(t *testing.T, conn *net.UDPConn) GossipPacket {
+	b := make([]byte, 1500)
+
+	err := conn.SetReadDeadline(time.Now().Add(3*time.Second))
+	require.NoError(t, err)
+	n, _, err := conn.ReadFromUDP(b)
+	require.NoError(t, err)
+
+	var packet GossipPacket
+	require.NoError(t, json.Unmarshal(b[:n], &packet))
+
+	return packet
+}
+
+// newKey returns a new signing key.
+func newKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	return key
+}
+
+// signRumor signs the rumor with the given key, as its origin would.
+func signRumor(key ed25519.PrivateKey, rumor *RumorMessage) *RumorMessage {
+	rumor.PublicKey = key.Public().(ed25519.PublicKey)
+	rumor.Signature = ed25519.Sign(key, rumorSignedBytes(rumor))
+	return rumor
+}
+
+// waitRoute waits until the node knows a route to dest.
+func waitRoute(t *testing.T, node BaseGossiper, dest string,
+	timeout time.Duration) {
+
+	deadline := time.After(timeout)
+	for {
+		if _, ok := node.GetRoutingTable()[dest]; ok {
+			return
+		}
+
+		select {
+		case <- deadline:
+			require.Fail(t, "Timed out waiting for a route", dest)
+		case <- time.After(50*time.Millisecond):
+		}
 	}
 }
 
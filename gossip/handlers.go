@@ -10,7 +10,7 @@ import (
 // ExecuteHandler executes the 'Exec' function of the registered handler that
 // takes f and g as input arguments.
 // f is the message to be processes, and g is the UDP address which sent the packet.
-// It also return the error of Exec if any.
+// It also return the error of Exec if any. It must be called with g.mux held.
 func (g *Gossiper) ExecuteHandler(f interface{}, f2 *net.UDPAddr) error {
 	t := reflect.TypeOf(f)
 
@@ -62,6 +62,9 @@ func (g *Gossiper) ExecuteHandler(f interface{}, f2 *net.UDPAddr) error {
 // f.Exec(g, h) error
 // It uses f as the key to later exec the handler.
 func (g *Gossiper) RegisterHandler(f interface{}) error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
 	t := reflect.TypeOf(f)
 
 	if t.Kind() != reflect.Ptr && t.Elem().Kind() != reflect.Struct {
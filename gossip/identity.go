@@ -0,0 +1,118 @@
+package gossip
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+)
+
+// rumorSignatureContext prefixes the signed bytes of a rumor, so that a
+// rumor signature cannot be taken for the signature of something else.
+const rumorSignatureContext = "peerster rumor v1"
+
+// rumorSignedBytes returns the bytes a rumor signature covers: its origin, ID,
+// text and box key.
+func rumorSignedBytes(rumor *RumorMessage) []byte {
+
+	var n [binary.MaxVarintLen64]byte
+
+	b := make([]byte, 0, len(rumorSignatureContext)+len(rumor.Origin)+len(rumor.Text)+16)
+	b = append(b, rumorSignatureContext...)
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(len(rumor.Origin)))]...)
+	b = append(b, rumor.Origin...)
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(rumor.ID))]...)
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(len(rumor.Text)))]...)
+	b = append(b, rumor.Text...)
+	b = append(b, rumor.BoxKey...)
+
+	return b
+}
+
+// newRumor creates, signs and stores the next rumor originating from this
+// gossiper. Route rumors, with an empty text, advertise our box key. It must
+// be called with g.mux held.
+func (g *Gossiper) newRumor(text string) *RumorMessage {
+
+	rumor := &RumorMessage{
+		Origin: g.identifier,
+		ID:     g.getLatest(g.identifier) + 1,
+		Text:   text,
+	}
+
+	if text == "" {
+		rumor.BoxKey = g.GetBoxKey()
+	}
+
+	rumor.PublicKey = g.key.Public().(ed25519.PublicKey)
+	rumor.Signature = ed25519.Sign(g.key, rumorSignedBytes(rumor))
+
+	g.addMessage(rumor)
+	return rumor
+}
+
+// errOtherKey is returned for a rumor validly signed by another key than the
+// one bound to its origin. The bindings of the peers may differ, a node may
+// restart with a new key, so the relays of such rumors are not to blame.
+var errOtherKey = xerrors.New("signed by another key than its origin's")
+
+// errUnsigned is returned for a rumor without a key or a signature, like the
+// ones of the nodes that do not sign. Such rumors are dropped, but their
+// senders are not to blame.
+var errUnsigned = xerrors.New("not signed")
+
+// verifyRumor checks the signature of the rumor and that its key is the one
+// bound to its origin. The first valid key seen for an origin is bound to it,
+// trust on first use. The box key of a valid rumor is the one private
+// messages to its origin are encrypted with. It must be called with g.mux
+// held.
+func (g *Gossiper) verifyRumor(rumor *RumorMessage) error {
+
+	if len(rumor.PublicKey) == 0 || len(rumor.Signature) == 0 {
+		return xerrors.Errorf("rumor %v/%v: %w", rumor.Origin, rumor.ID, errUnsigned)
+	}
+
+	if len(rumor.PublicKey) != ed25519.PublicKeySize {
+		return xerrors.Errorf("rumor %v/%v has no valid public key", rumor.Origin, rumor.ID)
+	}
+
+	key := ed25519.PublicKey(rumor.PublicKey)
+
+	if !ed25519.Verify(key, rumorSignedBytes(rumor), rumor.Signature) {
+		return xerrors.Errorf("rumor %v/%v has an invalid signature", rumor.Origin, rumor.ID)
+	}
+
+	known, ok := g.keys[rumor.Origin]
+	if ok && !bytes.Equal(known, key) {
+		return xerrors.Errorf("rumor %v/%v: %w", rumor.Origin, rumor.ID, errOtherKey)
+	}
+
+	if !ok {
+		g.keys[rumor.Origin] = key
+	}
+
+	if len(rumor.BoxKey) > 0 {
+		g.boxKeys[rumor.Origin] = rumor.BoxKey
+	}
+
+	return nil
+}
+
+// GetPublicKey returns the public key that signs the rumors of this gossiper.
+func (g *Gossiper) GetPublicKey() ed25519.PublicKey {
+	return g.key.Public().(ed25519.PublicKey)
+}
+
+// GetKeys returns the public key bound to each origin.
+func (g *Gossiper) GetKeys() map[string]ed25519.PublicKey {
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	cpy := make(map[string]ed25519.PublicKey, len(g.keys))
+	for origin, key := range g.keys {
+		cpy[origin] = key
+	}
+	return cpy
+}
@@ -0,0 +1,297 @@
+package gossip
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// defaultBanStrikes is the number of invalid packets a peer can send in a
+// burst before being banned. One invalid packet is forgiven every second.
+const defaultBanStrikes = 10
+
+// defaultBanDuration is how long a peer is banned, unless another duration is
+// given.
+const defaultBanDuration = 10 * time.Minute
+
+// maxBuckets bounds the number of buckets kept for the addresses or the
+// origins. Past it, the buckets that are full again are forgotten.
+const maxBuckets = 4096
+
+// LimitStats counts the packets dropped to protect the gossiper.
+type LimitStats struct {
+	// RateLimited is the number of datagrams dropped because their sender
+	// sent too many
+	RateLimited int
+	// OriginLimited is the number of rumors dropped because their origin
+	// created too many
+	OriginLimited int
+	// Banned is the number of datagrams dropped because their sender is
+	// banned
+	Banned int
+	// Invalid is the number of packets that could not be parsed, and of
+	// rumors with a bad signature
+	Invalid int
+	// Bans is the number of peers banned for sending invalid packets
+	Bans int
+}
+
+// tokenBucket lets through rate packets per second on average, and bursts of
+// at most burst packets.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token from the bucket, if there is one left.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// limiter holds the rate limits and the bans. It has its own lock, so that
+// the datagrams are checked before taking g.mux.
+type limiter struct {
+	sync.Mutex
+
+	// a rate of 0 disables the limit
+	addrRate    float64
+	addrBurst   int
+	originRate  float64
+	originBurst int
+
+	// banStrikes of 0 disables the
+	// automatic bans
+	banStrikes  int
+	banDuration time.Duration
+
+	addrs   map[string]*tokenBucket
+	origins map[string]*tokenBucket
+	strikes map[string]*tokenBucket
+
+	// bans holds, for each address or
+	// IP, when its ban expires
+	bans  map[string]time.Time
+	stats LimitStats
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		banStrikes:  defaultBanStrikes,
+		banDuration: defaultBanDuration,
+		addrs:       make(map[string]*tokenBucket),
+		origins:     make(map[string]*tokenBucket),
+		strikes:     make(map[string]*tokenBucket),
+		bans:        make(map[string]time.Time),
+	}
+}
+
+// take takes a token from the bucket of key in buckets, which is created
+// full. It must be called with l held.
+func (l *limiter) take(buckets map[string]*tokenBucket, key string, now time.Time,
+	rate float64, burst int) bool {
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	b, ok := buckets[key]
+	if !ok {
+
+		// Might happen sometimes
+		// Many addresses or origins
+		if len(buckets) >= maxBuckets {
+			for k, b := range buckets {
+				if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+					delete(buckets, k)
+				}
+			}
+		}
+
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		buckets[key] = b
+	}
+
+	return b.take(now, rate, burst)
+}
+
+// banned tells whether the address, or its IP, is banned. It must be called
+// with l held.
+func (l *limiter) banned(addr *net.UDPAddr, now time.Time) bool {
+
+	for _, key := range []string{addr.String(), addr.IP.String()} {
+
+		until, ok := l.bans[key]
+		if !ok {
+			continue
+		}
+
+		if now.Before(until) {
+			return true
+		}
+		delete(l.bans, key)
+	}
+
+	return false
+}
+
+// admit tells whether a datagram from sender must be handled: the sender is
+// not banned and did not send too many datagrams.
+func (g *Gossiper) admit(sender *net.UDPAddr) bool {
+
+	l := g.limits
+	now := g.clock.Now()
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.banned(sender, now) {
+		l.stats.Banned++
+		return false
+	}
+
+	if l.addrRate > 0 && !l.take(l.addrs, sender.String(), now, l.addrRate, l.addrBurst) {
+		l.stats.RateLimited++
+		return false
+	}
+
+	return true
+}
+
+// admitOrigin tells whether a new rumor of origin must be handled: the origin
+// did not create too many rumors.
+func (g *Gossiper) admitOrigin(origin string) bool {
+
+	l := g.limits
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.originRate > 0 && !l.take(l.origins, origin, g.clock.Now(), l.originRate, l.originBurst) {
+		l.stats.OriginLimited++
+		return false
+	}
+
+	return true
+}
+
+// strike records an invalid packet from sender, which is banned after too
+// many of them.
+func (g *Gossiper) strike(sender *net.UDPAddr) {
+
+	l := g.limits
+	now := g.clock.Now()
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.stats.Invalid++
+
+	if l.banStrikes <= 0 || l.take(l.strikes, sender.String(), now, 1, l.banStrikes) {
+		return
+	}
+
+	log.Lvl1("Banning", sender, "for", l.banDuration, ": too many invalid packets")
+
+	delete(l.strikes, sender.String())
+	l.bans[sender.String()] = now.Add(l.banDuration)
+	l.stats.Bans++
+}
+
+// Ban drops the datagrams from the given address, or from every port of the
+// given IP, for the given duration. A duration of 0 bans for the default
+// duration.
+func (g *Gossiper) Ban(addr string, d time.Duration) error {
+
+	key, err := banKey(addr)
+	if err != nil {
+		return err
+	}
+
+	if d <= 0 {
+		d = defaultBanDuration
+	}
+
+	l := g.limits
+	l.Lock()
+	defer l.Unlock()
+
+	l.bans[key] = g.clock.Now().Add(d)
+	return nil
+}
+
+// Unban lifts the ban of the given address or IP.
+func (g *Gossiper) Unban(addr string) {
+
+	key, err := banKey(addr)
+	if err != nil {
+		key = addr
+	}
+
+	l := g.limits
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.bans, key)
+}
+
+// banKey returns the key of the bans of an address or IP, which is the way
+// the datagrams from the address or IP are checked.
+func banKey(addr string) (string, error) {
+
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String(), nil
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return "", xerrors.Errorf("invalid address %v: %v", addr, err)
+	}
+
+	return udpAddr.String(), nil
+}
+
+// GetBans returns the banned addresses and IPs, with when their ban expires.
+func (g *Gossiper) GetBans() map[string]time.Time {
+
+	l := g.limits
+	now := g.clock.Now()
+
+	l.Lock()
+	defer l.Unlock()
+
+	bans := make(map[string]time.Time, len(l.bans))
+	for key, until := range l.bans {
+		if now.Before(until) {
+			bans[key] = until
+		} else {
+			delete(l.bans, key)
+		}
+	}
+	return bans
+}
+
+// GetLimitStats returns the number of packets dropped by the rate limits and
+// the bans so far.
+func (g *Gossiper) GetLimitStats() LimitStats {
+
+	l := g.limits
+	l.Lock()
+	defer l.Unlock()
+
+	return l.stats
+}
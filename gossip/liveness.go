@@ -0,0 +1,166 @@
+package gossip
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// PeerState is what the failure detector knows of a peer.
+type PeerState int
+
+const (
+	// PeerAlive is a peer heard from recently.
+	PeerAlive PeerState = iota
+	// PeerSuspect is a peer silent for suspectProbes probe intervals. It is
+	// still chosen to gossip with.
+	PeerSuspect
+	// PeerDead is a peer silent for deadProbes probe intervals. It is not
+	// chosen to gossip with anymore, but still probed, so that it rejoins as
+	// soon as it answers.
+	PeerDead
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerAlive:
+		return "alive"
+	case PeerSuspect:
+		return "suspect"
+	case PeerDead:
+		return "dead"
+	default:
+		return fmt.Sprintf("PeerState(%d)", int(s))
+	}
+}
+
+// number of probe intervals a peer must be silent for to be suspected, and
+// then declared dead
+const (
+	suspectProbes = 2
+	deadProbes    = 5
+)
+
+// peerLiveness is the state of a peer for the failure detector.
+type peerLiveness struct {
+	lastHeard time.Time
+	state     PeerState
+}
+
+// heard records that a packet was received from the peer, which is alive
+// again if it was suspected or dead. It must be called with g.mux held.
+func (g *Gossiper) heard(addr *net.UDPAddr) {
+
+	l, ok := g.liveness[addr.String()]
+	if !ok {
+		return
+	}
+
+	l.lastHeard = g.clock.Now()
+
+	if l.state != PeerAlive {
+		l.state = PeerAlive
+		fmt.Fprintf(g.out, "PEER %v ALIVE\n", addr.String())
+	}
+}
+
+// isDead tells whether the failure detector declared the peer dead. It must
+// be called with g.mux held.
+func (g *Gossiper) isDead(addr *net.UDPAddr) bool {
+
+	l, ok := g.liveness[addr.String()]
+	return ok && l.state == PeerDead
+}
+
+// startProbes checks the peers every probe interval, until the gossiper
+// stops. The peers silent for an interval are probed with a status they
+// answer, and suspected and declared dead after a few intervals. A probe
+// interval of 0 disables the failure detector. It must be called with g.mux
+// held.
+func (g *Gossiper) startProbes() {
+
+	if g.probeInterval <= 0 {
+		return
+	}
+
+	var tick func()
+	tick = func() {
+
+		g.mux.Lock()
+		defer g.mux.Unlock()
+
+		if g.stopped {
+			return
+		}
+
+		g.probe()
+		g.probeTimer = g.clock.AfterFunc(g.probeInterval, tick)
+	}
+
+	g.probeTimer = g.clock.AfterFunc(g.probeInterval, tick)
+}
+
+// probe updates the state of the peers and probes the silent ones. It must
+// be called with g.mux held.
+func (g *Gossiper) probe() {
+
+	now := g.clock.Now()
+	forgotten := make([]string, 0)
+
+	for _, peer := range g.peers {
+
+		l := g.liveness[peer.String()]
+		silence := now.Sub(l.lastHeard)
+
+		if silence < g.probeInterval {
+			continue
+		}
+
+		state := l.state
+		switch {
+		case silence >= deadProbes*g.probeInterval:
+			state = PeerDead
+		case silence >= suspectProbes*g.probeInterval:
+			state = PeerSuspect
+		}
+
+		if state != l.state {
+			l.state = state
+			fmt.Fprintf(g.out, "PEER %v %v\n", peer.String(), state)
+		}
+
+		// dead peers learnt from an
+		// exchange make room for others
+		if state == PeerDead {
+			if _, ok := g.learntFrom[peer.String()]; ok {
+				forgotten = append(forgotten, peer.String())
+				continue
+			}
+		}
+
+		g.send(GossipPacket{
+			Status: &StatusPacket{
+				Want:  g.map2slice(),
+				Probe: true,
+			},
+		}, peer)
+	}
+
+	for _, addr := range forgotten {
+		g.forgetPeer(addr)
+	}
+}
+
+// GetPeerStates returns the state of each peer, as known by the failure
+// detector. Every peer is alive if the failure detector is disabled.
+func (g *Gossiper) GetPeerStates() map[string]PeerState {
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	states := make(map[string]PeerState, len(g.liveness))
+	for addr, l := range g.liveness {
+		states[addr] = l.state
+	}
+	return states
+}
@@ -0,0 +1,131 @@
+package gossip
+
+import (
+	"fmt"
+	"net"
+
+	"go.dedis.ch/cs438/hw1/gossip/clock"
+)
+
+// mongerEntry is a rumor sent to a peer that waits for the status packet
+// acknowledging it.
+type mongerEntry struct {
+	rumor *RumorMessage
+	timer clock.Timer
+}
+
+// monger sends the rumor to the given peer and remembers it until a status
+// from that peer acknowledges it. If no acknowledgement arrives within the
+// ack timeout, the rumor is mongered with another random peer. It must be
+// called with g.mux held.
+func (g *Gossiper) monger(rumor *RumorMessage, to *net.UDPAddr) {
+
+	fmt.Fprintf(g.out, "MONGERING with %v\n", to.String())
+
+	entry := &mongerEntry{rumor: rumor}
+	key := to.String()
+
+	entry.timer = g.clock.AfterFunc(g.ackTimeout, func() {
+
+		g.mux.Lock()
+		defer g.mux.Unlock()
+
+		// the status may have been received
+		// just before the timer fired
+		if !g.removeMongering(key, entry) {
+			return
+		}
+
+		// on a lossy link with a single peer,
+		// retrying the same peer is all we can do
+		if !g.spreadRumor(rumor, key) {
+			g.spreadRumor(rumor)
+		}
+	})
+	g.mongering[key] = append(g.mongering[key], entry)
+
+	// the datagram is queued for the
+	// peer, the queue keeps the order
+	// of the packets reproducible
+	g.send(GossipPacket{Rumor: rumor}, to)
+}
+
+// spreadRumor mongers the rumor with a random peer that is not blacklisted.
+// It returns false if there is no such peer. It must be called with g.mux
+// held.
+func (g *Gossiper) spreadRumor(rumor *RumorMessage, blacklisted ...string) bool {
+
+	receiver := g.randomPeer(blacklisted...)
+	if receiver == nil {
+		return false
+	}
+
+	g.monger(rumor, receiver)
+	return true
+}
+
+// ackRumors stops waiting for the rumors sent to addr that the peer now has
+// according to its status, and returns them. The want map holds the next ID
+// expected by the peer for each origin. It must be called with g.mux held.
+func (g *Gossiper) ackRumors(addr string, want map[string]uint32) []*RumorMessage {
+
+	acked := make([]*RumorMessage, 0)
+	remaining := make([]*mongerEntry, 0)
+
+	for _, entry := range g.mongering[addr] {
+
+		next, ok := want[entry.rumor.Origin]
+		if ok && next > entry.rumor.ID {
+			entry.timer.Stop()
+			acked = append(acked, entry.rumor)
+		} else {
+			remaining = append(remaining, entry)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(g.mongering, addr)
+	} else {
+		g.mongering[addr] = remaining
+	}
+
+	return acked
+}
+
+// removeMongering removes the entry from the rumors waiting for an
+// acknowledgement from addr. It returns false if the entry was already
+// removed. It must be called with g.mux held.
+func (g *Gossiper) removeMongering(addr string, entry *mongerEntry) bool {
+
+	entries := g.mongering[addr]
+	for i, e := range entries {
+
+		if e == entry {
+			g.mongering[addr] = append(entries[:i:i], entries[i+1:]...)
+			if len(g.mongering[addr]) == 0 {
+				delete(g.mongering, addr)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// stopMongering stops every pending acknowledgement timer. It must be called
+// with g.mux held.
+func (g *Gossiper) stopMongering() {
+
+	for addr, entries := range g.mongering {
+		for _, entry := range entries {
+			entry.timer.Stop()
+		}
+		delete(g.mongering, addr)
+	}
+}
+
+// flipCoin returns true with probability one half. It must be called with
+// g.mux held.
+func (g *Gossiper) flipCoin() bool {
+	return g.ran.Intn(2) == 0
+}
@@ -0,0 +1,99 @@
+package gossip
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// networkMagic starts every datagram of a gossiper that has a network key.
+const networkMagic byte = 0xA1
+
+// networkMACSize is the size of the HMAC-SHA256 that ends every datagram of
+// a gossiper that has a network key.
+const networkMACSize = sha256.Size
+
+// envelopeSize is how much the envelope adds to a datagram, 0 without a
+// network key.
+func (g *Gossiper) envelopeSize() int {
+
+	if g.networkKey == nil {
+		return 0
+	}
+
+	var n [binary.MaxVarintLen64]byte
+	return 1 + binary.PutUvarint(n[:], uint64(len(g.networkID))) + len(g.networkID) + networkMACSize
+}
+
+// sealDatagram wraps the datagram in an envelope made of the network ID and a
+// MAC of the whole datagram, under the network key. The datagram is returned
+// as is without a network key.
+func (g *Gossiper) sealDatagram(d []byte) []byte {
+
+	if g.networkKey == nil {
+		return d
+	}
+
+	var n [binary.MaxVarintLen64]byte
+
+	b := make([]byte, 0, len(d)+g.envelopeSize())
+	b = append(b, networkMagic)
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(len(g.networkID)))]...)
+	b = append(b, g.networkID...)
+	b = append(b, d...)
+
+	mac := hmac.New(sha256.New, g.networkKey)
+	mac.Write(b)
+	return mac.Sum(b)
+}
+
+// openDatagram returns the datagram in the envelope, or nil if it does not
+// come from our network. Without a network key, datagrams in an envelope are
+// dropped and the others returned as they are.
+func (g *Gossiper) openDatagram(b []byte, sender *net.UDPAddr) []byte {
+
+	sealed := len(b) > 0 && b[0] == networkMagic
+
+	if g.networkKey == nil {
+
+		// Might happen sometimes
+		// A peer of another network
+		if sealed {
+			log.Lvl2("Dropping datagram from", sender, ": sealed for a network")
+			return nil
+		}
+		return b
+	}
+
+	// Might happen sometimes
+	// A peer without a network key
+	if !sealed {
+		log.Lvl2("Dropping datagram from", sender, ": not sealed for our network")
+		return nil
+	}
+
+	length, n := binary.Uvarint(b[1:])
+	if n <= 0 || len(b) < 1+n+networkMACSize || length > uint64(len(b)-1-n-networkMACSize) {
+		log.Lvl2("Dropping datagram from", sender, ": truncated envelope")
+		return nil
+	}
+
+	start := 1 + n + int(length)
+	end := len(b) - networkMACSize
+
+	mac := hmac.New(sha256.New, g.networkKey)
+	mac.Write(b[:end])
+
+	// Might happen sometimes
+	// A peer of another network, or
+	// with another key
+	if string(b[1+n:start]) != g.networkID || !hmac.Equal(mac.Sum(nil), b[end:]) {
+		log.Lvl2("Dropping datagram from", sender, ": sealed for another network")
+		return nil
+	}
+
+	return b[start:end]
+}
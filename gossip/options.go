@@ -0,0 +1,258 @@
+package gossip
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"io"
+	"math/rand"
+	"time"
+
+	"go.dedis.ch/cs438/hw1/gossip/clock"
+	"go.dedis.ch/cs438/hw1/gossip/transport"
+)
+
+// defaultAckTimeout is how long a rumor waits for its status
+// acknowledgement before being mongered with another peer.
+const defaultAckTimeout = 10 * time.Second
+
+// Option configures an optional parameter of a Gossiper. Options are given
+// to GossipFactory.New and applied once the gossiper is created.
+type Option func(g *Gossiper)
+
+// WithAckTimeout sets how long the gossiper waits for a status acknowledging
+// a mongered rumor before sending the rumor to another random peer.
+func WithAckTimeout(d time.Duration) Option {
+	return func(g *Gossiper) {
+		g.ackTimeout = d
+	}
+}
+
+// WithTransport sets the transport used to exchange datagrams with the peers,
+// instead of a UDP socket listening on the gossiper address. The transport
+// should listen on that address, which is sent to peers in simple messages.
+func WithTransport(t transport.Transport) Option {
+	return func(g *Gossiper) {
+		g.transport = t
+	}
+}
+
+// WithClock sets the clock driving the timers of the gossiper: anti-entropy,
+// route rumors, acknowledgement timeouts and catch ups. The wall clock is used
+// by default.
+func WithClock(c clock.Clock) Option {
+	return func(g *Gossiper) {
+		g.clock = c
+	}
+}
+
+// WithSeed seeds the random generator of the gossiper, which picks the peers
+// and flips the coins. By default the generator is seeded from the time.
+func WithSeed(seed int64) Option {
+	return func(g *Gossiper) {
+		g.source = rand.NewSource(seed)
+	}
+}
+
+// WithOutput sets where the gossiper prints the messages it sends and
+// receives. It prints to the standard output by default.
+func WithOutput(w io.Writer) Option {
+	return func(g *Gossiper) {
+		g.out = w
+	}
+}
+
+// WithKey sets the key signing the rumors of the gossiper. A new key is
+// generated by default.
+func WithKey(key ed25519.PrivateKey) Option {
+	return func(g *Gossiper) {
+		g.key = key
+	}
+}
+
+// WithBoxKey sets the X25519 key private messages to the gossiper are
+// encrypted with. A new key is generated by default.
+func WithBoxKey(key *ecdh.PrivateKey) Option {
+	return func(g *Gossiper) {
+		g.boxKey = key
+	}
+}
+
+// WithEntropy sets where the ephemeral keys and the nonces of the private
+// messages are drawn from. It is crypto/rand by default, a deterministic
+// reader is only meant for simulations.
+func WithEntropy(r io.Reader) Option {
+	return func(g *Gossiper) {
+		g.entropy = r
+	}
+}
+
+// WithWireFormat sets the encoding of the packets sent to the peers. The
+// binary format is used by default, with the peers that advertise it. The
+// gossiper reads both formats whatever its own.
+func WithWireFormat(f WireFormat) Option {
+	return func(g *Gossiper) {
+		g.wireFormat = f
+	}
+}
+
+// WithNetwork isolates the gossiper in the network of the given ID and
+// pre-shared key. Every datagram sent carries the ID and a MAC under the key,
+// and the datagrams received without a valid one are dropped before being
+// handled or watched. Without a key, the ID only restricts the discovery to
+// the gossipers of the network.
+func WithNetwork(id string, key []byte) Option {
+	return func(g *Gossiper) {
+		g.networkID = id
+		g.networkKey = key
+	}
+}
+
+// WithFailureDetector probes the peers silent for the given interval. A peer
+// silent for a few intervals is suspected and then declared dead: it is not
+// gossiped with anymore until it is heard from again. The failure detector is
+// disabled by default.
+func WithFailureDetector(interval time.Duration) Option {
+	return func(g *Gossiper) {
+		g.probeInterval = interval
+	}
+}
+
+// WithPeerExchange sends a sample of the live peers to a random peer every
+// interval, and bounds the number of peers learnt from the exchanges. The
+// peer exchange is disabled by default, or with an interval of 0, the peers
+// learnt from the exchanges of the others are added anyway, up to maxPeers.
+func WithPeerExchange(interval time.Duration, maxPeers int) Option {
+	return func(g *Gossiper) {
+		g.exchangeInterval = interval
+		g.maxPeers = maxPeers
+	}
+}
+
+// WithDiscovery announces the gossiper on the given UDP multicast group every
+// interval, and adds the gossipers announced on the group to the peers. Only
+// the gossipers of the same network, see WithNetwork, are added. The
+// discovery is disabled by default.
+func WithDiscovery(group string, interval time.Duration) Option {
+	return func(g *Gossiper) {
+		g.discoveryGroup = group
+		g.discoveryInterval = interval
+	}
+}
+
+// WithAntiEntropyMode sets what is sent to a random peer every anti-entropy
+// interval: the status, by default, or its digest.
+func WithAntiEntropyMode(mode AntiEntropyMode) Option {
+	return func(g *Gossiper) {
+		g.antiEntropyMode = mode
+	}
+}
+
+// WithFanout sets the number of random peers each rumor is mongered with,
+// 1 by default. Retries and the rumors spread again after an acknowledgement
+// go to a single peer.
+func WithFanout(n int) Option {
+	return func(g *Gossiper) {
+		g.fanout = n
+	}
+}
+
+// WithAntiEntropyPeers sets the number of random peers contacted every
+// anti-entropy interval, 1 by default.
+func WithAntiEntropyPeers(n int) Option {
+	return func(g *Gossiper) {
+		g.antiEntropyPeers = n
+	}
+}
+
+// WithSyncMode sets the direction of the rumors exchanged with the peers
+// contacted by the anti-entropy: both ways, by default, only to the peers or
+// only from the peers. The rumors sent meanwhile are acknowledged as usual.
+func WithSyncMode(mode SyncMode) Option {
+	return func(g *Gossiper) {
+		g.syncMode = mode
+	}
+}
+
+// WithSendQueue sets the number of datagrams waiting to be sent to a peer,
+// at most, and what happens to the packets sent to a peer whose queue is
+// full. A depth of 0 sends the packets directly, which a simulator needs to
+// replay a run.
+func WithSendQueue(depth int, policy QueuePolicy) Option {
+	return func(g *Gossiper) {
+		g.queueDepth = depth
+		g.queuePolicy = policy
+	}
+}
+
+// WithCompression compresses the packets larger than threshold bytes for the
+// peers reading compressed packets, which they advertise. A threshold of 0
+// disables the compression, the compressed packets of the peers are read
+// anyway. Packets larger than the maximum packet size once decompressed are
+// dropped.
+func WithCompression(threshold int) Option {
+	return func(g *Gossiper) {
+		g.compressThreshold = threshold
+	}
+}
+
+// WithRateLimits bounds the number of datagrams handled per second from each
+// address, and of new rumors handled per second from each origin, with
+// bursts of the given sizes. A rate of 0 disables the limit, which is the
+// default.
+func WithRateLimits(addrRate float64, addrBurst int, originRate float64, originBurst int) Option {
+	return func(g *Gossiper) {
+		g.limits.addrRate = addrRate
+		g.limits.addrBurst = addrBurst
+		g.limits.originRate = originRate
+		g.limits.originBurst = originBurst
+	}
+}
+
+// WithBans bans for the given duration the peers sending more than strikes
+// invalid packets in a burst, one invalid packet being forgiven every second.
+// A peer is banned after 10 invalid packets for 10 minutes by default. 0
+// strikes disables the automatic bans.
+func WithBans(strikes int, d time.Duration) Option {
+	return func(g *Gossiper) {
+		g.limits.banStrikes = strikes
+		g.limits.banDuration = d
+	}
+}
+
+// WithDissemination sets how the rumors are spread: by rumormongering, by
+// default, or along the trees of plumtree.
+func WithDissemination(mode DisseminationMode) Option {
+	return func(g *Gossiper) {
+		g.dissemination = mode
+	}
+}
+
+// WithStore keeps the state of the gossiper in a log at the given path: the
+// rumors, and so its own sequence number, the peers, the routes and the keys.
+// The state is restored when the gossiper is created. The log is synced to
+// the disk every syncEvery records, 0 leaves it to the system until Stop.
+func WithStore(path string, syncEvery int) Option {
+	return func(g *Gossiper) {
+		g.storePath = path
+		g.storeSyncEvery = syncEvery
+	}
+}
+
+// WithMaxDatagramSize sets the size of the largest datagram sent. Larger
+// packets are sent in fragments, which the peer reassembles. The size must
+// leave at least 256 bytes to the payload of a fragment, once sealed, or
+// NewGossiper fails.
+func WithMaxDatagramSize(n int) Option {
+	return func(g *Gossiper) {
+		g.maxDatagramSize = n
+	}
+}
+
+// WithMaxPacketSize bounds the size of a packet. Larger packets are neither
+// sent nor reassembled, which bounds the memory used by the fragments of
+// incomplete packets. It must be positive, and fit in 65535 fragments.
+func WithMaxPacketSize(n int) Option {
+	return func(g *Gossiper) {
+		g.maxPacketSize = n
+	}
+}
@@ -3,7 +3,8 @@
 package gossip
 
 import (
-       "context"
+	"context"
+	"time"
 )
 
 // GetFactory returns the Gossip factory
@@ -18,6 +19,17 @@ type GossipPacket struct {
 	Rumor   *RumorMessage   `json:"rumor"`
 	Status  *StatusPacket   `json:"status"`
 	Private *PrivateMessage `json:"private"`
+
+	PeerExchange *PeerExchangePacket `json:"peerexchange,omitempty"`
+	Digest       *DigestPacket       `json:"digest,omitempty"`
+	IHave        *IHavePacket        `json:"ihave,omitempty"`
+	Graft        *GraftPacket        `json:"graft,omitempty"`
+	Prune        *PrunePacket        `json:"prune,omitempty"`
+	Batch        *BatchPacket        `json:"batch,omitempty"`
+
+	// WireVersion is the latest version of the binary format the sender
+	// reads, 0 if it only reads JSON
+	WireVersion uint8 `json:"wireversion,omitempty"`
 }
 
 // SimpleMessage is a structure for the simple message
@@ -32,12 +44,32 @@ type RumorMessage struct {
 	Origin string `json:"origin"`
 	ID     uint32 `json:"id"`
 	Text   string `json:"text"`
+
+	// PublicKey is the Ed25519 key of the origin, which signs the origin,
+	// ID and text of the rumor
+	PublicKey []byte `json:"publickey,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+
+	// BoxKey is the X25519 key private messages to the origin are
+	// encrypted with. Route rumors carry it, under the signature
+	BoxKey []byte `json:"boxkey,omitempty"`
 }
 
 // StatusPacket is sent as a status of the current local state of messages seen
 // so far. It can start a rumormongering process in the network.
 type StatusPacket struct {
 	Want []PeerStatus `json:"want"`
+
+	// Probe asks the peer to answer with its status even if it is in sync,
+	// which tells the failure detector the peer is alive
+	Probe bool `json:"probe,omitempty"`
+
+	// Push tells the peer not to send the rumors the sender misses, but to
+	// answer with a Pull status if it misses some. Pull tells the peer to
+	// send the rumors the sender misses, but not to ask for the ones it
+	// misses. Neither means both ways
+	Push bool `json:"push,omitempty"`
+	Pull bool `json:"pull,omitempty"`
 }
 
 // PeerStatus shows how far have a node see messages coming from a peer in
@@ -62,6 +94,58 @@ type PrivateMessage struct {
 	Text        string `json:"text"`
 	Destination string `json:"destination"`
 	HopLimit    int    `json:"hoplimit"`
+
+	// EphemeralKey and Ciphertext carry the origin, ID and text, encrypted
+	// for the destination. The relays only read Destination and HopLimit
+	EphemeralKey []byte `json:"ephemeralkey,omitempty"`
+	Ciphertext   []byte `json:"ciphertext,omitempty"`
+
+	// Decrypted and Authenticated are set on the messages delivered to
+	// us, when the message was encrypted and when it is signed by the key
+	// bound to its origin
+	Decrypted     bool `json:"-"`
+	Authenticated bool `json:"-"`
+}
+
+// PeerExchangePacket shares a sample of the live peers of the sender, so that
+// nodes learn peers beyond the ones they were given.
+type PeerExchangePacket struct {
+	Peers []string `json:"peers"`
+}
+
+// DigestPacket carries a digest of the status of the sender, sent instead of
+// the status by the anti-entropy.
+type DigestPacket struct {
+	Hash []byte `json:"hash"`
+}
+
+// IHavePacket announces a rumor to a lazy peer in plumtree mode.
+type IHavePacket struct {
+	Origin string `json:"origin"`
+	ID     uint32 `json:"id"`
+}
+
+// GraftPacket asks a peer for a rumor it announced, and makes the sender part
+// of its tree in plumtree mode.
+type GraftPacket struct {
+	Origin string `json:"origin"`
+	ID     uint32 `json:"id"`
+}
+
+// PrunePacket removes the sender from the tree of the origin of a peer in
+// plumtree mode, after the peer sent it a rumor of that origin it already
+// had.
+type PrunePacket struct {
+	Origin string `json:"origin"`
+}
+
+// BatchPacket carries several rumors, handled in order as if sent alone, and
+// optionally the status of the sender, handled after them. The receiver
+// acknowledges the whole batch with a single status. Only the peers reading
+// the batchVersion of the binary format are sent batches.
+type BatchPacket struct {
+	Rumors []*RumorMessage `json:"rumors"`
+	Status *StatusPacket   `json:"status,omitempty"`
 }
 
 // CallbackPacket describes the content of a callback
@@ -74,9 +158,10 @@ type CallbackPacket struct {
 // provide to get a feedback on new messages detected in the gossip network.
 type NewMessageCallback func(origin string, message GossipPacket)
 
-// GossipFactory provides the primitive to instantiate a new Gossiper
+// GossipFactory provides the primitive to instantiate a new Gossiper. The
+// options tune optional parameters of the gossiper.
 type GossipFactory interface {
-	New(address, identifier string, antiEntropy int, routeTimer int) (BaseGossiper, error)
+	New(address, identifier string, antiEntropy int, routeTimer int, opts ...Option) (BaseGossiper, error)
 }
 
 // BaseGossiper ...
@@ -89,8 +174,8 @@ type BaseGossiper interface {
 	// GetDirectNodes returns the list of nodes this gossiper knows  in its routing table
 	GetDirectNodes() []string
 	// SetIdentifier changes the identifier sent with messages originating from this
-	// gossiper.
-	SetIdentifier(id string)
+	// gossiper. It returns an error if another node already uses the identifier.
+	SetIdentifier(id string) error
 	// GetIdentifier returns the currently used identifier for outgoing messages from
 	// this gossiper.
 	GetIdentifier() string
@@ -100,17 +185,33 @@ type BaseGossiper interface {
 	// AddMessage takes a text that will be spread through the gossip network
 	// with the identifier of g. It returns the ID of the message
 	AddMessage(text string) uint32
-	// AddPrivateMessage
-	AddPrivateMessage(text string, dest string, origin string, hoplimit int)
+	// GetMessages returns the rumors with a text known by the gossiper,
+	// including the ones restored from its store.
+	GetMessages() []RumorMessage
+	// AddPrivateMessage sends a message to dest along the known route, which
+	// is dropped after hoplimit hops, DefaultHopLimit if not positive. It
+	// returns an error if there is no route to dest.
+	AddPrivateMessage(text string, dest string, origin string, hoplimit int) error
 	// AddAddresses takes any number of node addresses that the gossiper can contact
 	// in the gossiping network.
 	AddAddresses(addresses ...string) error
+	// Ban drops the packets from the given address, or from every port of
+	// the given IP, for the given duration, the default one if 0.
+	Ban(addr string, d time.Duration) error
+	// Unban lifts the ban of the given address or IP.
+	Unban(addr string)
+	// GetBans returns the banned addresses and IPs, with when their ban
+	// expires.
+	GetBans() map[string]time.Time
+	// GetLimitStats returns the number of packets dropped by the rate limits
+	// and the bans.
+	GetLimitStats() LimitStats
 	// GetRoutingTable returns the routing table of the node.
 	GetRoutingTable() map[string]*RouteStruct
 	// RegisterCallback registers a callback needed by the controller to update
 	// the view.
 	RegisterCallback(NewMessageCallback)
-	// Run creates the UPD connection and starts the gossiper. This function is
+	// Run creates the transport, if none was given, and starts the gossiper. This function is
 	// assumed to be blocking until Stop is called. The ready chan should be
 	// closed when the Gossiper is started.
 	Run(ready chan struct{})
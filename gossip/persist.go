@@ -0,0 +1,389 @@
+package gossip
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"sort"
+
+	"go.dedis.ch/cs438/hw1/gossip/store"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// kinds of the records of the store. The first byte of a record is its kind.
+const (
+	recordKeys  byte = 1
+	recordRumor byte = 2
+	recordPeer  byte = 3
+	recordRoute byte = 4
+	// recordForget removes a peer restored from the records before it.
+	recordForget byte = 5
+	// recordLearnt tells the source a peer was learnt from.
+	recordLearnt byte = 6
+)
+
+// minCompaction is the number of records appended to the store before it is
+// compacted, at least. The store is compacted when the appended records
+// outnumber twice the records of the state.
+const minCompaction = 1024
+
+// openStore opens the store and restores the keys it holds, unless they are
+// given as options. It must be called before the keys are generated, the rest
+// of the state is restored by restoreStore.
+func (g *Gossiper) openStore() error {
+
+	l, records, err := store.Open(g.storePath, g.storeSyncEvery)
+	if err != nil {
+		return xerrors.Errorf("failed to open store: %v", err)
+	}
+
+	// Might happen once a day
+	// The node crashed while writing
+	if l.Truncated() > 0 {
+		log.Error("Dropped", l.Truncated(), "bytes of invalid records from", g.storePath)
+	}
+
+	// the keys sign and decrypt the
+	// stored messages, restore them first
+	for _, r := range records {
+		if len(r) > 0 && r[0] == recordKeys {
+			g.restoreKeys(r[1:])
+		}
+	}
+
+	g.storeRecords = records
+	g.store = l
+
+	return nil
+}
+
+// restoreStore restores the rumors, and so our own sequence number, the peers
+// and the routes of the store, and then compacts it. It must be called once
+// the keys are known.
+func (g *Gossiper) restoreStore() {
+
+	if g.store == nil {
+		return
+	}
+
+	// restored state is not appended again
+	l := g.store
+	g.store = nil
+
+	for _, r := range g.storeRecords {
+
+		var err error
+
+		if len(r) == 0 {
+			continue
+		}
+
+		switch r[0] {
+		case recordRumor:
+			err = g.restoreRumor(r[1:])
+		case recordPeer:
+			err = g.restorePeer(r[1:])
+		case recordRoute:
+			err = g.restoreRoute(r[1:])
+		case recordForget:
+			g.unlearn(string(r[1:]))
+			g.removePeer(string(r[1:]))
+		case recordLearnt:
+			err = g.restoreLearnt(r[1:])
+		}
+
+		// Might happen once a day
+		// Written by another version
+		if err != nil {
+			log.Error("Skipping stored record:", err)
+		}
+	}
+
+	g.storeRecords = nil
+	g.store = l
+	g.compactStore()
+}
+
+func (g *Gossiper) restoreKeys(b []byte) {
+
+	err := readFields(b, func(tag byte, v []byte) error {
+		switch tag {
+		case 1:
+			if g.key == nil && len(v) == ed25519.PrivateKeySize {
+				g.key = ed25519.PrivateKey(append([]byte(nil), v...))
+			}
+		case 2:
+			if g.boxKey == nil {
+				key, err := ecdh.X25519().NewPrivateKey(v)
+				if err != nil {
+					return err
+				}
+				g.boxKey = key
+			}
+		}
+		return nil
+	})
+
+	// Might happen once a day
+	if err != nil {
+		log.Error("Skipping stored keys:", err)
+	}
+}
+
+func (g *Gossiper) restoreRumor(b []byte) error {
+
+	p, _, err := decodePacket(b)
+	if err != nil {
+		return err
+	}
+
+	if p.Rumor == nil {
+		return xerrors.Errorf("record is not a rumor")
+	}
+
+	err = g.verifyRumor(p.Rumor)
+	if err != nil {
+		return err
+	}
+
+	// Should really never happen
+	// Rumors are stored in order
+	if p.Rumor.ID != g.getLatest(p.Rumor.Origin)+1 {
+		return xerrors.Errorf("rumor %v/%v is out of order", p.Rumor.Origin, p.Rumor.ID)
+	}
+
+	g.addMessage(p.Rumor)
+	return nil
+}
+
+func (g *Gossiper) restorePeer(b []byte) error {
+
+	addr, err := net.ResolveUDPAddr("udp", string(b))
+	if err != nil {
+		return err
+	}
+
+	g.addAddress(addr)
+	return nil
+}
+
+func (g *Gossiper) restoreLearnt(b []byte) error {
+
+	var peer, source string
+
+	err := readFields(b, func(tag byte, v []byte) error {
+		switch tag {
+		case 1:
+			peer = string(v)
+		case 2:
+			source = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// a peer learnt twice
+	// counts once
+	g.unlearn(peer)
+	g.learn(peer, source)
+	return nil
+}
+
+func (g *Gossiper) restoreRoute(b []byte) error {
+
+	var origin string
+	route := &RouteStruct{}
+
+	err := readFields(b, func(tag byte, v []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			origin = string(v)
+		case 2:
+			route.NextHop = string(v)
+		case 3:
+			route.LastID, err = readUint32(v)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	g.routes[origin] = route
+	return nil
+}
+
+// persist appends the record to the store, if any. It must be called with
+// g.mux held.
+func (g *Gossiper) persist(record []byte) {
+
+	if g.store == nil {
+		return
+	}
+
+	err := g.store.Append(record)
+
+	// Might happen once a day
+	// The disk is full
+	if err != nil {
+		log.Error("Could not store record:", err)
+		return
+	}
+
+	g.storeAppends++
+	if g.storeAppends >= minCompaction && g.storeAppends >= 2*g.stateRecords() {
+		g.compactStore()
+	}
+}
+
+func rumorRecord(rumor *RumorMessage) []byte {
+
+	b, err := encodeBinary(GossipPacket{Rumor: rumor}, wireVersion)
+
+	// Should really never happen
+	// The packet has one message
+	if err != nil {
+		panic(fmt.Sprintf("Could not encode rumor: %v", err))
+	}
+
+	return append([]byte{recordRumor}, b...)
+}
+
+func peerRecord(addr *net.UDPAddr) []byte {
+	return append([]byte{recordPeer}, addr.String()...)
+}
+
+func learntRecord(peer, source string) []byte {
+
+	w := &tlvWriter{b: []byte{recordLearnt}}
+	w.string(1, peer)
+	w.string(2, source)
+
+	return w.b
+}
+
+func forgetRecord(addr string) []byte {
+	return append([]byte{recordForget}, addr...)
+}
+
+func routeRecord(origin string, route *RouteStruct) []byte {
+
+	w := &tlvWriter{b: []byte{recordRoute}}
+	w.string(1, origin)
+	w.string(2, route.NextHop)
+	w.uint(3, uint64(route.LastID))
+
+	return w.b
+}
+
+// stateRecords returns the number of records of the state. It must be called
+// with g.mux held.
+func (g *Gossiper) stateRecords() int {
+
+	n := 1 + len(g.peers) + len(g.learntFrom) + len(g.routes)
+	for _, rumors := range g.messages {
+		n += len(rumors)
+	}
+	return n
+}
+
+// compactStore rewrites the store with the records of the current state
+// only. It must be called with g.mux held.
+func (g *Gossiper) compactStore() {
+
+	if g.store == nil {
+		return
+	}
+
+	keys := &tlvWriter{b: []byte{recordKeys}}
+	keys.blob(1, g.key)
+	keys.blob(2, g.boxKey.Bytes())
+
+	records := [][]byte{keys.b}
+
+	origins := make([]string, 0, len(g.messages))
+	for origin := range g.messages {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	// the rumors of each origin in order
+	for _, origin := range origins {
+		for _, rumor := range g.messages[origin] {
+			records = append(records, rumorRecord(rumor))
+		}
+	}
+
+	// the records of forgotten
+	// peers are left out
+	for _, peer := range g.peers {
+		records = append(records, peerRecord(peer))
+
+		source, ok := g.learntFrom[peer.String()]
+		if ok {
+			records = append(records, learntRecord(peer.String(), source))
+		}
+	}
+
+	for origin, route := range g.routes {
+		records = append(records, routeRecord(origin, route))
+	}
+
+	err := g.store.Rewrite(records)
+
+	// Might happen once a day
+	if err != nil {
+		log.Error("Could not compact store:", err)
+		return
+	}
+
+	g.storeAppends = 0
+}
+
+// closeStore syncs and closes the store, if any. It must be called with g.mux
+// held.
+func (g *Gossiper) closeStore() {
+
+	if g.store == nil {
+		return
+	}
+
+	err := g.store.Close()
+
+	// Might happen once a day
+	if err != nil {
+		log.Error("Could not close store:", err)
+	}
+
+	g.store = nil
+}
+
+// GetMessages implements gossip.BaseGossiper. It returns the rumors with a
+// text, by origin and in order.
+func (g *Gossiper) GetMessages() []RumorMessage {
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	origins := make([]string, 0, len(g.messages))
+	for origin := range g.messages {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	messages := make([]RumorMessage, 0)
+	for _, origin := range origins {
+		for _, rumor := range g.messages[origin] {
+			if rumor.Text != "" {
+				messages = append(messages, *rumor)
+			}
+		}
+	}
+
+	return messages
+}
@@ -0,0 +1,290 @@
+package gossip
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"go.dedis.ch/cs438/hw1/gossip/clock"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// DisseminationMode is how a gossiper spreads the rumors.
+type DisseminationMode int
+
+const (
+	// DisseminationMongering sends each rumor to a random peer, which
+	// acknowledges it with its status, and keeps spreading it with
+	// probability 1/2.
+	DisseminationMongering DisseminationMode = iota
+	// DisseminationPlumtree pushes each rumor along a spanning tree made of
+	// the eager peers, and announces it to the lazy peers with an IHAVE. A
+	// peer sending us a rumor we already have becomes lazy, a lazy peer
+	// announcing a rumor we miss is grafted back to the tree. Each origin
+	// has its own tree, built by its first rumors. Every peer must use this
+	// mode.
+	DisseminationPlumtree
+)
+
+// plumtreeVersion is the version of the binary format that adds the IHAVE,
+// GRAFT and PRUNE packets. The peers reading older versions get the rumors
+// themselves and are never pruned.
+const plumtreeVersion uint8 = 4
+
+// graftTimeout is how long an announced rumor is waited for before grafting
+// the peer that announced it. The other announcers are grafted one after the
+// other, every retryTimeout, until the rumor arrives.
+const (
+	graftTimeout = time.Second
+	retryTimeout = 500 * time.Millisecond
+)
+
+// maxMissingRumors bounds the number of announced rumors waited for.
+const maxMissingRumors = 1024
+
+// rumorKey identifies a rumor.
+type rumorKey struct {
+	origin string
+	id     uint32
+}
+
+// missingRumor is a rumor announced by some peers that we did not receive
+// yet.
+type missingRumor struct {
+	announcers []*net.UDPAddr
+	timer      clock.Timer
+}
+
+// disseminate spreads the rumor with the peers, except the one it came from,
+// in the dissemination mode of the gossiper. It returns false if there is no
+// peer to spread it to. It must be called with g.mux held.
+func (g *Gossiper) disseminate(rumor *RumorMessage, from ...string) bool {
+
+	if g.dissemination != DisseminationPlumtree {
+
+		receivers := g.randomPeers(g.fanout, from...)
+		for _, receiver := range receivers {
+			g.monger(rumor, receiver)
+		}
+		return len(receivers) > 0
+	}
+
+	sent := false
+
+	for _, peer := range g.peers {
+
+		if g.isDead(peer) || (len(from) > 0 && peer.String() == from[0]) {
+			continue
+		}
+
+		if g.lazy[rumor.Origin][peer.String()] && g.reads(peer, plumtreeVersion) {
+			g.send(GossipPacket{IHave: &IHavePacket{Origin: rumor.Origin, ID: rumor.ID}}, peer)
+		} else {
+			g.send(GossipPacket{Rumor: rumor}, peer)
+		}
+		sent = true
+	}
+
+	return sent
+}
+
+// receivePlumtree handles a rumor received in plumtree mode. The sender of a
+// new rumor is part of the tree, the sender of a rumor we already have is
+// pruned from it. It must be called with g.mux held.
+func (g *Gossiper) receivePlumtree(rumor *RumorMessage, addr *net.UDPAddr) {
+
+	if rumor.ID > g.getLatest(rumor.Origin) {
+		g.setLazy(rumor.Origin, addr, false)
+		return
+	}
+
+	// already pruned, the rumor
+	// is a late answer to a graft
+	// or a catch up
+	if g.lazy[rumor.Origin][addr.String()] || !g.reads(addr, plumtreeVersion) {
+		return
+	}
+
+	fmt.Fprintf(g.out, "PRUNE %v origin %v\n", addr.String(), rumor.Origin)
+
+	g.setLazy(rumor.Origin, addr, true)
+	g.send(GossipPacket{Prune: &PrunePacket{Origin: rumor.Origin}}, addr)
+}
+
+// setLazy moves the peer to the lazy or eager peers of the tree of origin.
+// It must be called with g.mux held.
+func (g *Gossiper) setLazy(origin string, addr *net.UDPAddr, lazy bool) {
+
+	if !lazy {
+		delete(g.lazy[origin], addr.String())
+		if len(g.lazy[origin]) == 0 {
+			delete(g.lazy, origin)
+		}
+		return
+	}
+
+	peers, ok := g.lazy[origin]
+	if !ok {
+		peers = make(map[string]bool)
+		g.lazy[origin] = peers
+	}
+	peers[addr.String()] = true
+}
+
+// delivered stops waiting for the rumor, which we now have. It must be
+// called with g.mux held.
+func (g *Gossiper) delivered(rumor *RumorMessage) {
+
+	key := rumorKey{origin: rumor.Origin, id: rumor.ID}
+
+	m, ok := g.missing[key]
+	if !ok {
+		return
+	}
+
+	m.timer.Stop()
+	delete(g.missing, key)
+}
+
+// Exec is the function that the gossiper uses to execute the handler for an
+// IHavePacket. If we miss the announced rumor, we graft the sender once the
+// timeout expires, unless the rumor arrives in the meantime.
+func (msg *IHavePacket) Exec(g *Gossiper, addr *net.UDPAddr) error {
+
+	g.addAddress(addr)
+
+	if msg.ID <= g.getLatest(msg.Origin) {
+		return nil
+	}
+
+	// buffered, waiting for
+	// its predecessors
+	if _, ok := g.pending[msg.Origin][msg.ID]; ok {
+		return nil
+	}
+
+	key := rumorKey{origin: msg.Origin, id: msg.ID}
+
+	m, ok := g.missing[key]
+	if !ok {
+
+		// Might happen sometimes
+		// The anti-entropy gets the
+		// rumors we cannot wait for
+		if len(g.missing) >= maxMissingRumors {
+			log.Lvl2("Ignoring IHAVE from", addr, ": too many missing rumors")
+			return nil
+		}
+
+		m = &missingRumor{}
+		m.timer = g.clock.AfterFunc(graftTimeout, func() {
+
+			g.mux.Lock()
+			defer g.mux.Unlock()
+
+			if g.stopped {
+				return
+			}
+
+			g.graft(key, m)
+		})
+		g.missing[key] = m
+	}
+
+	for _, a := range m.announcers {
+		if a.String() == addr.String() {
+			return nil
+		}
+	}
+
+	m.announcers = append(m.announcers, addr)
+	return nil
+}
+
+// graft asks the next peer that announced the missing rumor for it, and
+// makes that peer part of the tree. It must be called with g.mux held.
+func (g *Gossiper) graft(key rumorKey, m *missingRumor) {
+
+	// the rumor arrived just
+	// before the timer fired
+	if g.missing[key] != m {
+		return
+	}
+
+	// an announcer reads the grafts,
+	// unless it restarted with an
+	// older version
+	for len(m.announcers) > 0 && !g.reads(m.announcers[0], plumtreeVersion) {
+		m.announcers = m.announcers[1:]
+	}
+
+	if len(m.announcers) == 0 || key.id <= g.getLatest(key.origin) {
+		delete(g.missing, key)
+		return
+	}
+
+	to := m.announcers[0]
+	m.announcers = m.announcers[1:]
+
+	fmt.Fprintf(g.out, "GRAFT %v origin %v ID %v\n", to.String(), key.origin, key.id)
+
+	g.setLazy(key.origin, to, false)
+	g.send(GossipPacket{Graft: &GraftPacket{Origin: key.origin, ID: key.id}}, to)
+
+	m.timer = g.clock.AfterFunc(retryTimeout, func() {
+
+		g.mux.Lock()
+		defer g.mux.Unlock()
+
+		if g.stopped {
+			return
+		}
+
+		g.graft(key, m)
+	})
+}
+
+// Exec is the function that the gossiper uses to execute the handler for a
+// GraftPacket. The sender becomes part of the tree of the origin, and gets
+// the rumor it asks for if we have it.
+func (msg *GraftPacket) Exec(g *Gossiper, addr *net.UDPAddr) error {
+
+	g.addAddress(addr)
+	g.setLazy(msg.Origin, addr, false)
+
+	rumors := g.messages[msg.Origin]
+	if msg.ID == 0 || msg.ID > uint32(len(rumors)) {
+		return nil
+	}
+
+	g.send(GossipPacket{Rumor: rumors[msg.ID-1]}, addr)
+	return nil
+}
+
+// Exec is the function that the gossiper uses to execute the handler for a
+// PrunePacket. The sender leaves the tree of the origin, it only gets our
+// announcements of the rumors of that origin.
+func (msg *PrunePacket) Exec(g *Gossiper, addr *net.UDPAddr) error {
+
+	g.addAddress(addr)
+
+	// Might happen sometimes
+	// A peer cannot make us
+	// track unknown origins
+	if _, ok := g.messages[msg.Origin]; !ok {
+		return nil
+	}
+
+	g.setLazy(msg.Origin, addr, true)
+	return nil
+}
+
+// stopGrafts stops every timer waiting for an announced rumor. It must be
+// called with g.mux held.
+func (g *Gossiper) stopGrafts() {
+
+	for key, m := range g.missing {
+		m.timer.Stop()
+		delete(g.missing, key)
+	}
+}
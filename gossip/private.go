@@ -0,0 +1,125 @@
+package gossip
+
+import (
+	"fmt"
+	"net"
+
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// DefaultHopLimit is the number of hops a private message can travel when the
+// sender does not choose one.
+const DefaultHopLimit = 10
+
+// AddPrivateMessage implements gossip.BaseGossiper. It encrypts the message
+// for dest and sends it to the next hop on the route to dest, with
+// DefaultHopLimit if hoplimit is not positive. It returns an error if no
+// route to dest, or no box key of dest, is known.
+func (g *Gossiper) AddPrivateMessage(text, dest, origin string, hoplimit int) error {
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	fmt.Fprintf(g.out, "CLIENT MESSAGE %v dest %v\n", text, dest)
+
+	// a message without hops
+	// would never leave
+	if hoplimit <= 0 {
+		hoplimit = DefaultHopLimit
+	}
+
+	msg := &PrivateMessage{
+		Origin:      origin,
+		ID:          0,
+		Text:        text,
+		Destination: dest,
+		HopLimit:    hoplimit,
+	}
+
+	// Might happen sometimes
+	// No rumor from the destination yet
+	if g.nextHop(dest) == nil {
+		return xerrors.Errorf("no route to %v", dest)
+	}
+
+	err := g.encryptPrivate(msg)
+	if err != nil {
+		return err
+	}
+
+	return g.forwardPrivate(msg)
+}
+
+// forwardPrivate sends the private message to the next hop towards its
+// destination. It must be called with g.mux held.
+func (g *Gossiper) forwardPrivate(msg *PrivateMessage) error {
+
+	next := g.nextHop(msg.Destination)
+
+	// Might happen sometimes
+	// No rumor from the destination yet
+	if next == nil {
+		return xerrors.Errorf("no route to %v", msg.Destination)
+	}
+
+	// the datagram is queued for the peer
+	g.send(GossipPacket{Private: msg}, next)
+	return nil
+}
+
+// Exec is the function that the gossiper uses to execute the handler for a PrivateMessage
+// The message is decrypted and delivered if we are its destination, otherwise
+// it is forwarded to the next hop as long as its hop limit is not reached.
+// Messages from peers that do not encrypt are delivered as they are, unless
+// we know the box key of their origin.
+func (msg *PrivateMessage) Exec(g *Gossiper, addr *net.UDPAddr) error {
+
+	g.addAddress(addr)
+
+	if msg.Destination == g.identifier {
+
+		// an origin that published its
+		// box key encrypts, anybody
+		// can forge a message in clear
+		_, known := g.boxKeys[msg.Origin]
+		if len(msg.Ciphertext) == 0 && known {
+			return xerrors.Errorf("dropping private message in clear from %v, "+
+				"whose box key is known", msg.Origin)
+		}
+
+		if len(msg.Ciphertext) > 0 {
+			plain, err := g.decryptPrivate(msg)
+
+			// Might happen once a day
+			if err != nil {
+				return xerrors.Errorf("dropping private message from %v: %v", addr, err)
+			}
+
+			// Might happen once a day
+			if !plain.Authenticated {
+				log.Lvl2("Private message from", plain.Origin, "is not authenticated")
+			}
+
+			msg = plain
+		}
+
+		fmt.Fprintf(g.out, "PRIVATE origin %v hop-limit %v contents %v\n",
+			msg.Origin, msg.HopLimit, msg.Text)
+
+		g.notify(msg.Origin, GossipPacket{Private: msg})
+		return nil
+	}
+
+	fwd := *msg
+	fwd.HopLimit--
+
+	// Might happen sometimes
+	// The route is too long or has a loop
+	if fwd.HopLimit <= 0 {
+		log.Lvl2("Dropping private message to", msg.Destination, ": hop limit reached")
+		return nil
+	}
+
+	return g.forwardPrivate(&fwd)
+}
@@ -0,0 +1,282 @@
+package gossip
+
+import (
+	"net"
+	"sync"
+
+	"go.dedis.ch/cs438/hw1/gossip/transport"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// QueuePolicy is what happens to a packet sent to a peer whose queue is full.
+type QueuePolicy int
+
+const (
+	// QueueDrop drops the packet. The anti-entropy resends the rumors lost
+	// this way.
+	QueueDrop QueuePolicy = iota
+	// QueueBlock keeps the packet until the queue has room for it. The
+	// datagrams received from the peer are not handled meanwhile, the
+	// handlers, timers and API calls do not wait. The packets past
+	// maxBlocked are dropped.
+	QueueBlock
+)
+
+// defaultQueueDepth is the number of datagrams waiting to be sent to a peer,
+// at most.
+const defaultQueueDepth = 256
+
+// maxBlocked is the number of packets waiting for room in a queue, at most.
+// The timers and API calls do not wait for a slow peer, their packets would
+// otherwise pile up.
+const maxBlocked = 64
+
+// QueueStats describes the queue of the datagrams waiting to be sent to a
+// peer.
+type QueueStats struct {
+	// Length is the number of datagrams in the queue
+	Length int
+	// MaxLength is the largest number of datagrams the queue held
+	MaxLength int
+	// Sent is the number of datagrams sent
+	Sent int
+	// Dropped is the number of datagrams dropped because the queue was full,
+	// or too many packets waited for room
+	Dropped int
+	// Blocked is the number of packets waiting for room in the queue
+	Blocked int
+}
+
+// sendQueue holds the datagrams waiting to be sent to a peer. A worker sends
+// them, one after the other, while the queue is not empty.
+type sendQueue struct {
+	sync.Mutex
+
+	to        *net.UDPAddr
+	depth     int
+	datagrams [][]byte
+	running   bool
+	closed    bool
+	stats     QueueStats
+
+	// blocked holds, in order, the packets
+	// waiting for room in the queue, and
+	// unblocked is signaled once there
+	// are none left
+	blocked   [][][]byte
+	unblocked *sync.Cond
+}
+
+func newSendQueue(to *net.UDPAddr, depth int) *sendQueue {
+	q := &sendQueue{to: to, depth: depth}
+	q.unblocked = sync.NewCond(q)
+	return q
+}
+
+// enqueue queues the datagrams of a packet for the peer, or sends them
+// directly if the queue depth is 0. The datagrams of a packet are dropped, or
+// kept until there is room, together: a part of them is of no use to the
+// peer. It never waits. It must be called with g.mux held.
+func (g *Gossiper) enqueue(datagrams [][]byte, to *net.UDPAddr) {
+
+	if g.queueDepth <= 0 {
+		for _, d := range datagrams {
+
+			err := g.transport.Send(d, to)
+
+			// Might happen once a day
+			// The peer may have closed the socket
+			if err != nil {
+				log.Error("Could not send to", to, ":", err)
+				return
+			}
+		}
+		return
+	}
+
+	// the workers are
+	// waited for by Stop
+	if g.stopped {
+		return
+	}
+
+	q, ok := g.queues[to.String()]
+	if !ok {
+		q = newSendQueue(to, g.queueDepth)
+		g.queues[to.String()] = q
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	// the worker queues the packet
+	// once there is room, after the
+	// ones already waiting
+	if g.queuePolicy == QueueBlock && (len(q.blocked) > 0 || !q.fits(datagrams)) {
+
+		// Might happen sometimes
+		// The peer is stalled
+		if len(q.blocked) >= maxBlocked {
+			q.stats.Dropped += len(datagrams)
+			log.Lvl2("Dropping packet to", to, ": too many packets waiting")
+			return
+		}
+
+		q.blocked = append(q.blocked, datagrams)
+		return
+	}
+
+	// Might happen sometimes
+	// A burst of catch ups
+	if len(q.datagrams)+len(datagrams) > g.queueDepth && len(q.datagrams) > 0 {
+		q.stats.Dropped += len(datagrams)
+		log.Lvl2("Dropping packet to", to, ": queue full")
+		return
+	}
+
+	q.datagrams = append(q.datagrams, datagrams...)
+	if len(q.datagrams) > q.stats.MaxLength {
+		q.stats.MaxLength = len(q.datagrams)
+	}
+
+	if !q.running {
+		q.running = true
+		g.senders.Add(1)
+		go g.runQueue(q, g.transport)
+	}
+}
+
+// runQueue sends the datagrams of the queue until it is empty or closed.
+func (g *Gossiper) runQueue(q *sendQueue, t transport.Transport) {
+
+	defer g.senders.Done()
+
+	for {
+		q.Lock()
+		if q.closed || len(q.datagrams) == 0 {
+			q.running = false
+			q.Unlock()
+			return
+		}
+
+		d := q.datagrams[0]
+		q.datagrams[0] = nil
+		q.datagrams = q.datagrams[1:]
+		q.unblock()
+		q.Unlock()
+
+		err := t.Send(d, q.to)
+
+		if err == transport.ErrClosed {
+			q.close()
+			return
+		}
+
+		// Might happen once a day
+		// The peer may have closed the socket
+		if err != nil {
+			log.Error("Could not send to", q.to, ":", err)
+			continue
+		}
+
+		q.Lock()
+		q.stats.Sent++
+		q.Unlock()
+	}
+}
+
+// fits tells whether the queue has room for the datagrams of a packet. A
+// packet larger than the queue only fits in an empty one. It must be called
+// with q held.
+func (q *sendQueue) fits(datagrams [][]byte) bool {
+
+	need := len(datagrams)
+	if need > q.depth {
+		need = q.depth
+	}
+
+	return len(q.datagrams)+need <= q.depth
+}
+
+// unblock queues the packets waiting for room, in order, as long as they
+// fit. It must be called with q held.
+func (q *sendQueue) unblock() {
+
+	n := 0
+	for n < len(q.blocked) && q.fits(q.blocked[n]) {
+		q.datagrams = append(q.datagrams, q.blocked[n]...)
+		q.blocked[n] = nil
+		n++
+	}
+
+	if n == 0 {
+		return
+	}
+
+	q.blocked = q.blocked[n:]
+	if len(q.datagrams) > q.stats.MaxLength {
+		q.stats.MaxLength = len(q.datagrams)
+	}
+
+	if len(q.blocked) == 0 {
+		q.unblocked.Broadcast()
+	}
+}
+
+// wait waits until no packet waits for room in the queue. It must be called
+// without q held.
+func (q *sendQueue) wait() {
+
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.blocked) > 0 && !q.closed {
+		q.unblocked.Wait()
+	}
+}
+
+// close drops the datagrams of the queue and the packets waiting for room.
+func (q *sendQueue) close() {
+
+	q.Lock()
+	defer q.Unlock()
+
+	q.closed = true
+	q.datagrams = nil
+	q.blocked = nil
+	q.unblocked.Broadcast()
+}
+
+// stopQueues closes every queue. It must be called with g.mux held, the
+// workers are waited for with g.senders once it is released.
+func (g *Gossiper) stopQueues() {
+
+	for addr, q := range g.queues {
+		q.close()
+		delete(g.queues, addr)
+	}
+}
+
+// GetQueueStats returns the state of the queue of each peer sent to.
+func (g *Gossiper) GetQueueStats() map[string]QueueStats {
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	stats := make(map[string]QueueStats, len(g.queues))
+	for addr, q := range g.queues {
+
+		q.Lock()
+		s := q.stats
+		s.Length = len(q.datagrams)
+		s.Blocked = len(q.blocked)
+		q.Unlock()
+
+		stats[addr] = s
+	}
+	return stats
+}
@@ -0,0 +1,81 @@
+package gossip
+
+import (
+	"go.dedis.ch/onet/v3/log"
+)
+
+// maxPendingRumors bounds the number of out-of-order rumors buffered for a
+// single origin.
+const maxPendingRumors = 256
+
+// pendingRumor is a rumor received before its predecessors, along with the
+// address of the peer that sent it.
+type pendingRumor struct {
+	rumor *RumorMessage
+	from  string
+}
+
+// bufferRumor keeps a rumor whose ID is ahead of the next expected one until
+// the gap is filled. It returns false if the rumor was dropped because the
+// buffer of its origin is full. It must be called with g.mux held.
+func (g *Gossiper) bufferRumor(rumor *RumorMessage, from string) bool {
+
+	buffer, ok := g.pending[rumor.Origin]
+	if !ok {
+		buffer = make(map[uint32]*pendingRumor)
+		g.pending[rumor.Origin] = buffer
+	}
+
+	if _, ok := buffer[rumor.ID]; ok {
+		return true
+	}
+
+	// Might happen sometimes
+	// The origin is far ahead or the
+	// gap is never filled
+	if len(buffer) >= maxPendingRumors {
+		log.Error("Reorder buffer full for origin", rumor.Origin)
+		return false
+	}
+
+	buffer[rumor.ID] = &pendingRumor{rumor: rumor, from: from}
+	return true
+}
+
+// popPending removes and returns, in order, the buffered rumors of origin that
+// directly follow the latest rumor received from that origin. It must be
+// called with g.mux held.
+func (g *Gossiper) popPending(origin string) []*pendingRumor {
+
+	buffer, ok := g.pending[origin]
+	if !ok {
+		return nil
+	}
+
+	ready := make([]*pendingRumor, 0)
+	for id := g.getLatest(origin) + 1; ; id++ {
+
+		p, ok := buffer[id]
+		if !ok {
+			break
+		}
+
+		delete(buffer, id)
+		ready = append(ready, p)
+	}
+
+	// drop rumors we got in
+	// the meantime by other means
+	latest := g.getLatest(origin) + uint32(len(ready))
+	for id := range buffer {
+		if id <= latest {
+			delete(buffer, id)
+		}
+	}
+
+	if len(buffer) == 0 {
+		delete(g.pending, origin)
+	}
+
+	return ready
+}
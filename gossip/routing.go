@@ -0,0 +1,132 @@
+package gossip
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"go.dedis.ch/onet/v3/log"
+)
+
+// updateRoute records that the origin can be reached through the peer that
+// sent us its rumor with the given ID. Routes are only updated by rumors more
+// recent than the one that set the current route. It must be called with
+// g.mux held.
+func (g *Gossiper) updateRoute(origin string, id uint32, from *net.UDPAddr) {
+
+	// we do not need a route to ourself
+	if origin == g.identifier {
+		return
+	}
+
+	route, ok := g.routes[origin]
+	if ok && route.LastID >= id {
+		return
+	}
+
+	g.routes[origin] = &RouteStruct{
+		NextHop: from.String(),
+		LastID:  id,
+	}
+	g.persist(routeRecord(origin, g.routes[origin]))
+
+	fmt.Fprintf(g.out, "DSDV %v %v\n", origin, from.String())
+}
+
+// nextHop returns the address of the peer to which the messages for dest
+// must be sent, or nil if no route to dest is known. It must be called with
+// g.mux held.
+func (g *Gossiper) nextHop(dest string) *net.UDPAddr {
+
+	route, ok := g.routes[dest]
+
+	if !ok {
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", route.NextHop)
+
+	// Should really never happen
+	// Routes are built from sender addresses
+	if err != nil {
+		log.Error("Error resolving next hop:", err)
+		return nil
+	}
+
+	return addr
+}
+
+// sendRouteRumor spreads a rumor with an empty text, which lets the other
+// nodes know how to reach us. It must be called with g.mux held.
+func (g *Gossiper) sendRouteRumor() {
+
+	rumor := g.newRumor("")
+
+	// Might happen sometimes
+	// No peer known yet
+	if !g.disseminate(rumor) {
+		log.Lvl2("No receiver found for route rumor")
+	}
+}
+
+// startRouteRumors sends a route rumor at startup and then every routeTimer
+// seconds, until the gossiper stops. A routeTimer of 0 disables the route
+// rumors. It must be called with g.mux held.
+func (g *Gossiper) startRouteRumors() {
+
+	if g.routeTimer <= 0 {
+		return
+	}
+
+	g.sendRouteRumor()
+
+	var tick func()
+	tick = func() {
+
+		g.mux.Lock()
+		defer g.mux.Unlock()
+
+		if g.stopped {
+			return
+		}
+
+		g.sendRouteRumor()
+		g.routeRumorTimer = g.clock.AfterFunc(time.Duration(g.routeTimer)*time.Second, tick)
+	}
+
+	g.routeRumorTimer = g.clock.AfterFunc(time.Duration(g.routeTimer)*time.Second, tick)
+}
+
+// GetRoutingTable implements gossip.BaseGossiper. It returns the known routes.
+func (g *Gossiper) GetRoutingTable() map[string]*RouteStruct {
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	// return a copy, the routes keep
+	// changing while the caller reads them
+	cpy := make(map[string]*RouteStruct, len(g.routes))
+	for origin, route := range g.routes {
+		cpy[origin] = &RouteStruct{
+			NextHop: route.NextHop,
+			LastID:  route.LastID,
+		}
+	}
+	return cpy
+}
+
+// GetDirectNodes implements gossip.BaseGossiper. It returns the list of nodes whose routes are known to this node
+func (g *Gossiper) GetDirectNodes() []string {
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	origins := make([]string, 0, len(g.routes))
+	for origin := range g.routes {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	return origins
+}
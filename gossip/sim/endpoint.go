@@ -0,0 +1,52 @@
+package sim
+
+import (
+	"net"
+	"sync"
+
+	"go.dedis.ch/cs438/hw1/gossip/transport"
+)
+
+// endpoint is the transport of a node. The simulator pushes the packets to
+// the gossiper with Process, so Receive only waits for the endpoint to be
+// closed.
+//
+// - implements transport.Transport
+type endpoint struct {
+	sim  *Simulator
+	addr *net.UDPAddr
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Send implements transport.Transport
+func (e *endpoint) Send(b []byte, to *net.UDPAddr) error {
+	select {
+	case <-e.closed:
+		return transport.ErrClosed
+	default:
+	}
+
+	e.sim.route(b, e.addr, to)
+	return nil
+}
+
+// Receive implements transport.Transport
+func (e *endpoint) Receive(b []byte) (int, *net.UDPAddr, error) {
+	<-e.closed
+	return 0, nil, transport.ErrClosed
+}
+
+// Close implements transport.Transport
+func (e *endpoint) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.closed)
+	})
+	return nil
+}
+
+// LocalAddr implements transport.Transport
+func (e *endpoint) LocalAddr() *net.UDPAddr {
+	return e.addr
+}
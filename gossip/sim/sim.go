@@ -0,0 +1,476 @@
+// Package sim runs many gossipers in one process on a virtual time. The
+// gossipers exchange their packets through the simulator, which delivers them
+// as events of a virtual clock. A run only depends on the seed of the
+// simulator, so that it can be replayed.
+package sim
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"go.dedis.ch/cs438/hw1/gossip"
+	"go.dedis.ch/cs438/hw1/gossip/clock"
+	"go.dedis.ch/cs438/hw1/topology"
+	"golang.org/x/xerrors"
+)
+
+// basePort is the port of the first node. Nodes are given consecutive ports
+// on the loopback address, which are never listened to.
+const basePort = 10000
+
+// Node is a gossiper of the simulation.
+type Node struct {
+	Name     string
+	Addr     string
+	Gossiper *gossip.Gossiper
+
+	endpoint *endpoint
+}
+
+// Stats counts the packets exchanged during a simulation.
+type Stats struct {
+	// Sent is the number of packets sent by the gossipers
+	Sent int
+	// Delivered is the number of packets handled by a gossiper
+	Delivered int
+	// Dropped is the number of packets lost on the way
+	Dropped int
+	// Bytes is the total size of the packets sent
+	Bytes int
+}
+
+// Report is the cost of spreading the messages added through the simulator
+// to every node.
+type Report struct {
+	// Converged tells whether every node got every message in time
+	Converged bool
+	// Elapsed is the virtual time it took
+	Elapsed time.Duration
+	// Stats counts the packets exchanged meanwhile
+	Stats Stats
+	// Overhead is the number of packets sent for each message a node got
+	// from another
+	Overhead float64
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("converged %v after %v, %d packets, %d bytes, overhead %.2f",
+		r.Converged, r.Elapsed, r.Stats.Sent, r.Stats.Bytes, r.Overhead)
+}
+
+// Simulator runs gossipers on a virtual time. It is not meant to be used by
+// several routines: the nodes are driven by the routine calling Run or
+// RunUntil.
+type Simulator struct {
+	sync.Mutex
+
+	clock *clock.Virtual
+	start time.Time
+	ran   *rand.Rand
+
+	dropRate   float64
+	minLatency time.Duration
+	maxLatency time.Duration
+
+	nodes  []*Node
+	byName map[string]*Node
+	byAddr map[string]*Node
+
+	// expected holds, for each origin, the ID of the last message
+	// added through the simulator
+	expected map[string]uint32
+
+	// added counts the messages added through the simulator, measured
+	// holds the state of the simulation at the end of the last measure
+	added    int
+	measured measure
+
+	stats Stats
+	trace hash.Hash
+}
+
+// New returns a simulator whose random choices, and those of its nodes, are
+// drawn from the given seed. Packets take 10ms to arrive and are never lost
+// by default.
+func New(seed int64) *Simulator {
+
+	start := time.Unix(0, 0)
+
+	return &Simulator{
+		clock:      clock.NewVirtual(start),
+		start:      start,
+		ran:        rand.New(rand.NewSource(seed)),
+		minLatency: 10 * time.Millisecond,
+		maxLatency: 10 * time.Millisecond,
+		byName:     make(map[string]*Node),
+		byAddr:     make(map[string]*Node),
+		expected:   make(map[string]uint32),
+		trace:      sha256.New(),
+	}
+}
+
+// SetDropRate sets the probability, between 0 and 1, that a packet is lost.
+func (s *Simulator) SetDropRate(rate float64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.dropRate = rate
+}
+
+// SetLatency sets the bounds of the delay of each packet. The delay is drawn
+// uniformly for every packet, so packets can arrive out of order when max is
+// greater than min.
+func (s *Simulator) SetLatency(min, max time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.minLatency = min
+	s.maxLatency = max
+}
+
+// AddNode creates a gossiper with the given name. The options are applied
+// after the ones of the simulator, the output of the gossiper is discarded
+// unless gossip.WithOutput is given.
+func (s *Simulator) AddNode(name string, antiEntropy, routeTimer int, opts ...gossip.Option) (*Node, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.byName[name]; ok {
+		return nil, xerrors.Errorf("node already exists: %v", name)
+	}
+
+	addr := &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: basePort + len(s.nodes),
+	}
+
+	e := &endpoint{
+		sim:    s,
+		addr:   addr,
+		closed: make(chan struct{}),
+	}
+
+	seed := make([]byte, ed25519.SeedSize)
+	s.ran.Read(seed)
+
+	boxSeed := make([]byte, 32)
+	s.ran.Read(boxSeed)
+
+	// Should really never happen
+	boxKey, err := ecdh.X25519().NewPrivateKey(boxSeed)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create box key: %v", err)
+	}
+
+	defaults := []gossip.Option{
+		gossip.WithClock(s.clock),
+		gossip.WithSeed(s.ran.Int63()),
+		gossip.WithKey(ed25519.NewKeyFromSeed(seed)),
+		gossip.WithBoxKey(boxKey),
+		gossip.WithEntropy(rand.New(rand.NewSource(s.ran.Int63()))),
+		gossip.WithOutput(ioutil.Discard),
+		gossip.WithTransport(e),
+		gossip.WithSendQueue(0, gossip.QueueDrop),
+	}
+
+	g, err := gossip.NewGossiper(addr.String(), name, antiEntropy, routeTimer,
+		append(defaults, opts...)...)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create gossiper: %v", err)
+	}
+
+	n := &Node{
+		Name:     name,
+		Addr:     addr.String(),
+		Gossiper: g.(*gossip.Gossiper),
+		endpoint: e,
+	}
+
+	s.nodes = append(s.nodes, n)
+	s.byName[name] = n
+	s.byAddr[n.Addr] = n
+
+	return n, nil
+}
+
+// Node returns the node with the given name, or nil.
+func (s *Simulator) Node(name string) *Node {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.byName[name]
+}
+
+// Nodes returns the nodes in the order they were added.
+func (s *Simulator) Nodes() []*Node {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]*Node(nil), s.nodes...)
+}
+
+// Connect gives the address of the node named to to the node named from, like
+// the peers given on the command line.
+func (s *Simulator) Connect(from, to string) error {
+
+	a := s.Node(from)
+	b := s.Node(to)
+
+	if a == nil || b == nil {
+		return xerrors.Errorf("unknown node: %v or %v", from, to)
+	}
+
+	return a.Gossiper.AddAddresses(b.Addr)
+}
+
+// AddTopology adds the nodes of the topology, with their anti-entropy and
+// route timer, and connects them along its edges. The addresses of the
+// topology are ignored, the simulator gives its own.
+func (s *Simulator) AddTopology(t *topology.Topology, opts ...gossip.Option) error {
+
+	for _, n := range t.Nodes {
+		_, err := s.AddNode(n.Name, n.AntiEntropy, n.RouteTimer, opts...)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, e := range t.Edges {
+
+		// a peer given twice
+		// is only added once
+		err := s.Connect(e.From, e.To)
+		if err != nil {
+			return xerrors.Errorf("failed to connect %v to %v: %v", e.From, e.To, err)
+		}
+	}
+
+	return nil
+}
+
+// Start starts every node, in the order they were added.
+func (s *Simulator) Start() {
+	for _, n := range s.Nodes() {
+		n.Gossiper.Start()
+	}
+}
+
+// Stop stops every node.
+func (s *Simulator) Stop() {
+	for _, n := range s.Nodes() {
+		n.Gossiper.Stop()
+	}
+}
+
+// AddMessage makes the node with the given name spread a rumor. The rumor is
+// expected to reach every node, see Converged.
+func (s *Simulator) AddMessage(name, text string) (uint32, error) {
+
+	n := s.Node(name)
+	if n == nil {
+		return 0, xerrors.Errorf("unknown node: %v", name)
+	}
+
+	id := n.Gossiper.AddMessage(text)
+
+	s.Lock()
+	s.expected[n.Gossiper.GetIdentifier()] = id
+	s.added++
+	s.Unlock()
+
+	return id, nil
+}
+
+// Now returns the virtual time elapsed since the start of the simulation.
+func (s *Simulator) Now() time.Duration {
+	return s.clock.Now().Sub(s.start)
+}
+
+// Run runs the simulation for the given duration of virtual time.
+func (s *Simulator) Run(d time.Duration) {
+	s.clock.Advance(d)
+}
+
+// RunUntil runs the simulation until cond holds, for at most max of virtual
+// time. The condition is checked each time the virtual time advances. It
+// returns the elapsed virtual time since the start of the simulation and
+// whether cond holds.
+func (s *Simulator) RunUntil(cond func() bool, max time.Duration) (time.Duration, bool) {
+
+	deadline := s.clock.Now().Add(max)
+
+	for {
+		if cond() {
+			return s.Now(), true
+		}
+
+		now := s.clock.Now()
+		for {
+			next, ok := s.clock.Next()
+			if !ok || next.After(now) {
+				break
+			}
+			s.clock.Step()
+		}
+
+		next, ok := s.clock.Next()
+		if !ok || next.After(deadline) {
+			s.clock.RunUntil(deadline)
+			return s.Now(), cond()
+		}
+
+		s.clock.Step()
+	}
+}
+
+// Converged tells whether every node has every message added through
+// AddMessage.
+func (s *Simulator) Converged() bool {
+
+	s.Lock()
+	expected := make(map[string]uint32, len(s.expected))
+	for origin, id := range s.expected {
+		expected[origin] = id
+	}
+	s.Unlock()
+
+	for _, n := range s.Nodes() {
+
+		next := make(map[string]uint32)
+		for _, status := range n.Gossiper.GetStatus() {
+			next[status.Identifier] = status.NextID
+		}
+
+		for origin, id := range expected {
+			if next[origin] <= id {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// measure is the state of a simulation a report is computed from.
+type measure struct {
+	now   time.Duration
+	added int
+	stats Stats
+}
+
+// Measure runs the simulation until it converges, for at most max of virtual
+// time, and reports the cost of spreading the messages added since the
+// previous measure, or since the start of the simulation.
+func (s *Simulator) Measure(max time.Duration) Report {
+
+	s.Lock()
+	from := s.measured
+	s.Unlock()
+
+	_, ok := s.RunUntil(s.Converged, max)
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.measured = measure{now: s.Now(), added: s.added, stats: s.stats}
+
+	r := Report{
+		Converged: ok,
+		Elapsed:   s.measured.now - from.now,
+		Stats: Stats{
+			Sent:      s.stats.Sent - from.stats.Sent,
+			Delivered: s.stats.Delivered - from.stats.Delivered,
+			Dropped:   s.stats.Dropped - from.stats.Dropped,
+			Bytes:     s.stats.Bytes - from.stats.Bytes,
+		},
+	}
+
+	received := (s.added - from.added) * (len(s.nodes) - 1)
+	if received > 0 {
+		r.Overhead = float64(r.Stats.Sent) / float64(received)
+	}
+
+	return r
+}
+
+// Stats returns the packets counted so far.
+func (s *Simulator) Stats() Stats {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.stats
+}
+
+// TraceHash returns a digest of every packet delivered so far, along with
+// its time, sender and receiver. Two runs with the same seed and the same
+// calls give the same digest.
+func (s *Simulator) TraceHash() string {
+	s.Lock()
+	defer s.Unlock()
+
+	return hex.EncodeToString(s.trace.Sum(nil))
+}
+
+// route decides the fate of a packet and schedules its delivery.
+func (s *Simulator) route(b []byte, from, to *net.UDPAddr) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.stats.Sent++
+	s.stats.Bytes += len(b)
+
+	dst, ok := s.byAddr[to.String()]
+
+	// like UDP, sending to nobody is not an error
+	if !ok || s.dropRate > 0 && s.ran.Float64() < s.dropRate {
+		s.stats.Dropped++
+		return
+	}
+
+	latency := s.minLatency
+	if s.maxLatency > s.minLatency {
+		latency += time.Duration(s.ran.Int63n(int64(s.maxLatency - s.minLatency)))
+	}
+
+	// the sender may reuse its buffer
+	packet := append([]byte(nil), b...)
+
+	s.clock.AfterFunc(latency, func() {
+		s.deliver(packet, from, dst)
+	})
+}
+
+// deliver records the packet in the trace and gives it to its receiver.
+func (s *Simulator) deliver(b []byte, from *net.UDPAddr, dst *Node) {
+
+	select {
+	case <-dst.endpoint.closed:
+		return
+	default:
+	}
+
+	s.Lock()
+	s.stats.Delivered++
+
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(s.Now()))
+	s.trace.Write(t[:])
+	fmt.Fprintf(s.trace, "%v>%v:", from, dst.Addr)
+	s.trace.Write(b)
+	s.Unlock()
+
+	// the handlers send packets
+	dst.Gossiper.Process(b, from)
+}
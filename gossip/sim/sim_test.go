@@ -0,0 +1,273 @@
+package sim
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cs438/hw1/gossip"
+	"go.dedis.ch/cs438/hw1/topology"
+)
+
+// build creates n nodes on a ring, with a few random chords, and adds a
+// message on every tenth node.
+func build(t *testing.T, seed int64, n int, opts ...gossip.Option) *Simulator {
+	s := New(seed)
+	s.SetLatency(5*time.Millisecond, 50*time.Millisecond)
+
+	for i := 0; i < n; i++ {
+		_, err := s.AddNode(fmt.Sprintf("N%d", i), 1, 0, opts...)
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < n; i++ {
+		a := fmt.Sprintf("N%d", i)
+		b := fmt.Sprintf("N%d", (i+1)%n)
+		c := fmt.Sprintf("N%d", (i+n/3)%n)
+
+		require.NoError(t, s.Connect(a, b))
+		require.NoError(t, s.Connect(b, a))
+		require.NoError(t, s.Connect(a, c))
+	}
+
+	s.Start()
+
+	for i := 0; i < n; i += 10 {
+		_, err := s.AddMessage(fmt.Sprintf("N%d", i), fmt.Sprintf("hello from N%d", i))
+		require.NoError(t, err)
+	}
+
+	return s
+}
+
+// Test that a 100 nodes network converges in virtual time
+func TestSim_100Nodes_Converge(t *testing.T) {
+	s := build(t, 1, 100)
+	defer s.Stop()
+
+	start := time.Now()
+	elapsed, ok := s.RunUntil(s.Converged, 5*time.Minute)
+	require.True(t, ok)
+
+	t.Logf("converged after %v of virtual time, %v of wall time, %+v",
+		elapsed, time.Since(start), s.Stats())
+}
+
+// Test that a lossy network converges thanks to the anti-entropy
+func TestSim_Lossy_Converge(t *testing.T) {
+	s := build(t, 2, 30)
+	defer s.Stop()
+
+	s.SetDropRate(0.2)
+
+	_, ok := s.RunUntil(s.Converged, 5*time.Minute)
+	require.True(t, ok)
+	require.Greater(t, s.Stats().Dropped, 0)
+}
+
+// Test that the binary format saves bandwidth
+func TestSim_WireFormat_Bytes(t *testing.T) {
+	run := func(f gossip.WireFormat) Stats {
+		s := build(t, 7, 50, gossip.WithWireFormat(f))
+		defer s.Stop()
+
+		_, ok := s.RunUntil(s.Converged, 5*time.Minute)
+		require.True(t, ok)
+
+		s.Run(10 * time.Second)
+		return s.Stats()
+	}
+
+	jsonStats := run(gossip.WireJSON)
+	binaryStats := run(gossip.WireBinary)
+
+	t.Logf("JSON %+v, binary %+v", jsonStats, binaryStats)
+	require.Less(t, binaryStats.Bytes, jsonStats.Bytes/2)
+}
+
+// Test that the digests converge and save bandwidth once the network is in
+// sync
+func TestSim_AntiEntropyDigest_Bytes(t *testing.T) {
+	run := func(mode gossip.AntiEntropyMode) (time.Duration, Stats) {
+		s := build(t, 11, 100, gossip.WithAntiEntropyMode(mode))
+		defer s.Stop()
+
+		s.SetDropRate(0.1)
+
+		elapsed, ok := s.RunUntil(s.Converged, 5*time.Minute)
+		require.True(t, ok)
+
+		before := s.Stats()
+		s.Run(30 * time.Second)
+		after := s.Stats()
+
+		after.Sent -= before.Sent
+		after.Delivered -= before.Delivered
+		after.Dropped -= before.Dropped
+		after.Bytes -= before.Bytes
+		return elapsed, after
+	}
+
+	statusElapsed, statusStats := run(gossip.AntiEntropyStatus)
+	digestElapsed, digestStats := run(gossip.AntiEntropyDigest)
+
+	t.Logf("in sync: status %+v, digest %+v", statusStats, digestStats)
+	t.Logf("converged: status after %v, digest after %v", statusElapsed, digestElapsed)
+	require.Less(t, digestStats.Bytes, statusStats.Bytes/2)
+}
+
+// Test that once the trees are built, plumtree spreads new rumors faster and
+// with less traffic than rumormongering
+func TestSim_Plumtree_Converge(t *testing.T) {
+	run := func(mode gossip.DisseminationMode) (time.Duration, Stats) {
+		s := build(t, 13, 100, gossip.WithDissemination(mode))
+		defer s.Stop()
+
+		_, ok := s.RunUntil(s.Converged, 5*time.Minute)
+		require.True(t, ok)
+
+		before := s.Stats()
+
+		for i := 0; i < 100; i += 10 {
+			_, err := s.AddMessage(fmt.Sprintf("N%d", i), fmt.Sprintf("hello again from N%d", i))
+			require.NoError(t, err)
+		}
+
+		start := s.Now()
+		_, ok = s.RunUntil(s.Converged, 5*time.Minute)
+		require.True(t, ok)
+
+		after := s.Stats()
+		after.Sent -= before.Sent
+		after.Delivered -= before.Delivered
+		after.Dropped -= before.Dropped
+		after.Bytes -= before.Bytes
+		return s.Now() - start, after
+	}
+
+	mongeringElapsed, mongeringStats := run(gossip.DisseminationMongering)
+	plumtreeElapsed, plumtreeStats := run(gossip.DisseminationPlumtree)
+
+	t.Logf("mongering after %v %+v, plumtree after %v %+v",
+		mongeringElapsed, mongeringStats, plumtreeElapsed, plumtreeStats)
+	require.Less(t, int64(plumtreeElapsed), int64(mongeringElapsed))
+	require.Less(t, plumtreeStats.Bytes, mongeringStats.Bytes)
+}
+
+// Test that every configuration of the gossip parameters converges, and
+// report the cost of each
+func TestSim_GossipParameters_Report(t *testing.T) {
+	configs := []struct {
+		name string
+		opts []gossip.Option
+	}{
+		{"default", nil},
+		{"fanout 3", []gossip.Option{gossip.WithFanout(3)}},
+		{"anti-entropy peers 3", []gossip.Option{gossip.WithAntiEntropyPeers(3)}},
+		{"push", []gossip.Option{gossip.WithSyncMode(gossip.SyncPush)}},
+		{"pull", []gossip.Option{gossip.WithSyncMode(gossip.SyncPull)}},
+		{"fanout 2, pull", []gossip.Option{gossip.WithFanout(2), gossip.WithSyncMode(gossip.SyncPull)}},
+	}
+
+	reports := make(map[string]Report)
+
+	for _, c := range configs {
+		s := build(t, 17, 100, c.opts...)
+		s.SetDropRate(0.05)
+
+		r := s.Measure(5 * time.Minute)
+		s.Stop()
+
+		t.Logf("%s: %v", c.name, r)
+		require.True(t, r.Converged, c.name)
+		reports[c.name] = r
+	}
+
+	require.Less(t, int64(reports["fanout 3"].Elapsed), int64(reports["default"].Elapsed))
+}
+
+// Test that two runs with the same seed are identical, and that another seed
+// gives another run
+func TestSim_Replay(t *testing.T) {
+	run := func(seed int64) (time.Duration, string) {
+		s := build(t, seed, 30)
+		defer s.Stop()
+
+		elapsed, ok := s.RunUntil(s.Converged, 5*time.Minute)
+		require.True(t, ok)
+
+		s.Run(10 * time.Second)
+
+		return elapsed, s.TraceHash()
+	}
+
+	elapsed1, hash1 := run(42)
+	elapsed2, hash2 := run(42)
+	_, hash3 := run(43)
+
+	require.Equal(t, elapsed1, elapsed2)
+	require.Equal(t, hash1, hash2)
+	require.NotEqual(t, hash1, hash3)
+}
+
+// Test that the encrypted private messages are replayed too
+func TestSim_Replay_PrivateMessages(t *testing.T) {
+	topo, err := topology.Parse(strings.NewReader(`
+		graph line {
+			antiEntropy=1;
+			rtimer=1;
+			A -- B -- C;
+		}`))
+	require.NoError(t, err)
+
+	run := func() string {
+		s := New(5)
+		require.NoError(t, s.AddTopology(topo))
+		s.Start()
+		defer s.Stop()
+
+		a := s.Node("A").Gossiper
+
+		_, ok := s.RunUntil(func() bool {
+			_, ok := a.GetRoutingTable()["C"]
+			return ok
+		}, time.Minute)
+		require.True(t, ok)
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, a.AddPrivateMessage(fmt.Sprintf("secret %d", i), "C", "A", 10))
+		}
+		s.Run(time.Second)
+
+		return s.TraceHash()
+	}
+
+	require.Equal(t, run(), run())
+}
+
+// Test that the nodes of a topology file get their routes
+func TestSim_Topology(t *testing.T) {
+	topo, err := topology.Parse(strings.NewReader(`
+		graph line {
+			antiEntropy=1;
+			rtimer=1;
+			A -- B -- C -- D -- E;
+		}`))
+	require.NoError(t, err)
+
+	s := New(1)
+	require.NoError(t, s.AddTopology(topo))
+	s.Start()
+	defer s.Stop()
+
+	a := s.Node("A").Gossiper
+
+	_, ok := s.RunUntil(func() bool {
+		return len(a.GetDirectNodes()) == 4
+	}, time.Minute)
+	require.True(t, ok)
+
+	require.Equal(t, s.Node("B").Addr, a.GetRoutingTable()["E"].NextHop)
+}
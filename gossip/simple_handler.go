@@ -6,8 +6,9 @@ package gossip
 import (
 	"net"
 	"fmt"
-	"golang.org/x/xerrors"
+
 	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
 )
 
 // Exec is the function that the gossiper uses to execute the handler for a SimpleMessage
@@ -16,7 +17,7 @@ import (
 // - update the relay field
 func (msg *SimpleMessage) Exec(g *Gossiper, addr *net.UDPAddr) error {
 
-	fmt.Printf("SIMPLE MESSAGE origin %v from %v contents %v\n", 
+	fmt.Fprintf(g.out, "SIMPLE MESSAGE origin %v from %v contents %v\n", 
 		msg.OriginPeerName, msg.RelayPeerAddr, msg.Contents)
 
 	var new_msg = SimpleMessage {
@@ -29,10 +30,7 @@ func (msg *SimpleMessage) Exec(g *Gossiper, addr *net.UDPAddr) error {
 		Simple: &new_msg,
 	}
 
-	// the callback might block or be very long
-	if g.callback != nil {
-		go g.callback(msg.OriginPeerName, packet)
-	}
+	g.notify(msg.OriginPeerName, packet)
 
 	// asynchronous because the Run()
 	// method wants to go back to
@@ -40,7 +38,7 @@ func (msg *SimpleMessage) Exec(g *Gossiper, addr *net.UDPAddr) error {
 
 	// Todo: call the watcher here or
 	// not ?
-	go g.broadcast(packet, msg.RelayPeerAddr)
+	g.broadcast(packet, msg.RelayPeerAddr)
 
 	// The call is synchronous because
 	// later in this thread we want to
@@ -56,112 +54,148 @@ func (msg *SimpleMessage) Exec(g *Gossiper, addr *net.UDPAddr) error {
 // Exec is the function that the gossiper uses to execute the handler for a RumorMessage
 func (msg *RumorMessage) Exec(g *Gossiper, addr *net.UDPAddr) error {
 
-	fmt.Printf("RUMOR origin %v from %v ID %v contents %v\n", 
-		msg.Origin, addr.String(), msg.ID, msg.Text)
+	ack, err := g.receiveRumor(msg, addr)
+	if err != nil {
+		return err
+	}
 
-	// if message not received before (lower , equal, greater than current sequence number)
-	//   send to random peer (blacklist the current one)
-	//   add the current peer to list
+	if ack {
+		g.sendStatus(addr)
+	}
 
-	var packet = GossipPacket {
-		Rumor: msg,
+	// Todo: make sure it is the addr
+	// and not the origin of the message
+	g.addAddress(addr)
+
+	return nil
+}
+
+// receiveRumor handles a rumor sent by addr, and tells whether the sender
+// must be acknowledged with our status. It must be called with g.mux held.
+func (g *Gossiper) receiveRumor(msg *RumorMessage, addr *net.UDPAddr) (bool, error) {
+
+	// a forged rumor must neither be
+	// stored nor change the routes. An
+	// honest relay may forward one whose
+	// origin changed its key
+	err := g.verifyRumor(msg)
+	if err != nil {
+		if !xerrors.Is(err, errOtherKey) && !xerrors.Is(err, errUnsigned) {
+			g.strike(addr)
+		}
+		return false, xerrors.Errorf("dropping rumor from %v: %v", addr, err)
 	}
 
-	// Todo: what to do when sequence 
-	// number is strictly greater than
-	// last seq number
+	// the anti-entropy gets the rumors
+	// dropped once the origin slows down
+	if msg.ID > g.getLatest(msg.Origin) && !g.admitOrigin(msg.Origin) {
+		log.Lvl2("Dropping rumor from", addr, ": too many rumors from", msg.Origin)
+		return false, nil
+	}
+
+	fmt.Fprintf(g.out, "RUMOR origin %v from %v ID %v contents %v\n", 
+		msg.Origin, addr.String(), msg.ID, msg.Text)
+
+	// any rumor more recent than the one
+	// that set the route updates it, even
+	// if it arrives out of order
+	g.updateRoute(msg.Origin, msg.ID, addr)
 
 	latest := g.getLatest(msg.Origin)
-	if latest + 1 != msg.ID {return nil}
 
-	// the callback might block or be very long
-	if g.callback != nil {
-		go g.callback(msg.Origin, packet)
+	if g.dissemination == DisseminationPlumtree {
+		g.receivePlumtree(msg, addr)
 	}
 
-	// Todo factor sendRumor
-	// in a function
-
-	// Todo: ask if the blacklist
-	// is necessary, can we send 
-	// back the gossip to the same 
-	// guy (would cause a loop)
-	receiver := g.randomPeer(addr.String())
-	if receiver != nil {
-
-		// asynchronous because the Run()
-		// method wants to go back to
-		// listening to new messages
-		go g.send(packet, receiver)
-
-		// Todo: mutex ?
-		// Todo: use ID or IP
-		// Todo: what id there are
-		// more than 1 rumor buffered
-		// How to identify rumors ?
-		// use a queue
-		// use ticker, select ... case
-
-		/*
-
-		go func {
-
-			select
-				case done
-					return
-				case timeout 
-					msg.Exec()
-		}
+	if latest + 1 == msg.ID {
 
-		*/
+		g.deliverRumor(msg, addr.String())
 
-		// g.mongering[receiver.String()] = msg
+		// the rumors buffered so far
+		// may directly follow this one
+		for _, p := range g.popPending(msg.Origin) {
+			g.deliverRumor(p.rumor, p.from)
+		}
 
-		// go func() {
-			
-		// 	time.Sleep(10 * time.Second)
-		// 	if _, ok := g.mongering[receiver.String()]; ok {
+	} else if latest + 1 < msg.ID {
 
-		// 		delete(g.mongering, receiver.String())
-		// 	}
-		// }()
+		// the status we send below asks
+		// the sender for the missing ones
+		g.bufferRumor(msg, addr.String())
 	}
 
-	g.addMessage(msg.Origin, msg.Text)
+	// acknowledge also rumors we already
+	// have, otherwise the sender would
+	// wait for the timeout and keep
+	// mongering them. The tree pushes
+	// rumors without waiting for acks
+	return g.dissemination != DisseminationPlumtree || latest + 1 < msg.ID, nil
+}
 
-	// Todo: make this piece
-	// asynchronous, but do not
-	// forget mutexes
-	want := g.map2slice()
-	
-	packet = GossipPacket {
-		Status: &StatusPacket {
-			Want: want,
-		},
-	}
+// Exec is the function that the gossiper uses to execute the handler for a
+// BatchPacket. The rumors are handled in order, the forged ones are dropped,
+// and acknowledged together once the status of the sender is handled.
+func (msg *BatchPacket) Exec(g *Gossiper, addr *net.UDPAddr) error {
 
-	go g.send(packet, addr)
+	ack := false
+
+	for _, rumor := range msg.Rumors {
+
+		a, err := g.receiveRumor(rumor, addr)
+
+		// Might happen sometimes
+		// The other rumors may be valid
+		if err != nil {
+			log.Error("Error executing handler:", err)
+			continue
+		}
+
+		ack = ack || a
+	}
 
-	// Todo: make sure it is the addr
-	// and not the origin of the message
 	g.addAddress(addr)
 
-	// Todo: launch the timer
-	// if nothing received after
-	// 10 seconds
+	// the status is answered
+	// with the acknowledgement
+	if msg.Status != nil {
+		status := *msg.Status
+		status.Probe = status.Probe || ack
+		return status.Exec(g, addr)
+	}
 
-	// add it to the queue maybe ?
-	// idk
+	if ack {
+		g.sendStatus(addr)
+	}
 
 	return nil
 }
 
+// deliverRumor stores the rumor, which must be the next one expected from its
+// origin, notifies the callback and spreads the rumor to the peers other than
+// the one it came from. It must be called with g.mux held.
+func (g *Gossiper) deliverRumor(msg *RumorMessage, from string) {
+
+	g.addMessage(msg)
+	g.delivered(msg)
+
+	// route rumors have no text and are
+	// not shown to the user. Callbacks are
+	// called in order, the buffered rumors
+	// keep their order
+	if msg.Text != "" {
+		g.notify(msg.Origin, GossipPacket{Rumor: msg})
+	}
+
+	// do not send the rumor back to
+	// the sender, it already has it
+	g.disseminate(msg, from)
+}
+
 // Exec is the function that the gossiper uses to execute the handler for a StatusMessage
+// Both sides of the exchange may miss messages at the same time: we ask the
+// peer for the messages we miss by sending our status, and send the peer the
+// messages it misses, in order and at a limited pace.
 func (msg *StatusPacket) Exec(g *Gossiper, addr *net.UDPAddr) error {
-	
-	// Todo: what happens if
-	// S has new messages AND 
-	// R has new messages
 
 	g.addAddress(addr)
 
@@ -169,112 +203,65 @@ func (msg *StatusPacket) Exec(g *Gossiper, addr *net.UDPAddr) error {
 	var needed = false
 
 	// Todo: lock the stdout when printing
-	fmt.Printf("STATUS from %v", addr.String())
+	fmt.Fprintf(g.out, "STATUS from %v", addr.String())
 
 	for _, i := range msg.Want {
 
-		val, ok := g.messages[i.Identifier]
-		if !ok || uint32(len(val) + 1) < i.NextID {
+		if g.getLatest(i.Identifier) + 1 < i.NextID {
 			needed = true
 		}
 
-		fmt.Printf(" peer %v nextID %v", i.Identifier, i.NextID)
+		fmt.Fprintf(g.out, " peer %v nextID %v", i.Identifier, i.NextID)
 		mp[i.Identifier] = i.NextID
 	}
-	fmt.Println()
-
-	// receiver has other new messages
-	if needed {
-
-		// Todo: make this piece
-		// asynchronous, but do not
-		// forget mutexes
-		want := g.map2slice()
-		
-		packet := GossipPacket {
-			Status: &StatusPacket {
-				Want: want,
-			},
-		}
-
-		go g.send(packet, addr)
+	fmt.Fprintln(g.out)
+
+	// the rumors the peer now has are
+	// not waiting for an ack anymore
+	acked := g.ackRumors(addr.String(), mp)
+
+	// the peer has new messages, or
+	// checks that we are alive. A peer
+	// that pushes them waits for us to
+	// pull, one that pulls keeps them
+	if needed && msg.Push {
+		g.send(GossipPacket{Status: &StatusPacket{Want: g.map2slice(), Pull: true}}, addr)
+	} else if (needed && !msg.Pull) || msg.Probe {
+		g.sendStatus(addr)
 	}
 
-	var has int = 0
+	// we have new messages for the peer,
+	// the statuses acknowledging a running
+	// catch up must not start another one.
+	// A peer that pushes does not take them
+	missing := g.missingRumors(mp)
+	if len(missing) > 0 && !msg.Push && !g.catchingUp(addr.String(), mp) {
+		g.catchUp(addr, missing)
+	}
 
-	// Todo: lock the messages ???
-	for key, value := range g.messages {
+	if len(missing) == 0 && !needed {
 
-		var start uint32 = 1
-		v, ok := mp[key]
+		fmt.Fprintf(g.out, "IN SYNC WITH %v\n", addr.String())
 
-		if ok {
-			start = v
+		// keep spreading each acknowledged
+		// rumor with probability 1/2
+		for _, rumor := range acked {
 
-			// Sanity check
-			// Might happen sometimes
-			if v == 1 {
-				log.Error("v is equal to 1 in status exec")
+			if !g.flipCoin() {
+				continue
 			}
-		}
 
-		for i := start; i < uint32(len(value) + 1); i++ {
+			receiver := g.randomPeer(addr.String())
 
-			has++;
-			
-			var packet = GossipPacket {
-				Rumor: &RumorMessage {
-					Origin: g.identifier,
-					ID: i,
-					Text: value[i - 1],
-				},
+			// Might happen sometimes
+			if receiver == nil {
+				continue
 			}
 
-			// Todo: the receiver must
-			// not send back a status
-			// in this case, other wise
-			// sender sends duplicates
-			// (a lot)
-
-			// asynchronous because the Run()
-			// method wants to go back to
-			// listening to new messages
-			go g.send(packet, addr)
+			fmt.Fprintf(g.out, "FLIPPED COIN sending rumor to %v\n", receiver.String())
+			g.monger(rumor, receiver)
 		}
 	}
 
-	if has == 0 && !needed /*&& g.ran.Intn(2) == 0*/ {
-
-		fmt.Printf("IN SYNC WITH %v\n", addr.String())
-
-		// Todo: is this a typo ?`
-		if g.ran.Intn(2) == 0 {
-			fmt.Printf("FLIPPED COIN sending rumor to\n")
-		}
-
-		// Todo: how to remember the gossip msg ???
-		// if entry in the mongo table
-
-		// packet := GossipPacket{}
-
-		// receiver := g.randomPeer(addr.String())
-
-		// // Might happen once a day
-		// if receiver == nil {
-		// 	log.Error("No receiver found")
-		// 	return xerrors.Errorf("No receiver found")
-		// }
-
-		// // asynchronous because the Run()
-		// // method wants to go back to
-		// // listening to new messages
-		// go g.send(packet, receiver)
-	}
-
 	return nil
 }
-
-// Exec is the function that the gossiper uses to execute the handler for a PrivateMessage
-func (msg *PrivateMessage) Exec(g *Gossiper, addr *net.UDPAddr) error {
-	return xerrors.Errorf("Implement me")
-}
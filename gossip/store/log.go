@@ -0,0 +1,269 @@
+// Package store keeps the state of a gossiper on disk in an append-only log,
+// so that a node restarts where it stopped.
+//
+// Each record of the log is framed by its length and a CRC-32 of its content.
+// A crash can leave a partial record at the end of the log, or a disk can
+// corrupt one: the log is truncated before the first invalid record when it
+// is opened, and the records before it are kept.
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// headerSize is the size of the frame of a record: the length and the
+// CRC-32 of its content.
+const headerSize = 4 + 4
+
+// MaxRecordSize bounds the size of a record, so that a corrupted length does
+// not make Open allocate the whole memory.
+const MaxRecordSize = 1 << 24
+
+// Log is an append-only log of records. It is safe for concurrent use.
+type Log struct {
+	sync.Mutex
+
+	path string
+	file *os.File
+
+	// syncEvery is the number of appends
+	// between two syncs, 0 to never sync
+	syncEvery int
+	unsynced  int
+
+	// truncated is the number of bytes
+	// dropped when the log was opened
+	truncated int64
+}
+
+// Open opens the log at the given path, which is created if it does not
+// exist, and returns its records. The log is synced to the disk every
+// syncEvery appends: 1 syncs every record, 0 leaves it to the system and
+// Close.
+func Open(path string, syncEvery int) (*Log, [][]byte, error) {
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("failed to open log: %v", err)
+	}
+
+	records, valid, err := readRecords(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, nil, xerrors.Errorf("failed to seek log: %v", err)
+	}
+
+	// Might happen once a day
+	// A crash in the middle of a write
+	if valid < size {
+		err = f.Truncate(valid)
+		if err == nil {
+			_, err = f.Seek(valid, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, xerrors.Errorf("failed to truncate log: %v", err)
+		}
+	}
+
+	l := &Log{
+		path:      path,
+		file:      f,
+		syncEvery: syncEvery,
+		truncated: size - valid,
+	}
+
+	return l, records, nil
+}
+
+// readRecords reads the records from the start of the file, until the end or
+// the first invalid record. It returns the records and the offset of the end
+// of the last valid one.
+func readRecords(f *os.File) ([][]byte, int64, error) {
+
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("failed to seek log: %v", err)
+	}
+
+	r := bufio.NewReader(f)
+	records := make([][]byte, 0)
+	var valid int64
+
+	for {
+		var header [headerSize]byte
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			// the end, or a partial header
+			return records, valid, nil
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+
+		if length > MaxRecordSize {
+			return records, valid, nil
+		}
+
+		record := make([]byte, length)
+		_, err = io.ReadFull(r, record)
+		if err != nil || crc32.ChecksumIEEE(record) != sum {
+			return records, valid, nil
+		}
+
+		records = append(records, record)
+		valid += headerSize + int64(length)
+	}
+}
+
+// Append writes the record at the end of the log.
+func (l *Log) Append(record []byte) error {
+
+	l.Lock()
+	defer l.Unlock()
+
+	if len(record) > MaxRecordSize {
+		return xerrors.Errorf("record of %d bytes is too large", len(record))
+	}
+
+	_, err := l.file.Write(frame(record))
+	if err != nil {
+		return xerrors.Errorf("failed to append to log: %v", err)
+	}
+
+	l.unsynced++
+	if l.syncEvery > 0 && l.unsynced >= l.syncEvery {
+		return l.sync()
+	}
+
+	return nil
+}
+
+// frame returns the record preceded by its length and CRC-32.
+func frame(record []byte) []byte {
+
+	b := make([]byte, headerSize+len(record))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(record))
+	copy(b[headerSize:], record)
+
+	return b
+}
+
+// Sync writes the appended records to the disk.
+func (l *Log) Sync() error {
+
+	l.Lock()
+	defer l.Unlock()
+
+	return l.sync()
+}
+
+func (l *Log) sync() error {
+
+	err := l.file.Sync()
+	if err != nil {
+		return xerrors.Errorf("failed to sync log: %v", err)
+	}
+
+	l.unsynced = 0
+	return nil
+}
+
+// Rewrite replaces the content of the log by the given records, which must
+// describe the same state in fewer records. The new log is written next to
+// the old one and then renamed, so that a crash leaves either of them. The
+// directory is synced once renamed, so that the rename survives a crash.
+func (l *Log) Rewrite(records [][]byte) error {
+
+	l.Lock()
+	defer l.Unlock()
+
+	tmp := l.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return xerrors.Errorf("failed to create log: %v", err)
+	}
+
+	w := bufio.NewWriter(f)
+	for _, record := range records {
+		w.Write(frame(record))
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return xerrors.Errorf("failed to rewrite log: %v", err)
+	}
+
+	l.file.Close()
+	l.file = f
+	l.unsynced = 0
+
+	err = syncDir(l.path)
+	if err != nil {
+		return xerrors.Errorf("failed to sync log directory: %v", err)
+	}
+
+	return nil
+}
+
+// syncDir writes the entries of the directory holding the path to the disk.
+func syncDir(path string) error {
+
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Truncated returns the number of bytes of invalid records dropped when the
+// log was opened.
+func (l *Log) Truncated() int64 {
+	return l.truncated
+}
+
+// Close syncs and closes the log.
+func (l *Log) Close() error {
+
+	l.Lock()
+	defer l.Unlock()
+
+	err := l.sync()
+	if err != nil {
+		l.file.Close()
+		return err
+	}
+
+	err = l.file.Close()
+	if err != nil {
+		return xerrors.Errorf("failed to close log: %v", err)
+	}
+
+	return nil
+}
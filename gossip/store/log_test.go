@@ -0,0 +1,131 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_Reopen(t *testing.T) {
+	path := tempPath(t)
+
+	l, records, err := Open(path, 1)
+	require.NoError(t, err)
+	require.Len(t, records, 0)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.Append([]byte(fmt.Sprintf("record %d", i))))
+	}
+	require.NoError(t, l.Append(nil))
+	require.NoError(t, l.Close())
+
+	l, records, err = Open(path, 0)
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.Len(t, records, 11)
+	require.Equal(t, "record 9", string(records[9]))
+	require.Len(t, records[10], 0)
+	require.Equal(t, int64(0), l.Truncated())
+}
+
+func TestLog_PartialRecord(t *testing.T) {
+	path := tempPath(t)
+	appendRecords(t, path, "first", "second")
+
+	// a crash in the middle of a write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write(frame([]byte("third"))[:10])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	l, records, err := Open(path, 1)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("first"), []byte("second")}, records)
+	require.Equal(t, int64(10), l.Truncated())
+
+	// the log goes on after the valid records
+	require.NoError(t, l.Append([]byte("fourth")))
+	require.NoError(t, l.Close())
+
+	l, records, err = Open(path, 1)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, [][]byte{[]byte("first"), []byte("second"), []byte("fourth")}, records)
+}
+
+func TestLog_CorruptedRecord(t *testing.T) {
+	path := tempPath(t)
+	appendRecords(t, path, "first", "second", "third")
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	// flip a bit of the second record
+	b[headerSize+len("first")+headerSize] ^= 1
+	require.NoError(t, ioutil.WriteFile(path, b, 0600))
+
+	l, records, err := Open(path, 1)
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.Equal(t, [][]byte{[]byte("first")}, records)
+	require.Equal(t, int64(2*headerSize+len("second")+len("third")), l.Truncated())
+
+	// a corrupted length
+	b[0] = 0xFF
+	require.NoError(t, ioutil.WriteFile(path, b, 0600))
+
+	l2, records, err := Open(path, 1)
+	require.NoError(t, err)
+	defer l2.Close()
+	require.Len(t, records, 0)
+}
+
+func TestLog_Rewrite(t *testing.T) {
+	path := tempPath(t)
+
+	l, _, err := Open(path, 0)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, l.Append([]byte("x")))
+	}
+
+	require.NoError(t, l.Rewrite([][]byte{[]byte("compacted")}))
+	require.NoError(t, l.Append([]byte("after")))
+	require.NoError(t, l.Close())
+
+	l, records, err := Open(path, 0)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, [][]byte{[]byte("compacted"), []byte("after")}, records)
+
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err))
+}
+
+// tempPath returns the path of a log in a new temporary directory.
+func tempPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return filepath.Join(dir, "log")
+}
+
+// appendRecords appends the records to the log at the given path.
+func appendRecords(t *testing.T, path string, records ...string) {
+	l, _, err := Open(path, 0)
+	require.NoError(t, err)
+
+	for _, r := range records {
+		require.NoError(t, l.Append([]byte(r)))
+	}
+	require.NoError(t, l.Close())
+}
@@ -0,0 +1,218 @@
+package transport
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// inboxSize is the number of datagrams a memory transport buffers before
+// dropping new ones, like a full socket buffer would.
+const inboxSize = 1024
+
+// MemoryNetwork connects memory transports of the same process. It can
+// simulate lossy links, latency, reordering and partitions. Its random choices
+// come from a seeded source, so that a test can be replayed.
+type MemoryNetwork struct {
+	sync.Mutex
+
+	endpoints map[string]*Memory
+	ran       *rand.Rand
+
+	dropRate   float64
+	minLatency time.Duration
+	maxLatency time.Duration
+
+	// groups maps an address to its side of the partition, nil when the
+	// network is not partitioned
+	groups map[string]int
+}
+
+// NewMemoryNetwork returns a perfect network: no loss, no latency, no
+// partition.
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		endpoints: make(map[string]*Memory),
+		ran:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetDropRate sets the probability, between 0 and 1, that a datagram is lost.
+func (n *MemoryNetwork) SetDropRate(rate float64) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.dropRate = rate
+}
+
+// SetLatency sets the bounds of the delay of each datagram. The delay is drawn
+// uniformly for every datagram, so datagrams can arrive out of order when max
+// is greater than min.
+func (n *MemoryNetwork) SetLatency(min, max time.Duration) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.minLatency = min
+	n.maxLatency = max
+}
+
+// Partition splits the network: datagrams are only delivered between
+// addresses of the same group. The addresses not listed form a group of their
+// own.
+func (n *MemoryNetwork) Partition(groups ...[]string) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.groups[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes the partition.
+func (n *MemoryNetwork) Heal() {
+	n.Lock()
+	defer n.Unlock()
+
+	n.groups = nil
+}
+
+// Listen returns a transport receiving the datagrams sent to the given
+// address, which must be a valid IPv4 UDP address not used by another
+// transport of the network.
+func (n *MemoryNetwork) Listen(address string) (Transport, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, xerrors.Errorf("could not resolve UDP addr: %v", err)
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if _, ok := n.endpoints[addr.String()]; ok {
+		return nil, xerrors.Errorf("address already in use: %v", addr)
+	}
+
+	m := &Memory{
+		network: n,
+		addr:    addr,
+		inbox:   make(chan datagram, inboxSize),
+		closed:  make(chan struct{}),
+	}
+	n.endpoints[addr.String()] = m
+
+	return m, nil
+}
+
+// route decides the fate of a datagram and delivers it, now or later.
+func (n *MemoryNetwork) route(b []byte, from, to *net.UDPAddr) {
+	n.Lock()
+	defer n.Unlock()
+
+	dst, ok := n.endpoints[to.String()]
+
+	// like UDP, sending to nobody is not an error
+	if !ok {
+		return
+	}
+
+	if n.groups != nil && n.groups[from.String()] != n.groups[to.String()] {
+		return
+	}
+
+	if n.dropRate > 0 && n.ran.Float64() < n.dropRate {
+		return
+	}
+
+	latency := n.minLatency
+	if n.maxLatency > n.minLatency {
+		latency += time.Duration(n.ran.Int63n(int64(n.maxLatency - n.minLatency)))
+	}
+
+	// the sender may reuse its buffer
+	d := datagram{b: append([]byte(nil), b...), from: from}
+
+	if latency == 0 {
+		dst.deliver(d)
+		return
+	}
+
+	time.AfterFunc(latency, func() {
+		dst.deliver(d)
+	})
+}
+
+func (n *MemoryNetwork) remove(addr *net.UDPAddr) {
+	n.Lock()
+	defer n.Unlock()
+
+	delete(n.endpoints, addr.String())
+}
+
+// datagram is a datagram in transit on a memory network.
+type datagram struct {
+	b    []byte
+	from *net.UDPAddr
+}
+
+// Memory is a transport of a memory network.
+//
+// - implements transport.Transport
+type Memory struct {
+	network *MemoryNetwork
+	addr    *net.UDPAddr
+	inbox   chan datagram
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Send implements transport.Transport
+func (m *Memory) Send(b []byte, to *net.UDPAddr) error {
+	select {
+	case <-m.closed:
+		return ErrClosed
+	default:
+	}
+
+	m.network.route(b, m.addr, to)
+	return nil
+}
+
+// Receive implements transport.Transport
+func (m *Memory) Receive(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case <-m.closed:
+		return 0, nil, ErrClosed
+	case d := <-m.inbox:
+		n := copy(b, d.b)
+		return n, d.from, nil
+	}
+}
+
+// Close implements transport.Transport
+func (m *Memory) Close() error {
+	m.closeOnce.Do(func() {
+		m.network.remove(m.addr)
+		close(m.closed)
+	})
+	return nil
+}
+
+// LocalAddr implements transport.Transport
+func (m *Memory) LocalAddr() *net.UDPAddr {
+	return m.addr
+}
+
+// deliver queues the datagram, or drops it if the inbox is full.
+func (m *Memory) deliver(d datagram) {
+	select {
+	case m.inbox <- d:
+	default:
+	}
+}
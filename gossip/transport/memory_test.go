@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory_SendReceive(t *testing.T) {
+	network := NewMemoryNetwork(1)
+	t1 := listen(t, network, "127.0.0.1:1")
+	t2 := listen(t, network, "127.0.0.1:2")
+
+	require.NoError(t, t1.Send([]byte("hello"), t2.LocalAddr()))
+
+	b := make([]byte, 100)
+	n, from, err := t2.Receive(b)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b[:n]))
+	require.Equal(t, t1.LocalAddr().String(), from.String())
+}
+
+func TestMemory_Close(t *testing.T) {
+	network := NewMemoryNetwork(1)
+	t1 := listen(t, network, "127.0.0.1:1")
+
+	done := make(chan error)
+	go func() {
+		_, _, err := t1.Receive(make([]byte, 100))
+		done <- err
+	}()
+
+	require.NoError(t, t1.Close())
+	select {
+	case err := <-done:
+		require.Equal(t, ErrClosed, err)
+	case <-time.After(time.Second):
+		require.Fail(t, "Receive not unblocked by Close")
+	}
+
+	require.Equal(t, ErrClosed, t1.Send([]byte("hello"), t1.LocalAddr()))
+
+	// the address can be reused
+	listen(t, network, "127.0.0.1:1")
+}
+
+func TestMemory_DropRate(t *testing.T) {
+	network := NewMemoryNetwork(1)
+	network.SetDropRate(0.5)
+	t1 := listen(t, network, "127.0.0.1:1")
+	t2 := listen(t, network, "127.0.0.1:2")
+
+	const sent = 1000
+	for i := 0; i < sent; i++ {
+		require.NoError(t, t1.Send([]byte("x"), t2.LocalAddr()))
+	}
+
+	received := len(t2.(*Memory).inbox)
+	require.InDelta(t, sent/2, received, sent/10)
+}
+
+func TestMemory_LatencyReorders(t *testing.T) {
+	network := NewMemoryNetwork(1)
+	network.SetLatency(0, 20*time.Millisecond)
+	t1 := listen(t, network, "127.0.0.1:1")
+	t2 := listen(t, network, "127.0.0.1:2")
+
+	const sent = 50
+	for i := 0; i < sent; i++ {
+		require.NoError(t, t1.Send([]byte(fmt.Sprint(i)), t2.LocalAddr()))
+	}
+
+	b := make([]byte, 100)
+	inOrder := true
+	for i := 0; i < sent; i++ {
+		n, _, err := t2.Receive(b)
+		require.NoError(t, err)
+		if string(b[:n]) != fmt.Sprint(i) {
+			inOrder = false
+		}
+	}
+
+	require.False(t, inOrder, "Expected some datagrams to be reordered")
+}
+
+func TestMemory_Partition(t *testing.T) {
+	network := NewMemoryNetwork(1)
+	t1 := listen(t, network, "127.0.0.1:1")
+	t2 := listen(t, network, "127.0.0.1:2")
+	t3 := listen(t, network, "127.0.0.1:3")
+
+	network.Partition([]string{"127.0.0.1:1", "127.0.0.1:2"}, []string{"127.0.0.1:3"})
+
+	require.NoError(t, t1.Send([]byte("x"), t2.LocalAddr()))
+	require.NoError(t, t1.Send([]byte("x"), t3.LocalAddr()))
+	require.Len(t, t2.(*Memory).inbox, 1)
+	require.Len(t, t3.(*Memory).inbox, 0)
+
+	network.Heal()
+
+	require.NoError(t, t1.Send([]byte("x"), t3.LocalAddr()))
+	require.Len(t, t3.(*Memory).inbox, 1)
+}
+
+func listen(t *testing.T, network *MemoryNetwork, address string) Transport {
+	tr, err := network.Listen(address)
+	require.NoError(t, err)
+	require.Equal(t, address, tr.LocalAddr().String())
+
+	_, err = network.Listen(address)
+	require.Error(t, err, "Expected the address to be in use")
+
+	return tr
+}
+
@@ -0,0 +1,26 @@
+package transport
+
+import (
+	"net"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrClosed is returned by Receive and Send once the transport is closed.
+var ErrClosed = xerrors.New("transport closed")
+
+// Transport describes the primitives a gossiper needs to exchange datagrams
+// with its peers.
+type Transport interface {
+	// Send sends the datagram to the given address. Like UDP, it does not
+	// guarantee that the datagram is delivered.
+	Send(b []byte, to *net.UDPAddr) error
+	// Receive blocks until a datagram arrives, copies it into b and returns
+	// its length and its sender. It returns ErrClosed once the transport is
+	// closed.
+	Receive(b []byte) (int, *net.UDPAddr, error)
+	// Close closes the transport and unblocks Receive.
+	Close() error
+	// LocalAddr returns the address the transport listens on.
+	LocalAddr() *net.UDPAddr
+}
@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// Multicast is a transport receiving the datagrams sent to a UDP multicast
+// group, its own included, and sending datagrams from another socket.
+//
+// - implements transport.Transport
+type Multicast struct {
+	sync.Mutex
+	group  *net.UDPAddr
+	listen *net.UDPConn
+	send   *net.UDPConn
+	closed bool
+}
+
+// NewMulticast returns a transport listening to the given multicast group,
+// which must be a valid IPv4 multicast UDP address, on every interface.
+func NewMulticast(group string) (Transport, error) {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, xerrors.Errorf("could not resolve multicast group: %v", err)
+	}
+
+	if !addr.IP.IsMulticast() {
+		return nil, xerrors.Errorf("%v is not a multicast address", group)
+	}
+
+	listen, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, xerrors.Errorf("could not join multicast group: %v", err)
+	}
+
+	send, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		listen.Close()
+		return nil, xerrors.Errorf("could not listen to UDP addr: %v", err)
+	}
+
+	return &Multicast{group: addr, listen: listen, send: send}, nil
+}
+
+// Send implements transport.Transport
+func (m *Multicast) Send(b []byte, to *net.UDPAddr) error {
+	_, err := m.send.WriteToUDP(b, to)
+	if err != nil && m.isClosed() {
+		return ErrClosed
+	}
+	return err
+}
+
+// Receive implements transport.Transport
+func (m *Multicast) Receive(b []byte) (int, *net.UDPAddr, error) {
+	n, sender, err := m.listen.ReadFromUDP(b)
+	if err != nil && m.isClosed() {
+		return 0, nil, ErrClosed
+	}
+	return n, sender, err
+}
+
+// Close implements transport.Transport
+func (m *Multicast) Close() error {
+	m.Lock()
+	m.closed = true
+	m.Unlock()
+
+	m.send.Close()
+	return m.listen.Close()
+}
+
+// LocalAddr implements transport.Transport. It returns the multicast group.
+func (m *Multicast) LocalAddr() *net.UDPAddr {
+	return m.group
+}
+
+func (m *Multicast) isClosed() bool {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.closed
+}
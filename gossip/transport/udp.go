@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// UDP is a transport sending datagrams over a UDP socket.
+//
+// - implements transport.Transport
+type UDP struct {
+	sync.Mutex
+	conn   *net.UDPConn
+	closed bool
+}
+
+// NewUDP returns a UDP transport listening on the given address, which must
+// be a valid IPv4 UDP address.
+func NewUDP(address string) (Transport, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, xerrors.Errorf("could not resolve UDP addr: %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, xerrors.Errorf("could not listen to UDP addr: %v", err)
+	}
+
+	return &UDP{conn: conn}, nil
+}
+
+// Send implements transport.Transport
+func (u *UDP) Send(b []byte, to *net.UDPAddr) error {
+	_, err := u.conn.WriteToUDP(b, to)
+	if err != nil && u.isClosed() {
+		return ErrClosed
+	}
+	return err
+}
+
+// Receive implements transport.Transport
+func (u *UDP) Receive(b []byte) (int, *net.UDPAddr, error) {
+	n, sender, err := u.conn.ReadFromUDP(b)
+	if err != nil && u.isClosed() {
+		return 0, nil, ErrClosed
+	}
+	return n, sender, err
+}
+
+// Close implements transport.Transport
+func (u *UDP) Close() error {
+	u.Lock()
+	u.closed = true
+	u.Unlock()
+
+	return u.conn.Close()
+}
+
+// LocalAddr implements transport.Transport
+func (u *UDP) LocalAddr() *net.UDPAddr {
+	return u.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (u *UDP) isClosed() bool {
+	u.Lock()
+	defer u.Unlock()
+
+	return u.closed
+}
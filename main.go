@@ -9,6 +9,7 @@ package main
 import (
 	"flag"
 	"strings"
+	"time"
 
 	"go.dedis.ch/cs438/hw1/gossip"
 	"go.dedis.ch/cs438/hw1/client"
@@ -28,8 +29,110 @@ func main() {
 	peers := flag.String("peers", "", "peer addresses used for bootstrap")
 	broadcastMode := flag.Bool("broadcast", true, "run gossiper in broadcast mode")
 	routeTimer := flag.Int("rtimer", 0, "route rumors sending period in seconds, 0 to disable sending of route rumors (default)")
+	hopLimit := flag.Int("hopLimit", gossip.DefaultHopLimit, "number of hops a private message can travel, 10 if not positive")
+	wire := flag.String("wire", "binary", "encoding of the packets, binary (with the peers supporting it) or json")
+	network := flag.String("network", "", "ID of the network, only the peers with the same ID are discovered, and heard if the network has a key")
+	networkKey := flag.String("networkKey", "", "pre-shared key of the network, the network is open if empty")
+	storePath := flag.String("store", "", "path of the file keeping the messages, peers and routes across restarts, none if empty")
+	storeSync := flag.Int("storeSync", 1, "number of records written to the store between two syncs to the disk, 0 to leave it to the system")
+	probe := flag.Int("probe", 0, "interval in seconds between two probes of the silent peers, 0 to disable the failure detector (default)")
+	peerExchange := flag.Int("peerExchange", 0, "interval in seconds between two exchanges of peers, 0 to disable sending them (default)")
+	maxPeers := flag.Int("maxPeers", 64, "number of peers that can be learnt from exchanges and discovery")
+	discover := flag.Bool("discover", false, "announce the node and find the nodes of the same network on the LAN with UDP multicast")
+	discoveryGroup := flag.String("discoveryGroup", gossip.DefaultDiscoveryGroup, "multicast group ip:port of the discovery")
+	antiEntropyMode := flag.String("antiEntropyMode", "status", "what the anti-entropy sends, the status or its digest, the peers not reading digests get the status")
+	fanout := flag.Int("fanout", 1, "number of random peers each rumor is mongered with")
+	antiEntropyPeers := flag.Int("antiEntropyPeers", 1, "number of random peers contacted every anti-entropy interval")
+	syncMode := flag.String("sync", "pushpull", "direction of the rumors exchanged by the anti-entropy, pushpull, push or pull")
+	queueDepth := flag.Int("queue", 256, "number of datagrams waiting to be sent to a peer, 0 to send them directly")
+	queueBlock := flag.Bool("queueBlock", false, "keep the packets until there is room in the queue of a peer instead of dropping them")
+	compress := flag.Int("compress", 512, "size in bytes above which the packets are compressed for the peers reading them, 0 to disable")
+	rateLimit := flag.Float64("rateLimit", 0, "number of datagrams handled per second from each address, twice as many in a burst, 0 to disable the limit (default)")
+	originLimit := flag.Float64("originLimit", 0, "number of new rumors handled per second from each origin, twice as many in a burst, 0 to disable the limit (default)")
+	banStrikes := flag.Int("banStrikes", 10, "number of invalid packets in a burst after which a peer is banned, 0 to disable the automatic bans")
+	banDuration := flag.Int("banDuration", 600, "duration in seconds of the automatic bans")
+	dissemination := flag.String("dissemination", "mongering", "how the rumors are spread when not in broadcast mode, by mongering or plumtree, which every peer must use")
 	flag.Parse()
 
+	var wireFormat gossip.WireFormat
+	switch *wire {
+	case "binary":
+		wireFormat = gossip.WireBinary
+	case "json":
+		wireFormat = gossip.WireJSON
+	default:
+		log.Fatal("Unknown wire format:", *wire)
+	}
+
+	var mode gossip.AntiEntropyMode
+	switch *antiEntropyMode {
+	case "status":
+		mode = gossip.AntiEntropyStatus
+	case "digest":
+		mode = gossip.AntiEntropyDigest
+	default:
+		log.Fatal("Unknown anti-entropy mode:", *antiEntropyMode)
+	}
+
+	var disseminationMode gossip.DisseminationMode
+	switch *dissemination {
+	case "mongering":
+		disseminationMode = gossip.DisseminationMongering
+	case "plumtree":
+		disseminationMode = gossip.DisseminationPlumtree
+	default:
+		log.Fatal("Unknown dissemination mode:", *dissemination)
+	}
+
+	var direction gossip.SyncMode
+	switch *syncMode {
+	case "pushpull":
+		direction = gossip.SyncPushPull
+	case "push":
+		direction = gossip.SyncPush
+	case "pull":
+		direction = gossip.SyncPull
+	default:
+		log.Fatal("Unknown sync mode:", *syncMode)
+	}
+
+	opts := []gossip.Option{gossip.WithWireFormat(wireFormat), gossip.WithAntiEntropyMode(mode),
+		gossip.WithDissemination(disseminationMode), gossip.WithFanout(*fanout),
+		gossip.WithAntiEntropyPeers(*antiEntropyPeers), gossip.WithSyncMode(direction),
+		gossip.WithCompression(*compress),
+		gossip.WithRateLimits(*rateLimit, int(2**rateLimit), *originLimit, int(2**originLimit)),
+		gossip.WithBans(*banStrikes, time.Duration(*banDuration)*time.Second)}
+
+	if *queueBlock {
+		opts = append(opts, gossip.WithSendQueue(*queueDepth, gossip.QueueBlock))
+	} else {
+		opts = append(opts, gossip.WithSendQueue(*queueDepth, gossip.QueueDrop))
+	}
+
+	if *probe > 0 {
+		opts = append(opts, gossip.WithFailureDetector(time.Duration(*probe)*time.Second))
+	}
+
+	// the peers learnt from the
+	// others are bounded anyway
+	opts = append(opts, gossip.WithPeerExchange(time.Duration(*peerExchange)*time.Second, *maxPeers))
+
+	if *storePath != "" {
+		opts = append(opts, gossip.WithStore(*storePath, *storeSync))
+	}
+
+	// without a key, the network
+	// only restricts the discovery
+	if *networkKey != "" {
+		opts = append(opts, gossip.WithNetwork(*network, []byte(*networkKey)))
+	} else if *network != "" {
+		opts = append(opts, gossip.WithNetwork(*network, nil))
+	}
+
+	if *discover {
+		opts = append(opts, gossip.WithDiscovery(*discoveryGroup, 5*time.Second))
+	}
+
 	UIAddress := "127.0.0.1:" + *UIPort
 	gossipAddress := *gossipAddr
 	bootstrapAddr := strings.Split(*peers, ",")
@@ -37,7 +140,7 @@ func main() {
 	// The work happens in the gossip folder. You should not touch the code in
 	// this package.
 	fac := gossip.GetFactory()
-	g, err := fac.New(gossipAddress, *ownName, *antiEntropy, *routeTimer)
+	g, err := fac.New(gossipAddress, *ownName, *antiEntropy, *routeTimer, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -46,7 +149,7 @@ func main() {
 		g.AddAddresses(bootstrapAddr...)
 	}
 
-	controller := NewController(*ownName, UIAddress, gossipAddress, *broadcastMode, g, bootstrapAddr...)
+	controller := NewController(*ownName, UIAddress, gossipAddress, *broadcastMode, *hopLimit, g, bootstrapAddr...)
 
 	ready := make(chan struct{})
 	go g.Run(ready)
@@ -97,7 +97,7 @@ $(document).ready(function () {
                 for (var i = 0; i < data.length; i++) {
                     messages.push("<li class=\"list-group-item\">\n" +
                         "<p class=\"list-group-item-text\"> <b>" + data[i].Origin +
-                        ":</b>  " + data[i].Text + "</p>\n</li>");
+                        ":</b>  " + data[i].Text + privateMarker(data[i]) + "</p>\n</li>");
                 }
             } else {
                 messages.push("<li class=\"list-group-item\">\n" +
@@ -109,6 +109,20 @@ $(document).ready(function () {
         $("#chatbox").scrollTop($("#chatbox")[0].scrollHeight);
     }
 
+    // Describes how a private message reached us
+    function privateMarker(message) {
+        if (!message.Private) {
+            return "";
+        }
+        if (!message.Decrypted) {
+            return " <i>(private, not encrypted)</i>";
+        }
+        if (!message.Authenticated) {
+            return " <i>(private, encrypted, sender not authenticated)</i>";
+        }
+        return " <i>(private, encrypted, authenticated)</i>";
+    }
+
     // GET request to the backend to obtain the latest list of gossiping nodes
     function refreshOriginbox() {
         $.getJSON("/origin", function (nodes) {
@@ -0,0 +1,320 @@
+package topology
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/xerrors"
+)
+
+// token is a lexical token of a topology file. Quoted strings are unquoted
+// and never taken for keywords or symbols.
+type token struct {
+	text   string
+	quoted bool
+	line   int
+}
+
+// is tells whether the token is the given symbol or keyword.
+func (t token) is(s string) bool {
+	return !t.quoted && t.text == s
+}
+
+// tokenize splits a topology file into tokens.
+func tokenize(s string) ([]token, error) {
+
+	tokens := make([]token, 0)
+	line := 1
+	r := []rune(s)
+
+	for i := 0; i < len(r); {
+
+		c := r[i]
+
+		switch {
+		case c == '\n':
+			line++
+			i++
+
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '#' || c == '/' && i+1 < len(r) && r[i+1] == '/':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			i += 2
+			for i < len(r) && !(r[i] == '*' && i+1 < len(r) && r[i+1] == '/') {
+				if r[i] == '\n' {
+					line++
+				}
+				i++
+			}
+			if i >= len(r) {
+				return nil, xerrors.Errorf("line %d: unterminated comment", line)
+			}
+			i += 2
+
+		case c == '"':
+			var b strings.Builder
+			i++
+			for i < len(r) && r[i] != '"' {
+				if r[i] == '\\' && i+1 < len(r) {
+					i++
+				}
+				if r[i] == '\n' {
+					line++
+				}
+				b.WriteRune(r[i])
+				i++
+			}
+			if i >= len(r) {
+				return nil, xerrors.Errorf("line %d: unterminated string", line)
+			}
+			i++
+			tokens = append(tokens, token{text: b.String(), quoted: true, line: line})
+
+		case c == '-' && i+1 < len(r) && (r[i+1] == '>' || r[i+1] == '-'):
+			tokens = append(tokens, token{text: string(r[i : i+2]), line: line})
+			i += 2
+
+		case strings.ContainsRune("{}[];,=", c):
+			tokens = append(tokens, token{text: string(c), line: line})
+			i++
+
+		case isIDRune(c):
+			start := i
+			for i < len(r) && isIDRune(r[i]) {
+				i++
+			}
+			tokens = append(tokens, token{text: string(r[start:i]), line: line})
+
+		default:
+			return nil, xerrors.Errorf("line %d: unexpected character %q", line, c)
+		}
+	}
+
+	return tokens, nil
+}
+
+// isIDRune tells whether the rune can be part of an unquoted identifier. Dots
+// and colons are allowed so that addresses need no quotes.
+func isIDRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("_.:", c)
+}
+
+// parser reads the statements of a topology file:
+//
+//	file  = ["strict"] ("graph" | "digraph") [id] "{" {stmt [";"]} "}"
+//	stmt  = id "=" id
+//	      | "graph" attrs
+//	      | id [attrs]
+//	      | id {("->" | "--") id} [attrs]
+//	attrs = "[" [id "=" id {[","|";"] id "=" id}] "]"
+type parser struct {
+	tokens []token
+	pos    int
+
+	graph     map[string]string
+	nodeAttrs map[string]map[string]string
+	// order holds the names of the nodes in the
+	// order they first appear
+	order []string
+
+	topo *Topology
+}
+
+func (p *parser) parse() error {
+
+	if p.peek().is("strict") {
+		p.pos++
+	}
+
+	kind := p.next()
+	if !kind.is("graph") && !kind.is("digraph") {
+		return p.errorf(kind, "expected graph or digraph")
+	}
+
+	if p.isID(p.peek()) {
+		p.topo.Name = p.next().text
+	}
+
+	err := p.expect("{")
+	if err != nil {
+		return err
+	}
+
+	for {
+		t := p.peek()
+
+		switch {
+		case t.is("}"):
+			p.pos++
+			if p.pos < len(p.tokens) {
+				return p.errorf(p.peek(), "unexpected content after the graph")
+			}
+			return nil
+
+		case t.is(";"):
+			p.pos++
+
+		case p.pos >= len(p.tokens):
+			return p.errorf(t, "missing }")
+
+		default:
+			err := p.statement()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *parser) statement() error {
+
+	t := p.next()
+
+	if t.is("graph") {
+		return p.attrs(p.graph)
+	}
+
+	if t.is("node") || t.is("edge") || t.is("subgraph") {
+		return p.errorf(t, "%v statements are not supported", t.text)
+	}
+
+	if !p.isID(t) {
+		return p.errorf(t, "expected a node name")
+	}
+
+	// graph attribute
+	if p.peek().is("=") {
+		p.pos++
+		value := p.next()
+		if !p.isID(value) {
+			return p.errorf(value, "expected a value for %v", t.text)
+		}
+		p.graph[t.text] = value.text
+		return nil
+	}
+
+	p.addNode(t.text)
+	from := t.text
+
+	for p.peek().is("->") || p.peek().is("--") {
+
+		op := p.next()
+		to := p.next()
+		if !p.isID(to) {
+			return p.errorf(to, "expected a node name after %v", op.text)
+		}
+		if to.text == from {
+			return p.errorf(to, "node %v cannot be its own peer", from)
+		}
+
+		p.addNode(to.text)
+		p.topo.Edges = append(p.topo.Edges, Edge{From: from, To: to.text})
+		if op.is("--") {
+			p.topo.Edges = append(p.topo.Edges, Edge{From: to.text, To: from})
+		}
+
+		from = to.text
+	}
+
+	// the attributes of an edge statement
+	// would apply to the edges
+	if p.peek().is("[") {
+		if from != t.text {
+			return p.errorf(p.peek(), "edge attributes are not supported")
+		}
+		return p.attrs(p.nodeAttrs[t.text])
+	}
+
+	return nil
+}
+
+// attrs parses an attribute list into the given map.
+func (p *parser) attrs(into map[string]string) error {
+
+	err := p.expect("[")
+	if err != nil {
+		return err
+	}
+
+	for {
+		t := p.next()
+
+		switch {
+		case t.is("]"):
+			return nil
+		case t.is(",") || t.is(";"):
+			continue
+		case !p.isID(t):
+			return p.errorf(t, "expected an attribute name")
+		}
+
+		err := p.expect("=")
+		if err != nil {
+			return err
+		}
+
+		value := p.next()
+		if !p.isID(value) {
+			return p.errorf(value, "expected a value for %v", t.text)
+		}
+
+		into[t.text] = value.text
+	}
+}
+
+func (p *parser) addNode(name string) {
+	if _, ok := p.nodeAttrs[name]; ok {
+		return
+	}
+	p.nodeAttrs[name] = make(map[string]string)
+	p.order = append(p.order, name)
+}
+
+// isID tells whether the token can be a name or a value.
+func (p *parser) isID(t token) bool {
+	if t.quoted {
+		return true
+	}
+	return t.text != "" && isIDRune([]rune(t.text)[0])
+}
+
+func (p *parser) expect(s string) error {
+	t := p.next()
+	if !t.is(s) {
+		return p.errorf(t, "expected %v", s)
+	}
+	return nil
+}
+
+// peek returns the next token, or an empty token at the end of the file.
+func (p *parser) peek() token {
+	if p.pos >= len(p.tokens) {
+		line := 0
+		if len(p.tokens) > 0 {
+			line = p.tokens[len(p.tokens)-1].line
+		}
+		return token{line: line}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	found := t.text
+	if p.pos > len(p.tokens) || found == "" && !t.quoted {
+		found = "end of file"
+	}
+	return xerrors.Errorf("line %d: %v, found %q", t.line, fmt.Sprintf(format, args...), found)
+}
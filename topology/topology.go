@@ -0,0 +1,295 @@
+// Package topology reads the description of a network of gossipers: the
+// nodes, their addresses and who knows whom. The description is written in a
+// subset of the Graphviz DOT language, so that it can also be drawn:
+//
+//	digraph demo {
+//		antiEntropy=1; rtimer=5;
+//
+//		A [addr="127.0.0.1:5000", ui=8080];
+//		B [addr="127.0.0.1:5001", ui=8081, antiEntropy=10];
+//		C;
+//
+//		A -- B;      // A and B know each other
+//		C -> A -> B; // C knows A, which knows B
+//	}
+//
+// An edge `X -> Y` gives the address of Y to X, like `-peers` on the command
+// line. An edge `X -- Y` goes both ways. Both kinds of edge can be used in
+// graphs and digraphs. Comments start with `//` or `#`.
+package topology
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+
+	"golang.org/x/xerrors"
+)
+
+// DefaultAntiEntropy is the anti-entropy period, in seconds, of the nodes
+// when the topology does not set it. It is the default of the command line.
+const DefaultAntiEntropy = 10
+
+// Node is a gossiper of the topology.
+type Node struct {
+	Name string
+	// Addr is the gossip address, empty if the topology does not set it
+	Addr string
+	// UIPort is the port of the UI, empty if the topology does not set it
+	UIPort string
+	// AntiEntropy is the anti-entropy period in seconds
+	AntiEntropy int
+	// RouteTimer is the route rumors period in seconds, 0 to disable them
+	RouteTimer int
+}
+
+// Edge gives the address of To to From.
+type Edge struct {
+	From string
+	To   string
+}
+
+// Topology is a parsed topology file.
+type Topology struct {
+	Name string
+	// Nodes are in the order they appear in the file
+	Nodes []*Node
+	// Edges are in the order they appear in the file, an undirected edge
+	// gives two edges
+	Edges []Edge
+}
+
+// Load parses the topology file at the given path.
+func Load(path string) (*Topology, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open topology: %v", err)
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse parses a topology. The graph attributes antiEntropy and rtimer are
+// the defaults of the nodes, which can override them.
+func Parse(r io.Reader) (*Topology, error) {
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read topology: %v", err)
+	}
+
+	tokens, err := tokenize(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{
+		tokens:    tokens,
+		graph:     make(map[string]string),
+		nodeAttrs: make(map[string]map[string]string),
+		topo:      &Topology{},
+	}
+
+	err = p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	return p.topo, nil
+}
+
+// Node returns the node with the given name, or nil.
+func (t *Topology) Node(name string) *Node {
+	for _, n := range t.Nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// Peers returns the addresses known by the node with the given name at
+// startup, in the order of the edges.
+func (t *Topology) Peers(name string) []string {
+
+	peers := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, e := range t.Edges {
+		if e.From != name || seen[e.To] {
+			continue
+		}
+		seen[e.To] = true
+
+		if n := t.Node(e.To); n != nil && n.Addr != "" {
+			peers = append(peers, n.Addr)
+		}
+	}
+
+	return peers
+}
+
+// AssignAddresses gives consecutive addresses on host, from the given ports,
+// to the nodes without gossip address or UI port, skipping the ports already
+// used by the topology.
+func (t *Topology) AssignAddresses(host string, gossipPort, uiPort int) {
+
+	used := make(map[string]bool)
+	for _, n := range t.Nodes {
+		if n.Addr != "" {
+			used[n.Addr] = true
+		}
+		if n.UIPort != "" {
+			used[":"+n.UIPort] = true
+		}
+	}
+
+	for _, n := range t.Nodes {
+
+		for n.Addr == "" {
+			addr := host + ":" + strconv.Itoa(gossipPort)
+			gossipPort++
+			if !used[addr] {
+				n.Addr = addr
+				used[addr] = true
+			}
+		}
+
+		for n.UIPort == "" {
+			port := strconv.Itoa(uiPort)
+			uiPort++
+			if !used[":"+port] {
+				n.UIPort = port
+				used[":"+port] = true
+			}
+		}
+	}
+}
+
+// Validate checks that every node has its own gossip address and UI port.
+func (t *Topology) Validate() error {
+
+	addrs := make(map[string]string)
+	ports := make(map[string]string)
+
+	for _, n := range t.Nodes {
+
+		if n.Addr == "" {
+			return xerrors.Errorf("node %v has no address", n.Name)
+		}
+		if other, ok := addrs[n.Addr]; ok {
+			return xerrors.Errorf("nodes %v and %v have the same address %v", other, n.Name, n.Addr)
+		}
+		addrs[n.Addr] = n.Name
+
+		if n.UIPort == "" {
+			continue
+		}
+		if other, ok := ports[n.UIPort]; ok {
+			return xerrors.Errorf("nodes %v and %v have the same UI port %v", other, n.Name, n.UIPort)
+		}
+		ports[n.UIPort] = n.Name
+	}
+
+	return nil
+}
+
+// resolve creates the nodes from their attributes and the defaults of the
+// graph.
+func (p *parser) resolve() error {
+
+	aeDefault, err := intAttr(p.graph, "antiEntropy", DefaultAntiEntropy)
+	if err != nil {
+		return xerrors.Errorf("graph: %v", err)
+	}
+
+	rtDefault, err := intAttr(p.graph, "rtimer", 0)
+	if err != nil {
+		return xerrors.Errorf("graph: %v", err)
+	}
+
+	for _, k := range sortedKeys(p.graph) {
+		if k != "antiEntropy" && k != "rtimer" {
+			return xerrors.Errorf("graph: unknown attribute %v", k)
+		}
+	}
+
+	for _, name := range p.order {
+
+		attrs := p.nodeAttrs[name]
+
+		for _, k := range sortedKeys(attrs) {
+			switch k {
+			case "addr", "ui", "antiEntropy", "rtimer":
+			default:
+				return xerrors.Errorf("node %v: unknown attribute %v", name, k)
+			}
+		}
+
+		ae, err := intAttr(attrs, "antiEntropy", aeDefault)
+		if err != nil {
+			return xerrors.Errorf("node %v: %v", name, err)
+		}
+
+		rt, err := intAttr(attrs, "rtimer", rtDefault)
+		if err != nil {
+			return xerrors.Errorf("node %v: %v", name, err)
+		}
+
+		if ui, ok := attrs["ui"]; ok {
+			_, err := strconv.ParseUint(ui, 10, 16)
+			if err != nil {
+				return xerrors.Errorf("node %v: invalid ui port %v", name, ui)
+			}
+		}
+
+		p.topo.Nodes = append(p.topo.Nodes, &Node{
+			Name:        name,
+			Addr:        attrs["addr"],
+			UIPort:      attrs["ui"],
+			AntiEntropy: ae,
+			RouteTimer:  rt,
+		})
+	}
+
+	return nil
+}
+
+// intAttr returns the integer value of the attribute, or def if it is not
+// set.
+func intAttr(attrs map[string]string, key string, def int) (int, error) {
+
+	value, ok := attrs[key]
+	if !ok {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, xerrors.Errorf("invalid %v: %v", key, value)
+	}
+
+	return i, nil
+}
+
+// sortedKeys returns the keys of the map in order, so that the same file
+// always gives the same error.
+func sortedKeys(m map[string]string) []string {
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,97 @@
+package topology
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	topo, err := Parse(strings.NewReader(`
+		# a small demo
+		digraph demo {
+			antiEntropy=1; rtimer=5;
+
+			A [addr="127.0.0.1:5000", ui=8080];
+			B [addr=127.0.0.1:5001 ui=8081 antiEntropy=10];
+			C;
+
+			A -- B;      // both ways
+			C -> A -> B; /* one way */
+		}`))
+	require.NoError(t, err)
+
+	require.Equal(t, "demo", topo.Name)
+	require.Len(t, topo.Nodes, 3)
+
+	require.Equal(t, &Node{Name: "A", Addr: "127.0.0.1:5000", UIPort: "8080",
+		AntiEntropy: 1, RouteTimer: 5}, topo.Nodes[0])
+	require.Equal(t, &Node{Name: "B", Addr: "127.0.0.1:5001", UIPort: "8081",
+		AntiEntropy: 10, RouteTimer: 5}, topo.Nodes[1])
+	require.Equal(t, &Node{Name: "C", AntiEntropy: 1, RouteTimer: 5}, topo.Nodes[2])
+
+	require.Equal(t, []Edge{{"A", "B"}, {"B", "A"}, {"C", "A"}, {"A", "B"}}, topo.Edges)
+
+	require.Equal(t, []string{"127.0.0.1:5001"}, topo.Peers("A"))
+	require.Equal(t, []string{"127.0.0.1:5000"}, topo.Peers("B"))
+
+	// C has no address yet
+	require.Error(t, topo.Validate())
+
+	topo.AssignAddresses("127.0.0.1", 5000, 8080)
+	require.NoError(t, topo.Validate())
+	require.Equal(t, "127.0.0.1:5002", topo.Nodes[2].Addr)
+	require.Equal(t, "8082", topo.Nodes[2].UIPort)
+	require.Equal(t, []string{"127.0.0.1:5000"}, topo.Peers("C"))
+}
+
+func TestParse_Defaults(t *testing.T) {
+	topo, err := Parse(strings.NewReader(`graph { A -- B }`))
+	require.NoError(t, err)
+
+	require.Len(t, topo.Nodes, 2)
+	require.Equal(t, DefaultAntiEntropy, topo.Nodes[0].AntiEntropy)
+	require.Equal(t, 0, topo.Nodes[0].RouteTimer)
+}
+
+func TestParse_Errors(t *testing.T) {
+	bad := []string{
+		``,
+		`tree { A }`,
+		`digraph { A -> }`,
+		`digraph { A -> A }`,
+		`digraph { A [addr] }`,
+		`digraph { A [color=red] }`,
+		`digraph { A [antiEntropy=-1] }`,
+		`digraph { A [ui=99999] }`,
+		`digraph { A -> B [weight=1] }`,
+		`digraph { node [addr=x] }`,
+		`digraph { size=10 }`,
+		`digraph { A "unterminated }`,
+		`digraph { A }}`,
+		`digraph { A`,
+		`digraph { A ! B }`,
+	}
+
+	for _, s := range bad {
+		_, err := Parse(strings.NewReader(s))
+		require.Error(t, err, s)
+	}
+}
+
+func TestValidate_Duplicates(t *testing.T) {
+	topo, err := Parse(strings.NewReader(`digraph {
+		A [addr="127.0.0.1:5000"];
+		B [addr="127.0.0.1:5000"];
+	}`))
+	require.NoError(t, err)
+	require.Error(t, topo.Validate())
+
+	topo, err = Parse(strings.NewReader(`digraph {
+		A [addr="127.0.0.1:5000", ui=8080];
+		B [addr="127.0.0.1:5001", ui=8080];
+	}`))
+	require.NoError(t, err)
+	require.Error(t, topo.Validate())
+}